@@ -0,0 +1,255 @@
+// Package agent contains a fake edge agent that speaks the Stratus node
+// protocol without running any workloads: it "runs" whatever it is assigned
+// by reporting it as running. It is used by tests and for local demos where
+// no real edge hardware is available.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+type FakeAgent struct {
+	BaseURL    string // e.g. http://localhost:8080
+	AuthToken  string // operator JWT used to register
+	Name       string
+	Region     string
+	Capacity   models.NodeCapacity
+	Labels     map[string]string
+	HTTPClient *http.Client
+
+	NodeID            string
+	nodeToken         string
+	heartbeatInterval time.Duration
+
+	mu         sync.Mutex
+	generation int64
+	running    map[string]time.Time // service ID -> started at
+}
+
+func NewFakeAgent(baseURL, authToken, name, region string) *FakeAgent {
+	return &FakeAgent{
+		BaseURL:   baseURL,
+		AuthToken: authToken,
+		Name:      name,
+		Region:    region,
+		Capacity: models.NodeCapacity{
+			CPUCores:    4,
+			MemoryMB:    8192,
+			MaxServices: 10,
+		},
+		Labels: map[string]string{},
+		// Long enough to outlast an assignment long-poll
+		HTTPClient: &http.Client{Timeout: 75 * time.Second},
+		generation: -1,
+		running:    make(map[string]time.Time),
+	}
+}
+
+// Register registers the agent and stores the node token it is issued.
+func (a *FakeAgent) Register(ctx context.Context) error {
+	req := models.RegisterNodeRequest{
+		Name:     a.Name,
+		Region:   a.Region,
+		Capacity: a.Capacity,
+		Labels:   a.Labels,
+	}
+
+	var resp models.RegisterNodeResponse
+	if err := a.do(ctx, http.MethodPost, "/api/v1/nodes", a.AuthToken, req, &resp); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+
+	a.NodeID = resp.Node.ID
+	a.nodeToken = resp.Token
+	a.heartbeatInterval = time.Duration(resp.HeartbeatIntervalSeconds) * time.Second
+	return nil
+}
+
+// Heartbeat sends a single heartbeat.
+func (a *FakeAgent) Heartbeat(ctx context.Context) (models.HeartbeatResponse, error) {
+	var resp models.HeartbeatResponse
+	if a.NodeID == "" {
+		return resp, fmt.Errorf("heartbeat: agent is not registered")
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/v1/nodes/"+a.NodeID+"/heartbeat", a.nodeToken, nil, &resp); err != nil {
+		return resp, fmt.Errorf("heartbeat: %w", err)
+	}
+	if resp.HeartbeatIntervalSeconds > 0 {
+		a.mu.Lock()
+		a.heartbeatInterval = time.Duration(resp.HeartbeatIntervalSeconds) * time.Second
+		a.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// Assignments fetches the node's assignment set. With generation >= 0 the
+// call long-polls until the set moves past that generation.
+func (a *FakeAgent) Assignments(ctx context.Context, generation int64, timeout time.Duration) (models.AssignmentSet, error) {
+	var set models.AssignmentSet
+	if a.NodeID == "" {
+		return set, fmt.Errorf("assignments: agent is not registered")
+	}
+
+	path := "/api/v1/nodes/" + a.NodeID + "/assignments?timeout=" + strconv.Itoa(int(timeout/time.Second))
+	if generation >= 0 {
+		path += "&generation=" + strconv.FormatInt(generation, 10)
+	}
+	if err := a.do(ctx, http.MethodGet, path, a.nodeToken, nil, &set); err != nil {
+		return set, fmt.Errorf("assignments: %w", err)
+	}
+	return set, nil
+}
+
+// ReportStatus sends the agent's observed status to the control plane.
+func (a *FakeAgent) ReportStatus(ctx context.Context, report models.NodeStatusReport) error {
+	if a.NodeID == "" {
+		return fmt.Errorf("report status: agent is not registered")
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/v1/nodes/"+a.NodeID+"/status", a.nodeToken, report, nil); err != nil {
+		return fmt.Errorf("report status: %w", err)
+	}
+	return nil
+}
+
+// Sync applies one assignment set: newly assigned services start "running",
+// unassigned ones are forgotten, and everything assigned is reported running.
+func (a *FakeAgent) Sync(ctx context.Context, set models.AssignmentSet) error {
+	a.mu.Lock()
+	now := time.Now()
+	assigned := make(map[string]bool, len(set.Services))
+	for _, s := range set.Services {
+		assigned[s.ServiceID] = true
+		if _, ok := a.running[s.ServiceID]; !ok {
+			a.running[s.ServiceID] = now
+		}
+	}
+	for id := range a.running {
+		if !assigned[id] {
+			delete(a.running, id)
+		}
+	}
+	a.generation = set.Generation
+
+	report := models.NodeStatusReport{Generation: set.Generation}
+	for id, started := range a.running {
+		report.Services = append(report.Services, models.ServiceStatusReport{
+			ServiceID: id,
+			Status:    models.StatusRunning,
+			Uptime:    int64(now.Sub(started) / time.Second),
+		})
+	}
+	a.mu.Unlock()
+
+	return a.ReportStatus(ctx, report)
+}
+
+// Running returns the IDs of the services the agent currently runs.
+func (a *FakeAgent) Running() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := make([]string, 0, len(a.running))
+	for id := range a.running {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Run registers if needed, then heartbeats at the interval the control plane
+// asks for and follows its assignments, until ctx is cancelled.
+func (a *FakeAgent) Run(ctx context.Context) error {
+	if a.NodeID == "" {
+		if err := a.Register(ctx); err != nil {
+			return err
+		}
+	}
+
+	go a.watch(ctx)
+
+	for {
+		if _, err := a.Heartbeat(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.interval()):
+		}
+	}
+}
+
+func (a *FakeAgent) watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		a.mu.Lock()
+		generation := a.generation
+		a.mu.Unlock()
+
+		set, err := a.Assignments(ctx, generation, 25*time.Second)
+		if err == nil {
+			err = a.Sync(ctx, set)
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(a.interval()):
+			}
+		}
+	}
+}
+
+func (a *FakeAgent) interval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.heartbeatInterval <= 0 {
+		return 10 * time.Second
+	}
+	return a.heartbeatInterval
+}
+
+func (a *FakeAgent) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+// fakeControlPlane implements just enough of the node API to exercise the agent.
+func fakeControlPlane(t *testing.T, heartbeats *int32) *httptest.Server {
+	return fakeControlPlaneWithReports(t, heartbeats, nil)
+}
+
+func fakeControlPlaneWithReports(t *testing.T, heartbeats *int32, reports chan<- models.NodeStatusReport) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer operator-jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req models.RegisterNodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("register body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(models.RegisterNodeResponse{
+			Node:                     models.Node{ID: "node-1", Name: req.Name, Region: req.Region, Status: models.NodeStatusReady},
+			Token:                    "node-secret",
+			HeartbeatIntervalSeconds: 10,
+		})
+	})
+	mux.HandleFunc("/api/v1/nodes/node-1/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer node-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(heartbeats, 1)
+		json.NewEncoder(w).Encode(models.HeartbeatResponse{Status: models.NodeStatusReady, HeartbeatIntervalSeconds: 10})
+	})
+	mux.HandleFunc("/api/v1/nodes/node-1/assignments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer node-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Generation 1 never changes, so a long-poll for it just times out
+		if r.URL.Query().Get("generation") == "1" {
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(models.AssignmentSet{
+			NodeID:     "node-1",
+			Generation: 1,
+			Services:   []models.Assignment{{ServiceID: "svc-a", Name: "api", Image: "nginx", Version: "1.0.0"}},
+		})
+	})
+	mux.HandleFunc("/api/v1/nodes/node-1/status", func(w http.ResponseWriter, r *http.Request) {
+		var report models.NodeStatusReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("status body: %v", err)
+		}
+		if reports != nil {
+			reports <- report
+		}
+		json.NewEncoder(w).Encode(map[string]int{"updated": len(report.Services)})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFakeAgentRegisterAndHeartbeat(t *testing.T) {
+	var heartbeats int32
+	srv := fakeControlPlane(t, &heartbeats)
+	defer srv.Close()
+
+	a := NewFakeAgent(srv.URL, "operator-jwt", "edge-test-01", "eu-west-1")
+
+	if _, err := a.Heartbeat(context.Background()); err == nil {
+		t.Error("Heartbeat() before Register() should fail")
+	}
+
+	if err := a.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if a.NodeID != "node-1" {
+		t.Errorf("NodeID = %q, want node-1", a.NodeID)
+	}
+
+	resp, err := a.Heartbeat(context.Background())
+	if err != nil {
+		t.Fatalf("Heartbeat() error = %v", err)
+	}
+	if resp.Status != models.NodeStatusReady {
+		t.Errorf("Heartbeat() status = %v, want ready", resp.Status)
+	}
+	if atomic.LoadInt32(&heartbeats) != 1 {
+		t.Errorf("server saw %d heartbeats, want 1", heartbeats)
+	}
+}
+
+func TestFakeAgentRegisterUnauthorized(t *testing.T) {
+	var heartbeats int32
+	srv := fakeControlPlane(t, &heartbeats)
+	defer srv.Close()
+
+	a := NewFakeAgent(srv.URL, "wrong-token", "edge-test-01", "eu-west-1")
+	if err := a.Register(context.Background()); err == nil {
+		t.Error("Register() with a bad token should fail")
+	}
+}
+
+func TestFakeAgentRunStopsOnCancel(t *testing.T) {
+	var heartbeats int32
+	srv := fakeControlPlane(t, &heartbeats)
+	defer srv.Close()
+
+	a := NewFakeAgent(srv.URL, "operator-jwt", "edge-test-01", "eu-west-1")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&heartbeats) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+
+	if atomic.LoadInt32(&heartbeats) == 0 {
+		t.Error("Run() never sent a heartbeat")
+	}
+}
+
+func TestFakeAgentSync(t *testing.T) {
+	var heartbeats int32
+	reports := make(chan models.NodeStatusReport, 4)
+	srv := fakeControlPlaneWithReports(t, &heartbeats, reports)
+	defer srv.Close()
+
+	a := NewFakeAgent(srv.URL, "operator-jwt", "edge-test-01", "eu-west-1")
+	if err := a.Register(context.Background()); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	if err := a.Sync(context.Background(), models.AssignmentSet{
+		Generation: 2,
+		Services:   []models.Assignment{{ServiceID: "svc-a"}, {ServiceID: "svc-b"}},
+	}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	report := <-reports
+	if report.Generation != 2 || len(report.Services) != 2 {
+		t.Fatalf("report = %+v, want generation 2 with 2 services", report)
+	}
+	for _, s := range report.Services {
+		if s.Status != models.StatusRunning {
+			t.Errorf("service %s reported %s, want running", s.ServiceID, s.Status)
+		}
+	}
+
+	// svc-a is unassigned and must no longer be reported
+	if err := a.Sync(context.Background(), models.AssignmentSet{
+		Generation: 3,
+		Services:   []models.Assignment{{ServiceID: "svc-b"}},
+	}); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	report = <-reports
+	if len(report.Services) != 1 || report.Services[0].ServiceID != "svc-b" {
+		t.Errorf("report = %+v, want only svc-b", report)
+	}
+	if running := a.Running(); len(running) != 1 || running[0] != "svc-b" {
+		t.Errorf("Running() = %v, want [svc-b]", running)
+	}
+}
+
+func TestFakeAgentRunFollowsAssignments(t *testing.T) {
+	var heartbeats int32
+	reports := make(chan models.NodeStatusReport, 4)
+	srv := fakeControlPlaneWithReports(t, &heartbeats, reports)
+	defer srv.Close()
+
+	a := NewFakeAgent(srv.URL, "operator-jwt", "edge-test-01", "eu-west-1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go a.Run(ctx)
+
+	select {
+	case report := <-reports:
+		if report.Generation != 1 || len(report.Services) != 1 || report.Services[0].ServiceID != "svc-a" {
+			t.Errorf("report = %+v, want svc-a at generation 1", report)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent never reported status for its assignments")
+	}
+}
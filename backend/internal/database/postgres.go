@@ -55,6 +55,319 @@ func RunMigrations(db *sql.DB) error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
 		)`,
+		// Desired vs observed state. Existing rows take their desired state
+		// from whatever status they had before the column existed.
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS desired_status VARCHAR(20)`,
+		`UPDATE services SET desired_status = CASE WHEN status IN ('running', 'starting') THEN 'running' ELSE 'stopped' END
+		 WHERE desired_status IS NULL`,
+		`ALTER TABLE services ALTER COLUMN desired_status SET DEFAULT 'stopped'`,
+		`ALTER TABLE services ALTER COLUMN desired_status SET NOT NULL`,
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS status_message TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS nodes (
+			id VARCHAR(36) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			region VARCHAR(50) NOT NULL,
+			capacity JSONB NOT NULL DEFAULT '{}',
+			labels JSONB NOT NULL DEFAULT '{}',
+			status VARCHAR(20) NOT NULL DEFAULT 'ready',
+			token_hash VARCHAR(64) NOT NULL,
+			last_heartbeat_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_nodes_region ON nodes(region)`,
+		// Workload assignment. generation is bumped whenever a node's
+		// assigned set changes so agents can long-poll for it.
+		`ALTER TABLE nodes ADD COLUMN IF NOT EXISTS generation BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS node_id VARCHAR(36) REFERENCES nodes(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_services_node_id ON services(node_id)`,
+		`CREATE TABLE IF NOT EXISTS deployments (
+			id VARCHAR(36) PRIMARY KEY,
+			service_id VARCHAR(36) NOT NULL,
+			service_name VARCHAR(255) NOT NULL,
+			version VARCHAR(50) NOT NULL,
+			batch_size INT NOT NULL,
+			max_error_rate DOUBLE PRECISION NOT NULL,
+			health_timeout_seconds INT NOT NULL,
+			bake_seconds INT NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			current_batch INT NOT NULL DEFAULT 0,
+			total_batches INT NOT NULL,
+			message TEXT NOT NULL DEFAULT '',
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS deployment_targets (
+			deployment_id VARCHAR(36) NOT NULL,
+			service_id VARCHAR(36) NOT NULL,
+			region VARCHAR(50) NOT NULL,
+			from_version VARCHAR(50) NOT NULL,
+			batch INT NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			PRIMARY KEY (deployment_id, service_id),
+			FOREIGN KEY (deployment_id) REFERENCES deployments(id) ON DELETE CASCADE,
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_deployments_service_name ON deployments(service_name, created_at DESC)`,
+		// Canary deployments
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS strategy VARCHAR(20) NOT NULL DEFAULT 'rolling'`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS canary_percent INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS analysis_seconds INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS max_error_rate_delta DOUBLE PRECISION NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS max_latency_increase DOUBLE PRECISION NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS analysis JSONB`,
+		`ALTER TABLE deployment_targets ADD COLUMN IF NOT EXISTS canary BOOLEAN NOT NULL DEFAULT FALSE`,
+		// Revision history. Rows are never updated; existing services get a
+		// first revision from their current state.
+		`CREATE TABLE IF NOT EXISTS service_revisions (
+			id VARCHAR(36) PRIMARY KEY,
+			service_id VARCHAR(36) NOT NULL,
+			revision INT NOT NULL,
+			image VARCHAR(255) NOT NULL,
+			version VARCHAR(50) NOT NULL,
+			config JSONB,
+			config_version INT,
+			reason TEXT NOT NULL DEFAULT '',
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (service_id, revision),
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE OR REPLACE RULE service_revisions_immutable AS ON UPDATE TO service_revisions DO INSTEAD NOTHING`,
+		`INSERT INTO service_revisions (id, service_id, revision, image, version, reason, created_at)
+		 SELECT gen_random_uuid()::text, s.id, 1, s.image, s.version, 'initial', s.created_at FROM services s
+		 WHERE NOT EXISTS (SELECT 1 FROM service_revisions r WHERE r.service_id = s.id)`,
+		// Versioned config
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_service_configs_version ON service_configs(service_id, version)`,
+		`CREATE TABLE IF NOT EXISTS service_config_schemas (
+			service_id VARCHAR(36) PRIMARY KEY,
+			schema JSONB NOT NULL,
+			updated_by VARCHAR(255),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		// Metrics ingestion
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS ingest_token_hash VARCHAR(64)`,
+		// Metrics rollups, one row per service, resolution and bucket
+		`CREATE TABLE IF NOT EXISTS metric_rollups (
+			service_id VARCHAR(36) NOT NULL,
+			resolution VARCHAR(8) NOT NULL,
+			bucket TIMESTAMP NOT NULL,
+			data JSONB NOT NULL,
+			PRIMARY KEY (service_id, resolution, bucket),
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_metric_rollups_bucket ON metric_rollups(resolution, bucket)`,
+		// Alerting. Resolved alerts are kept as history; at most one alert
+		// per rule and service is unresolved.
+		`CREATE TABLE IF NOT EXISTS alert_rules (
+			id VARCHAR(36) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			service_id VARCHAR(36),
+			region VARCHAR(50),
+			metric VARCHAR(32) NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			operator VARCHAR(2) NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			window_seconds INT NOT NULL DEFAULT 0,
+			for_seconds INT NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id VARCHAR(36) PRIMARY KEY,
+			rule_id VARCHAR(36) NOT NULL,
+			rule_name VARCHAR(255) NOT NULL,
+			service_id VARCHAR(36) NOT NULL,
+			state VARCHAR(20) NOT NULL,
+			value DOUBLE PRECISION NOT NULL DEFAULT 0,
+			message TEXT NOT NULL DEFAULT '',
+			started_at TIMESTAMP NOT NULL,
+			fired_at TIMESTAMP,
+			resolved_at TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (rule_id) REFERENCES alert_rules(id) ON DELETE CASCADE
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_unresolved ON alerts(rule_id, service_id) WHERE state <> 'resolved'`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_started_at ON alerts(started_at DESC)`,
+		// Outbound webhooks
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id VARCHAR(36) PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret VARCHAR(64) NOT NULL,
+			events TEXT[] NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id VARCHAR(36) PRIMARY KEY,
+			webhook_id VARCHAR(36) NOT NULL,
+			event VARCHAR(50) NOT NULL,
+			payload JSONB NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			last_status_code INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMP,
+			delivered_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending'`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, created_at DESC)`,
+		`CREATE TABLE IF NOT EXISTS webhook_attempts (
+			delivery_id VARCHAR(36) NOT NULL,
+			attempt INT NOT NULL,
+			status_code INT NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (delivery_id, attempt),
+			FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+		)`,
+		// Service accounts and their API keys
+		`CREATE TABLE IF NOT EXISTS service_accounts (
+			id VARCHAR(36) PRIMARY KEY,
+			name VARCHAR(64) NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			role VARCHAR(20) NOT NULL,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id VARCHAR(36) PRIMARY KEY,
+			service_account_id VARCHAR(36) NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			prefix VARCHAR(20) NOT NULL,
+			key_hash VARCHAR(64) NOT NULL UNIQUE,
+			expires_at TIMESTAMP,
+			last_used_at TIMESTAMP,
+			revoked_at TIMESTAMP,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (service_account_id) REFERENCES service_accounts(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_service_account ON api_keys(service_account_id, created_at DESC)`,
+		// JWT signing key ring
+		`CREATE TABLE IF NOT EXISTS jwt_signing_keys (
+			kid VARCHAR(36) PRIMARY KEY,
+			algorithm VARCHAR(10) NOT NULL,
+			private_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			active_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP
+		)`,
+		// Resource-scoped role bindings. A binding's scope is one service, or
+		// every service matching its region and label selector; empty ones
+		// match everything.
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'`,
+		`CREATE TABLE IF NOT EXISTS role_bindings (
+			id VARCHAR(36) PRIMARY KEY,
+			subject_kind VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			role VARCHAR(20) NOT NULL,
+			service_id VARCHAR(36),
+			region VARCHAR(50) NOT NULL DEFAULT '',
+			selector JSONB NOT NULL DEFAULT '{}',
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_role_bindings_subject ON role_bindings(subject_kind, subject)`,
+		// Audit trail of mutating API calls. Rows can only be inserted.
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			occurred_at TIMESTAMP NOT NULL,
+			request_id VARCHAR(36) NOT NULL DEFAULT '',
+			actor VARCHAR(255) NOT NULL DEFAULT '',
+			actor_role VARCHAR(20) NOT NULL DEFAULT '',
+			client_ip VARCHAR(45) NOT NULL DEFAULT '',
+			action VARCHAR(300) NOT NULL,
+			resource_type VARCHAR(50) NOT NULL DEFAULT '',
+			resource_id VARCHAR(255) NOT NULL DEFAULT '',
+			before JSONB,
+			after JSONB,
+			changes JSONB,
+			status INT NOT NULL,
+			outcome VARCHAR(10) NOT NULL,
+			error TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_occurred_at ON audit_log(occurred_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log(resource_type, resource_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor)`,
+		`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+		`CREATE OR REPLACE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+		// Organizations and their projects, which own services. Everyone
+		// can see the default project, which holds services created before
+		// projects existed.
+		`CREATE TABLE IF NOT EXISTS organizations (
+			id VARCHAR(36) PRIMARY KEY,
+			name VARCHAR(64) NOT NULL UNIQUE,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS projects (
+			id VARCHAR(36) PRIMARY KEY,
+			organization_id VARCHAR(36) NOT NULL,
+			name VARCHAR(64) NOT NULL,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (organization_id, name),
+			FOREIGN KEY (organization_id) REFERENCES organizations(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS project_members (
+			project_id VARCHAR(36) NOT NULL,
+			subject_kind VARCHAR(10) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			created_by VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (project_id, subject_kind, subject),
+			FOREIGN KEY (project_id) REFERENCES projects(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_project_members_subject ON project_members(subject_kind, subject)`,
+		`INSERT INTO organizations (id, name) VALUES ('default', 'default') ON CONFLICT DO NOTHING`,
+		`INSERT INTO projects (id, organization_id, name) VALUES ('default', 'default', 'default') ON CONFLICT DO NOTHING`,
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS project_id VARCHAR(36) NOT NULL DEFAULT 'default' REFERENCES projects(id)`,
+		`CREATE INDEX IF NOT EXISTS idx_services_project ON services(project_id)`,
+		// Alert rules belong to the project of their service, or for
+		// region rules to the project whose services they watch
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS project_id VARCHAR(36) NOT NULL DEFAULT 'default' REFERENCES projects(id) ON DELETE CASCADE`,
+		`UPDATE alert_rules SET project_id = services.project_id FROM services
+			WHERE services.id = alert_rules.service_id AND alert_rules.project_id <> services.project_id`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_rules_project ON alert_rules(project_id)`,
+		// Quotas on the services of a project or created by a user. NULL
+		// limits are unlimited.
+		`ALTER TABLE services ADD COLUMN IF NOT EXISTS created_by VARCHAR(255)`,
+		`CREATE INDEX IF NOT EXISTS idx_services_created_by ON services(created_by)`,
+		`CREATE TABLE IF NOT EXISTS quotas (
+			scope_kind VARCHAR(10) NOT NULL,
+			scope VARCHAR(255) NOT NULL,
+			max_services INT,
+			max_running_services INT,
+			max_services_per_region INT,
+			updated_by VARCHAR(255),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (scope_kind, scope)
+		)`,
+		// Deployments are driven by the replica that owns them, which
+		// heartbeats them; others roll back those whose heartbeat stops
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS owner VARCHAR(36)`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMP`,
+		`ALTER TABLE deployments ADD COLUMN IF NOT EXISTS abort_requested_by VARCHAR(255)`,
 		`CREATE INDEX IF NOT EXISTS idx_services_region ON services(region)`,
 		`CREATE INDEX IF NOT EXISTS idx_services_status ON services(status)`,
 		`CREATE INDEX IF NOT EXISTS idx_deployment_logs_service_id ON deployment_logs(service_id)`,
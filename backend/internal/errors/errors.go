@@ -54,6 +54,14 @@ func Forbidden(c *gin.Context, message string) {
 	})
 }
 
+func Conflict(c *gin.Context, message string) {
+	c.JSON(http.StatusConflict, ErrorResponse{
+		Error:   "Conflict",
+		Message: message,
+		Code:    "CONFLICT",
+	})
+}
+
 func TooManyRequests(c *gin.Context, message string) {
 	c.JSON(http.StatusTooManyRequests, ErrorResponse{
 		Error:   "Too Many Requests",
@@ -61,3 +69,15 @@ func TooManyRequests(c *gin.Context, message string) {
 		Code:    "RATE_LIMIT_EXCEEDED",
 	})
 }
+
+// QuotaExceeded refuses a request that would exceed a quota, with status
+// 403 when the request can never be admitted as it stands and 409 when it
+// conflicts with what is currently running. details describes the quota.
+func QuotaExceeded(c *gin.Context, status int, message string, details interface{}) {
+	c.JSON(status, ErrorResponse{
+		Error:   http.StatusText(status),
+		Message: message,
+		Details: details,
+		Code:    "QUOTA_EXCEEDED",
+	})
+}
@@ -0,0 +1,649 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	alertEvaluationInterval = 15 * time.Second
+	alertStaleAfter         = time.Minute // threshold rules ignore older samples
+	alertRateSpan           = time.Minute // rate rules average this much at both ends of the window
+	maxAlertSeconds         = 3600
+)
+
+// alertMetrics are the sample fields rules can watch.
+var alertMetrics = map[string]func(models.ServiceMetrics) float64{
+	"cpu_usage":     func(m models.ServiceMetrics) float64 { return m.CPUUsage },
+	"memory_usage":  func(m models.ServiceMetrics) float64 { return m.MemoryUsage },
+	"request_count": func(m models.ServiceMetrics) float64 { return float64(m.RequestCount) },
+	"error_rate":    func(m models.ServiceMetrics) float64 { return m.ErrorRate },
+	"p95_latency":   func(m models.ServiceMetrics) float64 { return m.P95Latency },
+}
+
+// AlertHandler manages alert rules and evaluates them against the stored
+// metrics series.
+type AlertHandler struct {
+	db      *sql.DB
+	hub     *websocket.Hub
+	metrics *MetricsHandler
+}
+
+func NewAlertHandler(db *sql.DB, hub *websocket.Hub, metrics *MetricsHandler) *AlertHandler {
+	return &AlertHandler{db: db, hub: hub, metrics: metrics}
+}
+
+// alertRuleColumns is the column list scanAlertRule expects, in order.
+const alertRuleColumns = `id, project_id, name, COALESCE(service_id, ''), COALESCE(region, ''), metric, kind, operator,
+	threshold, window_seconds, for_seconds, enabled, COALESCE(created_by, ''), created_at, updated_at`
+
+func scanAlertRule(row rowScanner) (models.AlertRule, error) {
+	var r models.AlertRule
+	err := row.Scan(&r.ID, &r.ProjectID, &r.Name, &r.ServiceID, &r.Region, &r.Metric, &r.Kind, &r.Operator,
+		&r.Threshold, &r.WindowSeconds, &r.ForSeconds, &r.Enabled, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
+
+// alertProject is the project of an alert's service, for projectFilter.
+const alertProject = "(SELECT project_id FROM services WHERE services.id = alerts.service_id)"
+
+// alertColumns is the column list scanAlert expects, in order.
+const alertColumns = "id, rule_id, rule_name, service_id, state, value, message, started_at, fired_at, resolved_at, updated_at"
+
+func scanAlert(row rowScanner) (models.Alert, error) {
+	var a models.Alert
+	var firedAt, resolvedAt sql.NullTime
+	err := row.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.ServiceID, &a.State, &a.Value, &a.Message,
+		&a.StartedAt, &firedAt, &resolvedAt, &a.UpdatedAt)
+	if firedAt.Valid {
+		a.FiredAt = &firedAt.Time
+	}
+	if resolvedAt.Valid {
+		a.ResolvedAt = &resolvedAt.Time
+	}
+	return a, err
+}
+
+func (h *AlertHandler) ListAlertRules(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, args := projectFilter(c, "project_id", nil)
+	rules, err := h.loadRules(ctx, filter, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query alert rules")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (h *AlertHandler) GetAlertRule(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, args := projectFilter(c, "project_id", []interface{}{c.Param("id")})
+	rule, err := scanAlertRule(h.db.QueryRowContext(ctx,
+		"SELECT "+alertRuleColumns+" FROM alert_rules WHERE id = $1"+filter, args...))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Alert rule")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get alert rule")
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *AlertHandler) CreateAlertRule(c *gin.Context) {
+	req, ok := h.bindAlertRule(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	rule, err := scanAlertRule(h.db.QueryRowContext(ctx,
+		`INSERT INTO alert_rules (id, name, service_id, region, metric, kind, operator, threshold,
+			window_seconds, for_seconds, enabled, created_by, created_at, updated_at, project_id)
+		 VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $9, $10, $11, $12, $13, $13, $14)
+		 RETURNING `+alertRuleColumns,
+		uuid.New().String(), req.Name, req.ServiceID, req.Region, req.Metric, req.Kind, req.Operator, req.Threshold,
+		req.WindowSeconds, req.ForSeconds, *req.Enabled, c.GetString("user_id"), now, req.ProjectID,
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to create alert rule")
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateAlertRule replaces a rule. Unresolved alerts of the rule are
+// re-evaluated against the new condition on the next pass.
+func (h *AlertHandler) UpdateAlertRule(c *gin.Context) {
+	req, ok := h.bindAlertRule(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, args := projectFilter(c, "project_id", []interface{}{c.Param("id")})
+	current, err := scanAlertRule(h.db.QueryRowContext(ctx, "SELECT "+alertRuleColumns+" FROM alert_rules WHERE id = $1"+filter, args...))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Alert rule")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get alert rule")
+		return
+	}
+	auditBefore(c, current)
+
+	rule, err := scanAlertRule(h.db.QueryRowContext(ctx,
+		`UPDATE alert_rules SET name = $2, service_id = NULLIF($3, ''), region = NULLIF($4, ''), metric = $5,
+			kind = $6, operator = $7, threshold = $8, window_seconds = $9, for_seconds = $10, enabled = $11,
+			updated_at = $12, project_id = $13
+		 WHERE id = $1
+		 RETURNING `+alertRuleColumns,
+		c.Param("id"), req.Name, req.ServiceID, req.Region, req.Metric, req.Kind, req.Operator, req.Threshold,
+		req.WindowSeconds, req.ForSeconds, *req.Enabled, time.Now(), req.ProjectID,
+	))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Alert rule")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to update alert rule")
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAlertRule deletes a rule together with its alerts.
+func (h *AlertHandler) DeleteAlertRule(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, args := projectFilter(c, "project_id", []interface{}{c.Param("id")})
+	rule, err := scanAlertRule(h.db.QueryRowContext(ctx, "DELETE FROM alert_rules WHERE id = $1"+filter+" RETURNING "+alertRuleColumns, args...))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Alert rule")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete alert rule")
+		return
+	}
+	auditBefore(c, rule)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+// bindAlertRule binds and validates a rule request, filling in defaults
+// and the rule's project. Services the caller cannot see are not found.
+func (h *AlertHandler) bindAlertRule(c *gin.Context) (models.AlertRuleRequest, bool) {
+	var req models.AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return req, false
+	}
+
+	if validationErrs := validateAlertRule(&req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return req, false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if req.ServiceID != "" {
+		var project string
+		filter, args := projectFilter(c, "project_id", []interface{}{req.ServiceID})
+		err := h.db.QueryRowContext(ctx, "SELECT project_id FROM services WHERE id = $1"+filter, args...).Scan(&project)
+		if err == sql.ErrNoRows {
+			errors.NotFound(c, "Service")
+			return req, false
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to check service")
+			return req, false
+		}
+		if req.ProjectID != "" && req.ProjectID != project {
+			errors.BadRequest(c, "Validation failed", validation.ValidationErrors{
+				{Field: "project_id", Message: "project_id must be the project of the service"},
+			})
+			return req, false
+		}
+		req.ProjectID = project
+		return req, true
+	}
+
+	if req.ProjectID == "" {
+		req.ProjectID = models.DefaultProjectID
+	}
+	if !canSeeProject(c, req.ProjectID) {
+		errors.Forbidden(c, fmt.Sprintf("Not a member of project %s", req.ProjectID))
+		return req, false
+	}
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)", req.ProjectID).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return req, false
+	}
+	if !exists {
+		errors.NotFound(c, "Project")
+		return req, false
+	}
+	return req, true
+}
+
+// validateAlertRule checks a rule request and fills in its defaults.
+func validateAlertRule(req *models.AlertRuleRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+	invalid := func(field, message string) {
+		errs = append(errs, validation.ValidationError{Field: field, Message: message})
+	}
+
+	if req.Kind == "" {
+		req.Kind = models.AlertThreshold
+	}
+	if req.Operator == "" {
+		req.Operator = ">"
+	}
+	if req.Enabled == nil {
+		enabled := true
+		req.Enabled = &enabled
+	}
+
+	if len(req.Name) > 255 {
+		invalid("name", "name must be at most 255 characters")
+	}
+	if (req.ServiceID == "") == (req.Region == "") {
+		invalid("service_id", "exactly one of service_id and region is required")
+	}
+	if req.Region != "" {
+		if err := validation.ValidateRegion(req.Region); err != nil {
+			errs = append(errs, err.(validation.ValidationError))
+		}
+	}
+	if _, ok := alertMetrics[req.Metric]; !ok {
+		invalid("metric", "metric must be one of cpu_usage, memory_usage, request_count, error_rate, p95_latency")
+	}
+	if _, ok := compareOperators[req.Operator]; !ok {
+		invalid("operator", "operator must be one of >, >=, <, <=")
+	}
+	switch req.Kind {
+	case models.AlertThreshold:
+		req.WindowSeconds = 0
+	case models.AlertRateOfChange:
+		if req.WindowSeconds < 60 || req.WindowSeconds > maxAlertSeconds {
+			invalid("window_seconds", fmt.Sprintf("window_seconds must be between 60 and %d", maxAlertSeconds))
+		}
+	default:
+		invalid("kind", "kind must be threshold or rate_of_change")
+	}
+	if err := validation.ValidateSeconds("for_seconds", req.ForSeconds, maxAlertSeconds); err != nil {
+		errs = append(errs, err.(validation.ValidationError))
+	}
+
+	return errs
+}
+
+// ListAlerts lists alerts, newest first. Filter with ?state=, ?service_id=
+// and ?rule_id=; ?limit= defaults to 100 (at most 500).
+func (h *AlertHandler) ListAlerts(c *gin.Context) {
+	query := "SELECT " + alertColumns + " FROM alerts WHERE 1=1"
+	args := []interface{}{}
+
+	if state := c.Query("state"); state != "" {
+		switch models.AlertState(state) {
+		case models.AlertPending, models.AlertFiring, models.AlertResolved:
+		default:
+			errors.BadRequest(c, "state must be pending, firing or resolved", nil)
+			return
+		}
+		args = append(args, state)
+		query += fmt.Sprintf(" AND state = $%d", len(args))
+	}
+	if serviceID := c.Query("service_id"); serviceID != "" {
+		args = append(args, serviceID)
+		query += fmt.Sprintf(" AND service_id = $%d", len(args))
+	}
+	if ruleID := c.Query("rule_id"); ruleID != "" {
+		args = append(args, ruleID)
+		query += fmt.Sprintf(" AND rule_id = $%d", len(args))
+	}
+	filter, args := projectFilter(c, alertProject, args)
+	query += filter
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY started_at DESC LIMIT $%d", len(args))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query alerts")
+		return
+	}
+	defer rows.Close()
+
+	alerts := []models.Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan alert")
+			return
+		}
+		alerts = append(alerts, a)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+func (h *AlertHandler) GetAlert(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	filter, args := projectFilter(c, alertProject, []interface{}{c.Param("id")})
+	a, err := scanAlert(h.db.QueryRowContext(ctx, "SELECT "+alertColumns+" FROM alerts WHERE id = $1"+filter, args...))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Alert")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get alert")
+		return
+	}
+
+	c.JSON(http.StatusOK, a)
+}
+
+// loadRules loads the rules matching the conditions in filter, which
+// starts with " AND".
+func (h *AlertHandler) loadRules(ctx context.Context, filter string, args ...interface{}) ([]models.AlertRule, error) {
+	query := "SELECT " + alertRuleColumns + " FROM alert_rules WHERE 1=1" + filter + " ORDER BY created_at"
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.AlertRule{}
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// Run evaluates every enabled rule against each service it applies to.
+func (h *AlertHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(alertEvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.evaluate(ctx)
+		}
+	}
+}
+
+func (h *AlertHandler) evaluate(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	now := time.Now()
+
+	rules, err := h.loadRules(ctx, " AND enabled")
+	if err != nil {
+		log.Printf("Failed to load alert rules: %v", err)
+		return
+	}
+
+	services := []models.Service{}
+	rows, err := h.db.QueryContext(ctx, "SELECT id, region, project_id FROM services")
+	if err != nil {
+		log.Printf("Failed to query services for alerting: %v", err)
+		return
+	}
+	for rows.Next() {
+		var s models.Service
+		if rows.Scan(&s.ID, &s.Region, &s.ProjectID) == nil {
+			services = append(services, s)
+		}
+	}
+	rows.Close()
+
+	unresolved := map[string]models.Alert{}
+	rows, err = h.db.QueryContext(ctx, "SELECT "+alertColumns+" FROM alerts WHERE state <> $1", models.AlertResolved)
+	if err != nil {
+		log.Printf("Failed to query unresolved alerts: %v", err)
+		return
+	}
+	for rows.Next() {
+		if a, err := scanAlert(rows); err == nil {
+			unresolved[a.RuleID+"/"+a.ServiceID] = a
+		}
+	}
+	rows.Close()
+
+	series := map[string][]models.ServiceMetrics{}
+	evaluated := map[string]bool{}
+	for _, rule := range rules {
+		for _, s := range services {
+			if !ruleApplies(rule, s) {
+				continue
+			}
+
+			key := rule.ID + "/" + s.ID
+			evaluated[key] = true
+
+			samples, ok := series[s.ID]
+			if !ok {
+				lookback := time.Duration(maxAlertSeconds)*time.Second + alertRateSpan
+				samples, err = h.metrics.MetricsSince(ctx, s.ID, now.Add(-lookback))
+				if err != nil {
+					log.Printf("Failed to read metrics of service %s for alerting: %v", s.ID, err)
+					continue
+				}
+				series[s.ID] = samples
+			}
+
+			var current *models.Alert
+			if a, ok := unresolved[key]; ok {
+				current = &a
+			}
+
+			value, holds := evaluateRule(rule, samples, now)
+			if next, changed := nextAlert(rule, s.ID, current, value, holds, now); changed {
+				h.saveAlert(ctx, next, current == nil)
+			}
+		}
+	}
+
+	// Rules that were disabled or deleted, and services that are gone, no
+	// longer hold
+	for key, a := range unresolved {
+		if !evaluated[key] {
+			a.State = models.AlertResolved
+			a.ResolvedAt = &now
+			a.UpdatedAt = now
+			h.saveAlert(ctx, a, false)
+		}
+	}
+}
+
+// saveAlert stores a new alert, or a change of state of an unresolved one,
+// and broadcasts it. Every replica evaluates the rules, so a new alert or
+// change another replica already stored is skipped, and broadcast once.
+func (h *AlertHandler) saveAlert(ctx context.Context, a models.Alert, isNew bool) {
+	var result sql.Result
+	var err error
+	if isNew {
+		result, err = h.db.ExecContext(ctx,
+			`INSERT INTO alerts (id, rule_id, rule_name, service_id, state, value, message, started_at, fired_at, resolved_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			 ON CONFLICT (rule_id, service_id) WHERE state <> 'resolved' DO NOTHING`,
+			a.ID, a.RuleID, a.RuleName, a.ServiceID, a.State, a.Value, a.Message, a.StartedAt, a.FiredAt, a.ResolvedAt, a.UpdatedAt,
+		)
+	} else {
+		result, err = h.db.ExecContext(ctx,
+			`UPDATE alerts SET state = $2, value = $3, message = $4, fired_at = $5, resolved_at = $6, updated_at = $7
+			 WHERE id = $1 AND state <> 'resolved' AND state <> $2`,
+			a.ID, a.State, a.Value, a.Message, a.FiredAt, a.ResolvedAt, a.UpdatedAt,
+		)
+	}
+	if err != nil {
+		log.Printf("Failed to save alert %s: %v", a.ID, err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeAlert, a)
+}
+
+// ruleApplies reports whether rule watches s: its own service, or for a
+// region rule, the services of its project in its region.
+func ruleApplies(rule models.AlertRule, s models.Service) bool {
+	if rule.ServiceID != "" {
+		return rule.ServiceID == s.ID
+	}
+	return rule.Region == s.Region && rule.ProjectID == s.ProjectID
+}
+
+// nextAlert applies one evaluation to the unresolved alert of a rule and
+// service, if any. It reports whether anything changed.
+func nextAlert(rule models.AlertRule, serviceID string, current *models.Alert, value float64, holds bool, now time.Time) (models.Alert, bool) {
+	switch {
+	case current == nil && holds:
+		a := models.Alert{
+			ID:        uuid.New().String(),
+			RuleID:    rule.ID,
+			RuleName:  rule.Name,
+			ServiceID: serviceID,
+			State:     models.AlertPending,
+			Value:     value,
+			Message:   alertMessage(rule, value),
+			StartedAt: now,
+			UpdatedAt: now,
+		}
+		if rule.ForSeconds == 0 {
+			a.State = models.AlertFiring
+			a.FiredAt = &now
+		}
+		return a, true
+
+	case current != nil && holds && current.State == models.AlertPending &&
+		now.Sub(current.StartedAt) >= time.Duration(rule.ForSeconds)*time.Second:
+		a := *current
+		a.State = models.AlertFiring
+		a.Value = value
+		a.Message = alertMessage(rule, value)
+		a.FiredAt = &now
+		a.UpdatedAt = now
+		return a, true
+
+	case current != nil && !holds:
+		a := *current
+		a.State = models.AlertResolved
+		a.ResolvedAt = &now
+		a.UpdatedAt = now
+		return a, true
+	}
+	return models.Alert{}, false
+}
+
+// evaluateRule returns the value a rule compares, from samples ordered newest
+// first, and whether its condition holds. Without recent enough samples the
+// condition does not hold.
+func evaluateRule(rule models.AlertRule, samples []models.ServiceMetrics, now time.Time) (float64, bool) {
+	metric, ok := alertMetrics[rule.Metric]
+	if !ok {
+		return 0, false
+	}
+
+	switch rule.Kind {
+	case models.AlertThreshold:
+		if len(samples) == 0 || samples[0].Timestamp.Before(now.Add(-alertStaleAfter)) {
+			return 0, false
+		}
+		value := metric(samples[0])
+		return value, compareOperators[rule.Operator](value, rule.Threshold)
+
+	case models.AlertRateOfChange:
+		window := time.Duration(rule.WindowSeconds) * time.Second
+		current, n := meanBetween(samples, metric, now.Add(-alertRateSpan), now)
+		previous, m := meanBetween(samples, metric, now.Add(-window-alertRateSpan), now.Add(-window))
+		if n == 0 || m == 0 || previous == 0 {
+			return 0, false
+		}
+		change := (current - previous) / previous * 100
+		return change, compareOperators[rule.Operator](change, rule.Threshold)
+	}
+	return 0, false
+}
+
+// meanBetween averages a metric over the samples taken within (from, to].
+func meanBetween(samples []models.ServiceMetrics, metric func(models.ServiceMetrics) float64, from, to time.Time) (float64, int) {
+	var sum float64
+	var n int
+	for _, m := range samples {
+		if m.Timestamp.After(from) && !m.Timestamp.After(to) {
+			sum += metric(m)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / float64(n), n
+}
+
+var compareOperators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+}
+
+func alertMessage(rule models.AlertRule, value float64) string {
+	if rule.Kind == models.AlertRateOfChange {
+		return fmt.Sprintf("%s changed %+.1f%% over %s (%s %g%%)",
+			rule.Metric, value, time.Duration(rule.WindowSeconds)*time.Second, rule.Operator, rule.Threshold)
+	}
+	return fmt.Sprintf("%s is %.4g (%s %g)", rule.Metric, value, rule.Operator, rule.Threshold)
+}
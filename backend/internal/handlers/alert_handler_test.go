@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestEvaluateRule(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sample := func(ago time.Duration, errorRate, latency float64) models.ServiceMetrics {
+		return models.ServiceMetrics{Timestamp: now.Add(-ago), ErrorRate: errorRate, P95Latency: latency}
+	}
+
+	threshold := models.AlertRule{Metric: "error_rate", Kind: models.AlertThreshold, Operator: ">", Threshold: 2}
+	rate := models.AlertRule{Metric: "p95_latency", Kind: models.AlertRateOfChange, Operator: ">", Threshold: 50, WindowSeconds: 600}
+
+	tests := []struct {
+		name      string
+		rule      models.AlertRule
+		samples   []models.ServiceMetrics
+		wantValue float64
+		wantHolds bool
+	}{
+		{"above threshold", threshold, []models.ServiceMetrics{sample(5*time.Second, 3, 0)}, 3, true},
+		{"below threshold", threshold, []models.ServiceMetrics{sample(5*time.Second, 1, 0)}, 1, false},
+		{"stale sample", threshold, []models.ServiceMetrics{sample(5*time.Minute, 3, 0)}, 0, false},
+		{"no samples", threshold, nil, 0, false},
+		{"latency up", rate, []models.ServiceMetrics{
+			sample(10*time.Second, 0, 160),
+			sample(30*time.Second, 0, 140),
+			sample(10*time.Minute+10*time.Second, 0, 100),
+		}, 50, false},
+		{"latency up more", rate, []models.ServiceMetrics{
+			sample(10*time.Second, 0, 200),
+			sample(10*time.Minute+10*time.Second, 0, 100),
+		}, 100, true},
+		{"no baseline", rate, []models.ServiceMetrics{sample(10*time.Second, 0, 200)}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, holds := evaluateRule(tt.rule, tt.samples, now)
+			if value != tt.wantValue || holds != tt.wantHolds {
+				t.Errorf("evaluateRule() = %v, %v, want %v, %v", value, holds, tt.wantValue, tt.wantHolds)
+			}
+		})
+	}
+}
+
+func TestNextAlert(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rule := models.AlertRule{ID: "r", Name: "errors", Metric: "error_rate", Kind: models.AlertThreshold, Operator: ">", Threshold: 2, ForSeconds: 120}
+
+	if _, changed := nextAlert(rule, "s", nil, 1, false, start); changed {
+		t.Fatal("inactive condition without an alert should not change anything")
+	}
+
+	a, changed := nextAlert(rule, "s", nil, 3, true, start)
+	if !changed || a.State != models.AlertPending || a.ID == "" {
+		t.Fatalf("first hit = %+v, %v, want a new pending alert", a, changed)
+	}
+
+	if _, changed := nextAlert(rule, "s", &a, 3, true, start.Add(time.Minute)); changed {
+		t.Error("alert should stay pending before for_seconds")
+	}
+
+	firing, changed := nextAlert(rule, "s", &a, 4, true, start.Add(2*time.Minute))
+	if !changed || firing.State != models.AlertFiring || firing.FiredAt == nil || firing.Value != 4 {
+		t.Fatalf("after for_seconds = %+v, %v, want firing", firing, changed)
+	}
+
+	if _, changed := nextAlert(rule, "s", &firing, 4, true, start.Add(3*time.Minute)); changed {
+		t.Error("firing alert should not change while the condition holds")
+	}
+
+	resolved, changed := nextAlert(rule, "s", &firing, 1, false, start.Add(4*time.Minute))
+	if !changed || resolved.State != models.AlertResolved || resolved.ResolvedAt == nil || resolved.ID != a.ID {
+		t.Errorf("after clearing = %+v, %v, want resolved", resolved, changed)
+	}
+
+	rule.ForSeconds = 0
+	if a, _ := nextAlert(rule, "s", nil, 3, true, start); a.State != models.AlertFiring {
+		t.Errorf("rule without for_seconds should fire immediately, got %s", a.State)
+	}
+}
+
+func TestValidateAlertRule(t *testing.T) {
+	tests := []struct {
+		name string
+		req  models.AlertRuleRequest
+		want []string
+	}{
+		{"service threshold", models.AlertRuleRequest{Name: "e", ServiceID: "s", Metric: "error_rate", Threshold: 2, ForSeconds: 120}, nil},
+		{"region rate", models.AlertRuleRequest{Name: "l", Region: "us-east-1", Metric: "p95_latency", Kind: models.AlertRateOfChange, Threshold: 50, WindowSeconds: 600}, nil},
+		{"no scope", models.AlertRuleRequest{Name: "e", Metric: "error_rate"}, []string{"service_id"}},
+		{"both scopes", models.AlertRuleRequest{Name: "e", ServiceID: "s", Region: "us-east-1", Metric: "error_rate"}, []string{"service_id"}},
+		{"bad metric and operator", models.AlertRuleRequest{Name: "e", ServiceID: "s", Metric: "disk", Operator: "!="}, []string{"metric", "operator"}},
+		{"rate without window", models.AlertRuleRequest{Name: "l", ServiceID: "s", Metric: "p95_latency", Kind: models.AlertRateOfChange}, []string{"window_seconds"}},
+		{"bad kind", models.AlertRuleRequest{Name: "e", ServiceID: "s", Metric: "error_rate", Kind: "absent"}, []string{"kind"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateAlertRule(&tt.req)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			if len(fields) != len(tt.want) {
+				t.Fatalf("validateAlertRule() fields = %v, want %v", fields, tt.want)
+			}
+			for i := range fields {
+				if fields[i] != tt.want[i] {
+					t.Errorf("validateAlertRule() fields = %v, want %v", fields, tt.want)
+				}
+			}
+			if tt.req.Operator == "" || tt.req.Kind == "" || tt.req.Enabled == nil {
+				t.Errorf("validateAlertRule() did not fill in defaults: %+v", tt.req)
+			}
+		})
+	}
+}
+
+func TestRuleApplies(t *testing.T) {
+	service := models.Service{ID: "s1", ProjectID: "payments", Region: "us-east-1"}
+
+	tests := []struct {
+		name string
+		rule models.AlertRule
+		want bool
+	}{
+		{"its service", models.AlertRule{ProjectID: "payments", ServiceID: "s1"}, true},
+		{"another service", models.AlertRule{ProjectID: "payments", ServiceID: "s2"}, false},
+		{"its region", models.AlertRule{ProjectID: "payments", Region: "us-east-1"}, true},
+		{"another region", models.AlertRule{ProjectID: "payments", Region: "eu-west-1"}, false},
+		{"another project's region", models.AlertRule{ProjectID: "search", Region: "us-east-1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleApplies(tt.rule, service); got != tt.want {
+				t.Errorf("ruleApplies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
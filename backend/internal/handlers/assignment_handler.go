@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	defaultWatchTimeout = 25 * time.Second
+	maxWatchTimeout     = 50 * time.Second
+	// Long polls re-read the database this often in case the change was
+	// made somewhere that did not notify this process.
+	watchRecheckInterval = 5 * time.Second
+)
+
+// AssignmentHandler serves agents the set of services scheduled onto their
+// node and takes their observed status back.
+type AssignmentHandler struct {
+	db  *sql.DB
+	hub *websocket.Hub
+
+	mu       sync.Mutex
+	watchers map[string]chan struct{} // node ID -> closed on next generation bump
+}
+
+func NewAssignmentHandler(db *sql.DB, hub *websocket.Hub) *AssignmentHandler {
+	return &AssignmentHandler{
+		db:       db,
+		hub:      hub,
+		watchers: make(map[string]chan struct{}),
+	}
+}
+
+// GetAssignments returns the node's assignment set. With ?generation=N it
+// long-polls until the node's generation moves past N or ?timeout= seconds
+// pass, whichever is first; on timeout the unchanged set is returned.
+func (h *AssignmentHandler) GetAssignments(c *gin.Context) {
+	nodeID := c.GetString("node_id")
+
+	since := int64(-1)
+	if generationParam := c.Query("generation"); generationParam != "" {
+		g, err := strconv.ParseInt(generationParam, 10, 64)
+		if err != nil || g < 0 {
+			errors.BadRequest(c, "Invalid generation", nil)
+			return
+		}
+		since = g
+	}
+
+	timeout := defaultWatchTimeout
+	if timeoutParam := c.Query("timeout"); timeoutParam != "" {
+		if t, err := strconv.Atoi(timeoutParam); err == nil && t >= 0 {
+			timeout = time.Duration(t) * time.Second
+			if timeout > maxWatchTimeout {
+				timeout = maxWatchTimeout
+			}
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		// Take the watch channel before reading so a bump between the read
+		// and the wait is not missed.
+		changed := h.watch(nodeID)
+
+		set, err := h.loadAssignments(c.Request.Context(), nodeID)
+		if err != nil {
+			errors.InternalError(c, "Failed to load assignments")
+			return
+		}
+
+		if set.Generation > since {
+			c.JSON(http.StatusOK, set)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(watchRecheckInterval):
+		case <-deadline.C:
+			c.JSON(http.StatusOK, set)
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// ReportStatus records the agent's observed status and uptime for services
+// assigned to its node. Reports for services that are not (or no longer) on
+// the node are ignored, as are reports that change nothing.
+func (h *AssignmentHandler) ReportStatus(c *gin.Context) {
+	nodeID := c.GetString("node_id")
+
+	var req models.NodeStatusReport
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	for _, report := range req.Services {
+		switch report.Status {
+		case models.StatusRunning, models.StatusStarting, models.StatusStopped, models.StatusError:
+		default:
+			errors.BadRequest(c, "Invalid service status", report.ServiceID)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	updated := 0
+	for _, report := range req.Services {
+		service, err := scanService(h.db.QueryRowContext(ctx,
+			`UPDATE services SET status = $1, uptime = $2, status_message = $3, updated_at = $4
+			 WHERE id = $5 AND node_id = $6
+			   AND (status <> $1 OR uptime <> $2 OR status_message <> $3)
+			 RETURNING `+serviceColumns,
+			report.Status, report.Uptime, report.Message, time.Now(), report.ServiceID, nodeID,
+		))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to record service status")
+			return
+		}
+		updated++
+		h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, service)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
+
+func (h *AssignmentHandler) loadAssignments(ctx context.Context, nodeID string) (models.AssignmentSet, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	set := models.AssignmentSet{NodeID: nodeID, Services: []models.Assignment{}}
+	if err := h.db.QueryRowContext(ctx, "SELECT generation FROM nodes WHERE id = $1", nodeID).Scan(&set.Generation); err != nil {
+		return set, err
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT s.id, s.name, s.image, s.version, s.desired_status,
+		        COALESCE((SELECT MAX(sc.version) FROM service_configs sc WHERE sc.service_id = s.id), 0)
+		 FROM services s
+		 WHERE s.node_id = $1
+		 ORDER BY s.name`,
+		nodeID,
+	)
+	if err != nil {
+		return set, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Assignment
+		if err := rows.Scan(&a.ServiceID, &a.Name, &a.Image, &a.Version, &a.DesiredStatus, &a.ConfigRevision); err != nil {
+			return set, err
+		}
+		set.Services = append(set.Services, a)
+	}
+	return set, rows.Err()
+}
+
+// BumpGeneration marks a node's assignment set as changed and wakes any agent
+// long-polling for it.
+func (h *AssignmentHandler) BumpGeneration(ctx context.Context, nodeID string) error {
+	if _, err := h.db.ExecContext(ctx, "UPDATE nodes SET generation = generation + 1 WHERE id = $1", nodeID); err != nil {
+		return err
+	}
+	h.notify(nodeID)
+	return nil
+}
+
+// ServiceChanged bumps the generation of whichever node the service is
+// assigned to, if any. Call it after changing anything in a service's spec.
+func (h *AssignmentHandler) ServiceChanged(ctx context.Context, serviceID string) {
+	var nodeID sql.NullString
+	if err := h.db.QueryRowContext(ctx, "SELECT node_id FROM services WHERE id = $1", serviceID).Scan(&nodeID); err != nil {
+		return
+	}
+	if !nodeID.Valid {
+		return
+	}
+	if err := h.BumpGeneration(ctx, nodeID.String); err != nil {
+		log.Printf("Failed to bump generation for node %s: %v", nodeID.String, err)
+	}
+}
+
+func (h *AssignmentHandler) watch(nodeID string) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch, ok := h.watchers[nodeID]
+	if !ok {
+		ch = make(chan struct{})
+		h.watchers[nodeID] = ch
+	}
+	return ch
+}
+
+func (h *AssignmentHandler) notify(nodeID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ch, ok := h.watchers[nodeID]; ok {
+		close(ch)
+		delete(h.watchers, nodeID)
+	}
+}
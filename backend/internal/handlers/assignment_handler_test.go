@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestAssignmentWatchNotify(t *testing.T) {
+	h := NewAssignmentHandler(nil, nil)
+
+	first := h.watch("node-1")
+	if second := h.watch("node-1"); second != first {
+		t.Error("watch() should share one channel per node until it fires")
+	}
+	other := h.watch("node-2")
+
+	h.notify("node-1")
+
+	select {
+	case <-first:
+	default:
+		t.Error("notify() did not wake watchers of node-1")
+	}
+	select {
+	case <-other:
+		t.Error("notify() woke watchers of an unrelated node")
+	default:
+	}
+
+	if next := h.watch("node-1"); next == first {
+		t.Error("watch() after notify() should return a fresh channel")
+	}
+
+	// Notifying a node nobody watches is a no-op
+	h.notify("node-3")
+}
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+)
+
+const (
+	// Responses larger than this are audited without their body
+	maxAuditBody  = 64 << 10
+	auditRedacted = "[REDACTED]"
+	// auditBeforeKey is where handlers leave the resource as it was before
+	// the call, for the audit log.
+	auditBeforeKey = "audit_before"
+)
+
+// auditSecretFields are redacted wherever they appear in audited bodies.
+var auditSecretFields = map[string]bool{
+	"token":         true,
+	"refresh_token": true,
+	"key":           true,
+	"secret":        true,
+	"client_secret": true,
+	"private_key":   true,
+	"password":      true,
+}
+
+// AuditHandler writes the audit log and lets admins query and export it.
+type AuditHandler struct {
+	db *sql.DB
+}
+
+func NewAuditHandler(db *sql.DB) *AuditHandler {
+	return &AuditHandler{db: db}
+}
+
+// auditBefore records the resource a handler is about to change, so its
+// audit entry shows what changed.
+func auditBefore(c *gin.Context, resource interface{}) {
+	c.Set(auditBeforeKey, resource)
+}
+
+// auditWriter keeps a copy of the response body for the audit entry.
+type auditWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *auditWriter) capture(b []byte) {
+	if w.truncated {
+		return
+	}
+	if w.body.Len()+len(b) > maxAuditBody {
+		w.truncated = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(b)
+}
+
+// Record is middleware writing an audit entry for every POST, PUT, PATCH
+// and DELETE passing through it. Use it before AuthRequired so refused
+// calls are recorded too.
+func (h *AuditHandler) Record() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+
+		w := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		occurredAt := time.Now()
+
+		c.Next()
+
+		var body []byte
+		if !w.truncated {
+			body = w.body.Bytes()
+		}
+		before, _ := c.Get(auditBeforeKey)
+		entry := newAuditEntry(c, occurredAt, before, body)
+
+		// The request's context may already be cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := h.insert(ctx, entry); err != nil {
+			log.Printf("Failed to write audit entry for %s (request %s): %v", entry.Action, entry.RequestID, err)
+		}
+	}
+}
+
+// newAuditEntry describes a finished call. body is its response, if not
+// too large to keep.
+func newAuditEntry(c *gin.Context, occurredAt time.Time, before interface{}, body []byte) models.AuditEntry {
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	role, _ := c.Get("role")
+	actorRole, _ := role.(middleware.Role)
+
+	entry := models.AuditEntry{
+		OccurredAt: occurredAt,
+		RequestID:  c.GetString("request_id"),
+		Actor:      c.GetString("user_id"),
+		ActorRole:  string(actorRole),
+		ClientIP:   c.ClientIP(),
+		Action:     c.Request.Method + " " + route,
+		Status:     c.Writer.Status(),
+	}
+	entry.ResourceType, entry.ResourceID = auditResource(route, c.Param("id"), c.Param("user_id"))
+
+	switch {
+	case entry.Status < 400:
+		entry.Outcome = models.AuditSuccess
+	case entry.Status == http.StatusUnauthorized || entry.Status == http.StatusForbidden:
+		entry.Outcome = models.AuditDenied
+	default:
+		entry.Outcome = models.AuditFailed
+	}
+
+	var beforeDoc, afterDoc interface{}
+	if before != nil {
+		// Round-trip through JSON to see the resource as clients do
+		if raw, err := json.Marshal(before); err == nil {
+			json.Unmarshal(raw, &beforeDoc)
+		}
+	}
+	if len(body) > 0 {
+		var doc interface{}
+		if json.Unmarshal(body, &doc) == nil {
+			if entry.Outcome == models.AuditSuccess {
+				afterDoc = doc
+			} else if m, ok := doc.(map[string]interface{}); ok {
+				entry.Error, _ = m["message"].(string)
+			}
+		}
+	}
+	beforeDoc, afterDoc = redactSecrets(beforeDoc), redactSecrets(afterDoc)
+
+	if beforeDoc != nil {
+		entry.Before, _ = json.Marshal(beforeDoc)
+	}
+	if afterDoc != nil {
+		entry.After, _ = json.Marshal(afterDoc)
+		// A create only learns its resource's ID from the response
+		if m, ok := afterDoc.(map[string]interface{}); ok && entry.ResourceID == "" && c.Request.Method == http.MethodPost {
+			entry.ResourceID, _ = m["id"].(string)
+		}
+	}
+	beforeMap, beforeOK := beforeDoc.(map[string]interface{})
+	afterMap, afterOK := afterDoc.(map[string]interface{})
+	if beforeOK && afterOK {
+		entry.Changes = diffConfig(beforeMap, afterMap)
+	}
+	return entry
+}
+
+// auditResource names the resource a route acts on: the first segment of
+// its path under /api/v1, and the ID in its path, if any.
+func auditResource(route, id, userID string) (string, string) {
+	path := strings.TrimPrefix(strings.TrimPrefix(route, "/api/v1"), "/")
+	resourceType, _, _ := strings.Cut(path, "/")
+	if id == "" {
+		id = userID
+	}
+	return resourceType, id
+}
+
+// redactSecrets replaces the values of secret fields, at any depth.
+func redactSecrets(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if auditSecretFields[key] {
+				v[key] = auditRedacted
+			} else {
+				v[key] = redactSecrets(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactSecrets(v[i])
+		}
+	}
+	return doc
+}
+
+func (h *AuditHandler) insert(ctx context.Context, e models.AuditEntry) error {
+	var changes []byte
+	if e.Changes != nil {
+		changes, _ = json.Marshal(e.Changes)
+	}
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO audit_log (occurred_at, request_id, actor, actor_role, client_ip, action, resource_type, resource_id,
+			before, after, changes, status, outcome, error)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		e.OccurredAt, e.RequestID, e.Actor, e.ActorRole, e.ClientIP, e.Action, e.ResourceType, e.ResourceID,
+		nullJSON(e.Before), nullJSON(e.After), nullJSON(changes), e.Status, e.Outcome, e.Error,
+	)
+	return err
+}
+
+// nullJSON stores empty documents as NULL.
+func nullJSON(raw []byte) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return raw
+}
+
+// auditColumns is the column list scanAuditEntry expects, in order.
+const auditColumns = "id, occurred_at, request_id, actor, actor_role, client_ip, action, resource_type, resource_id, before, after, changes, status, outcome, error"
+
+func scanAuditEntry(row rowScanner) (models.AuditEntry, error) {
+	var e models.AuditEntry
+	var before, after, changes []byte
+	if err := row.Scan(&e.ID, &e.OccurredAt, &e.RequestID, &e.Actor, &e.ActorRole, &e.ClientIP, &e.Action,
+		&e.ResourceType, &e.ResourceID, &before, &after, &changes, &e.Status, &e.Outcome, &e.Error); err != nil {
+		return e, err
+	}
+	if len(before) > 0 {
+		e.Before = before
+	}
+	if len(after) > 0 {
+		e.After = after
+	}
+	if len(changes) > 0 {
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// auditQuery builds the query for ListAuditLog and ExportAuditLog from
+// ?actor=, ?resource_type=, ?resource_id=, ?outcome=, ?since= and ?until=
+// (RFC 3339), newest first.
+func auditQuery(c *gin.Context) (string, []interface{}, error) {
+	query := "SELECT " + auditColumns + " FROM audit_log WHERE 1=1"
+	args := []interface{}{}
+
+	for _, filter := range []string{"actor", "resource_type", "resource_id", "outcome"} {
+		if value := c.Query(filter); value != "" {
+			args = append(args, value)
+			query += fmt.Sprintf(" AND %s = $%d", filter, len(args))
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s must be an RFC 3339 time", bound.param)
+		}
+		args = append(args, t)
+		query += fmt.Sprintf(" AND occurred_at %s $%d", bound.op, len(args))
+	}
+	// Entries older than ?before= (an entry ID), for paging
+	if value := c.Query("before"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("before must be an entry ID")
+		}
+		args = append(args, id)
+		query += fmt.Sprintf(" AND id < $%d", len(args))
+	}
+	return query + " ORDER BY id DESC", args, nil
+}
+
+// ListAuditLog returns up to ?limit= (default 100, at most 500) entries.
+// Pass the last entry's ID as ?before= for the next page.
+func (h *AuditHandler) ListAuditLog(c *gin.Context) {
+	query, args, err := auditQuery(c)
+	if err != nil {
+		errors.BadRequest(c, err.Error(), nil)
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" LIMIT $%d", len(args))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query audit log")
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan audit entry")
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// auditCSVHeader names the columns of a CSV export.
+var auditCSVHeader = []string{"id", "occurred_at", "request_id", "actor", "actor_role", "client_ip", "action",
+	"resource_type", "resource_id", "status", "outcome", "error", "before", "after", "changes"}
+
+// ExportAuditLog streams every matching entry as newline-delimited JSON
+// or, with ?format=csv, as CSV.
+func (h *AuditHandler) ExportAuditLog(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	if format != "ndjson" && format != "csv" {
+		errors.BadRequest(c, "format must be ndjson or csv", nil)
+		return
+	}
+	query, args, err := auditQuery(c)
+	if err != nil {
+		errors.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
+	defer cancel()
+	// Exports can outlast the server's write timeout
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query audit log")
+		return
+	}
+	defer rows.Close()
+
+	filename := "audit-log-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		csvWriter = csv.NewWriter(c.Writer)
+		csvWriter.Write(auditCSVHeader)
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			log.Printf("Audit log export failed: %v", err)
+			break
+		}
+		if csvWriter != nil {
+			err = csvWriter.Write(auditCSVRecord(e))
+		} else {
+			err = encoder.Encode(e)
+		}
+		if err != nil {
+			break // client went away
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Audit log export failed: %v", err)
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+}
+
+func auditCSVRecord(e models.AuditEntry) []string {
+	changes := ""
+	if e.Changes != nil {
+		raw, _ := json.Marshal(e.Changes)
+		changes = string(raw)
+	}
+	return []string{
+		strconv.FormatInt(e.ID, 10), e.OccurredAt.UTC().Format(time.RFC3339Nano), e.RequestID, e.Actor, e.ActorRole,
+		e.ClientIP, e.Action, e.ResourceType, e.ResourceID, strconv.Itoa(e.Status), e.Outcome, e.Error,
+		string(e.Before), string(e.After), changes,
+	}
+}
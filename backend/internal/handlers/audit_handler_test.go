@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{
+		"token": "eyJ...", "name": "ci",
+		"key": {"id": "k1", "key": "sk_live"},
+		"keys": [{"private_key": "pem", "kid": "a"}],
+		"config": {"db": {"password": "hunter2", "host": "db"}}
+	}`), &doc)
+
+	var want interface{}
+	json.Unmarshal([]byte(`{
+		"token": "[REDACTED]", "name": "ci",
+		"key": "[REDACTED]",
+		"keys": [{"private_key": "[REDACTED]", "kid": "a"}],
+		"config": {"db": {"password": "[REDACTED]", "host": "db"}}
+	}`), &want)
+
+	if got := redactSecrets(doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactSecrets() = %v, want %v", got, want)
+	}
+	if redactSecrets(nil) != nil {
+		t.Error("redactSecrets(nil) should be nil")
+	}
+}
+
+func TestAuditResource(t *testing.T) {
+	tests := []struct {
+		route, id, userID string
+		wantType, wantID  string
+	}{
+		{"/api/v1/services/:id", "svc-1", "", "services", "svc-1"},
+		{"/api/v1/services", "", "", "services", ""},
+		{"/api/v1/deployments/:id/abort", "dep-1", "", "deployments", "dep-1"},
+		{"/api/v1/users/:user_id/revoke-sessions", "", "alice", "users", "alice"},
+		{"/api/v1/signing-keys/rotate", "", "", "signing-keys", ""},
+		{"/auth/logout", "", "", "auth", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			gotType, gotID := auditResource(tt.route, tt.id, tt.userID)
+			if gotType != tt.wantType || gotID != tt.wantID {
+				t.Errorf("auditResource() = %q, %q, want %q, %q", gotType, gotID, tt.wantType, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestNewAuditEntry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	now := time.Now()
+
+	audit := func(method, path string, status int, before interface{}, body string) models.AuditEntry {
+		var entry models.AuditEntry
+		r := gin.New()
+		handle := func(c *gin.Context) {
+			c.Set("request_id", "req-1")
+			c.Set("user_id", "alice")
+			c.Set("role", middleware.RoleOperator)
+			c.Data(status, "application/json", []byte(body))
+			entry = newAuditEntry(c, now, before, []byte(body))
+		}
+		r.Handle(method, "/api/v1/services", handle)
+		r.Handle(method, "/api/v1/services/:id", handle)
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.0.0.1:4000"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return entry
+	}
+
+	updated := audit(http.MethodPatch, "/api/v1/services/svc-1", http.StatusOK,
+		models.Service{ID: "svc-1", Version: "1.0.0"}, `{"id": "svc-1", "version": "1.1.0"}`)
+	if updated.Action != "PATCH /api/v1/services/:id" || updated.ResourceType != "services" || updated.ResourceID != "svc-1" {
+		t.Errorf("unexpected action or resource: %+v", updated)
+	}
+	if updated.RequestID != "req-1" || updated.Actor != "alice" || updated.ActorRole != "operator" || updated.ClientIP != "10.0.0.1" {
+		t.Errorf("unexpected request details: %+v", updated)
+	}
+	if updated.Outcome != models.AuditSuccess || updated.Status != http.StatusOK {
+		t.Errorf("outcome = %s (%d), want success", updated.Outcome, updated.Status)
+	}
+	found := false
+	for _, change := range updated.Changes {
+		if change.Path == "version" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("changes = %+v, want the version change", updated.Changes)
+	}
+
+	created := audit(http.MethodPost, "/api/v1/services", http.StatusCreated, nil, `{"id": "svc-2", "name": "api"}`)
+	if created.ResourceID != "svc-2" || created.Before != nil || created.Changes != nil {
+		t.Errorf("a create should take its ID from the response and have no before: %+v", created)
+	}
+
+	denied := audit(http.MethodDelete, "/api/v1/services/svc-1", http.StatusForbidden, nil,
+		`{"error": "Forbidden", "message": "Insufficient permissions", "code": 403}`)
+	if denied.Outcome != models.AuditDenied || denied.Error != "Insufficient permissions" || denied.After != nil {
+		t.Errorf("unexpected denied entry: %+v", denied)
+	}
+
+	failed := audit(http.MethodDelete, "/api/v1/services/svc-1", http.StatusInternalServerError, nil, `{"message": "boom"}`)
+	if failed.Outcome != models.AuditFailed {
+		t.Errorf("outcome = %s, want failed", failed.Outcome)
+	}
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const maxConfigBytes = 64 * 1024
+
+const configColumns = "id, service_id, config, version, created_at, COALESCE(created_by, '')"
+
+// ConfigHandler serves the versioned service configs. Versions are
+// append-only and numbered per service; every write may be checked against
+// an optional per-service JSON Schema.
+type ConfigHandler struct {
+	db          *sql.DB
+	hub         *websocket.Hub
+	assignments *AssignmentHandler
+}
+
+func NewConfigHandler(db *sql.DB, hub *websocket.Hub, assignments *AssignmentHandler) *ConfigHandler {
+	return &ConfigHandler{
+		db:          db,
+		hub:         hub,
+		assignments: assignments,
+	}
+}
+
+func scanConfig(row rowScanner) (models.ServiceConfig, error) {
+	var cfg models.ServiceConfig
+	var raw []byte
+	if err := row.Scan(&cfg.ID, &cfg.ServiceID, &raw, &cfg.Version, &cfg.CreatedAt, &cfg.CreatedBy); err != nil {
+		return cfg, err
+	}
+	err := json.Unmarshal(raw, &cfg.Config)
+	return cfg, err
+}
+
+// GetConfig returns the latest config version.
+func (h *ConfigHandler) GetConfig(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	cfg, err := h.loadConfig(ctx, c.Param("id"), 0)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Config")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get config")
+		return
+	}
+
+	c.JSON(http.StatusOK, cfg)
+}
+
+func (h *ConfigHandler) GetConfigVersion(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		errors.BadRequest(c, "Invalid config version", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	cfg, err := h.loadConfig(ctx, c.Param("id"), version)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Config version")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get config")
+		return
+	}
+
+	c.JSON(http.StatusOK, cfg)
+}
+
+func (h *ConfigHandler) ListConfigVersions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+configColumns+" FROM service_configs WHERE service_id = $1 ORDER BY version DESC LIMIT 100",
+		c.Param("id"),
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to query configs")
+		return
+	}
+	defer rows.Close()
+
+	configs := []models.ServiceConfig{}
+	for rows.Next() {
+		cfg, err := scanConfig(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan config")
+			return
+		}
+		configs = append(configs, cfg)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"configs": configs})
+}
+
+// PutConfig stores a new config version, validated against the service's
+// schema if it has one.
+func (h *ConfigHandler) PutConfig(c *gin.Context) {
+	id := c.Param("id")
+	user := c.GetString("user_id")
+
+	var req models.PutConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	raw, err := json.Marshal(req.Config)
+	if err != nil {
+		errors.BadRequest(c, "Invalid config", err.Error())
+		return
+	}
+	if len(raw) > maxConfigBytes {
+		errors.BadRequest(c, fmt.Sprintf("Config must be at most %d bytes", maxConfigBytes), nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	schema, err := h.loadSchema(ctx, id)
+	if err != nil && err != sql.ErrNoRows {
+		errors.InternalError(c, "Failed to get config schema")
+		return
+	}
+	if err == nil {
+		if errs := validation.ValidateAgainstSchema(schema.Schema, req.Config, "config"); len(errs) > 0 {
+			errors.BadRequest(c, "Config does not match the service's schema", errs)
+			return
+		}
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to save config")
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the service row serialises config writes for it
+	var locked string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM services WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+
+	var latest int
+	previous, err := scanConfig(tx.QueryRowContext(ctx,
+		"SELECT "+configColumns+" FROM service_configs WHERE service_id = $1 ORDER BY version DESC LIMIT 1", id,
+	))
+	switch {
+	case err == nil:
+		latest = previous.Version
+		auditBefore(c, previous)
+	case err != sql.ErrNoRows:
+		errors.InternalError(c, "Failed to get config version")
+		return
+	}
+	if req.BaseVersion != nil && *req.BaseVersion != latest {
+		errors.Conflict(c, fmt.Sprintf("Config was changed: latest version is %d, not %d", latest, *req.BaseVersion))
+		return
+	}
+
+	cfg, err := scanConfig(tx.QueryRowContext(ctx,
+		`INSERT INTO service_configs (id, service_id, config, version, created_at, created_by)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+configColumns,
+		uuid.New().String(), id, raw, latest+1, time.Now(), user,
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to save config")
+		return
+	}
+
+	if _, err := recordRevision(ctx, tx, id, fmt.Sprintf("config version %d", cfg.Version), user); err != nil {
+		errors.InternalError(c, "Failed to record revision")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to save config")
+		return
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeConfigUpdate, cfg)
+	recordDeploymentLog(h.db, h.hub, id, "config_update", "success", fmt.Sprintf("Config version %d saved", cfg.Version))
+	h.assignments.ServiceChanged(ctx, id)
+
+	c.JSON(http.StatusCreated, cfg)
+}
+
+// DiffConfig compares two config versions. to defaults to the latest version
+// and from to the one before it; version 0 is the empty config.
+func (h *ConfigHandler) DiffConfig(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	to := 0
+	if param := c.Query("to"); param != "" {
+		v, err := strconv.Atoi(param)
+		if err != nil || v < 1 {
+			errors.BadRequest(c, "Invalid to version", nil)
+			return
+		}
+		to = v
+	}
+
+	toCfg, err := h.loadConfig(ctx, id, to)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Config version")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get config")
+		return
+	}
+
+	from := toCfg.Version - 1
+	if param := c.Query("from"); param != "" {
+		v, err := strconv.Atoi(param)
+		if err != nil || v < 0 {
+			errors.BadRequest(c, "Invalid from version", nil)
+			return
+		}
+		from = v
+	}
+
+	fromCfg := models.ServiceConfig{Config: map[string]interface{}{}}
+	if from > 0 {
+		fromCfg, err = h.loadConfig(ctx, id, from)
+		if err == sql.ErrNoRows {
+			errors.NotFound(c, "Config version")
+			return
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to get config")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, models.ConfigDiff{
+		ServiceID:   id,
+		FromVersion: from,
+		ToVersion:   toCfg.Version,
+		Changes:     diffConfig(fromCfg.Config, toCfg.Config),
+	})
+}
+
+func (h *ConfigHandler) GetConfigSchema(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	schema, err := h.loadSchema(ctx, c.Param("id"))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Config schema")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get config schema")
+		return
+	}
+
+	c.JSON(http.StatusOK, schema)
+}
+
+// PutConfigSchema sets the schema future config versions are validated
+// against. Existing versions are not re-checked.
+func (h *ConfigHandler) PutConfigSchema(c *gin.Context) {
+	id := c.Param("id")
+
+	var req models.PutConfigSchemaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if err := validation.ValidateSchema(req.Schema); err != nil {
+		errors.BadRequest(c, "Invalid schema", err)
+		return
+	}
+
+	raw, err := json.Marshal(req.Schema)
+	if err != nil {
+		errors.BadRequest(c, "Invalid schema", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	schema := models.ConfigSchema{
+		ServiceID: id,
+		Schema:    req.Schema,
+		UpdatedBy: c.GetString("user_id"),
+		UpdatedAt: time.Now(),
+	}
+	result, err := h.db.ExecContext(ctx,
+		`INSERT INTO service_config_schemas (service_id, schema, updated_by, updated_at)
+		 SELECT id, $2, $3, $4 FROM services WHERE id = $1
+		 ON CONFLICT (service_id) DO UPDATE SET schema = EXCLUDED.schema, updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at`,
+		id, raw, schema.UpdatedBy, schema.UpdatedAt,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to save config schema")
+		return
+	}
+
+	// The INSERT ... SELECT writes nothing for an unknown service
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		errors.NotFound(c, "Service")
+		return
+	}
+
+	c.JSON(http.StatusOK, schema)
+}
+
+func (h *ConfigHandler) DeleteConfigSchema(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	result, err := h.db.ExecContext(ctx, "DELETE FROM service_config_schemas WHERE service_id = $1", c.Param("id"))
+	if err != nil {
+		errors.InternalError(c, "Failed to delete config schema")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		errors.NotFound(c, "Config schema")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Config schema deleted successfully"})
+}
+
+// loadConfig loads one config version, or the latest when version is 0.
+func (h *ConfigHandler) loadConfig(ctx context.Context, serviceID string, version int) (models.ServiceConfig, error) {
+	if version == 0 {
+		return scanConfig(h.db.QueryRowContext(ctx,
+			"SELECT "+configColumns+" FROM service_configs WHERE service_id = $1 ORDER BY version DESC LIMIT 1",
+			serviceID,
+		))
+	}
+	return scanConfig(h.db.QueryRowContext(ctx,
+		"SELECT "+configColumns+" FROM service_configs WHERE service_id = $1 AND version = $2",
+		serviceID, version,
+	))
+}
+
+func (h *ConfigHandler) loadSchema(ctx context.Context, serviceID string) (models.ConfigSchema, error) {
+	var schema models.ConfigSchema
+	var raw []byte
+	err := h.db.QueryRowContext(ctx,
+		"SELECT service_id, schema, COALESCE(updated_by, ''), updated_at FROM service_config_schemas WHERE service_id = $1",
+		serviceID,
+	).Scan(&schema.ServiceID, &raw, &schema.UpdatedBy, &schema.UpdatedAt)
+	if err != nil {
+		return schema, err
+	}
+	err = json.Unmarshal(raw, &schema.Schema)
+	return schema, err
+}
+
+// diffConfig lists the changes from one config to another, recursing into
+// nested objects, sorted by path.
+func diffConfig(from, to map[string]interface{}) []models.ConfigChange {
+	changes := []models.ConfigChange{}
+	diffInto(&changes, "", from, to)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffInto(changes *[]models.ConfigChange, prefix string, from, to map[string]interface{}) {
+	for k, old := range from {
+		path := prefix + k
+		cur, ok := to[k]
+		if !ok {
+			*changes = append(*changes, models.ConfigChange{Path: path, Op: models.ConfigRemoved, From: old})
+			continue
+		}
+		oldMap, oldIsMap := old.(map[string]interface{})
+		curMap, curIsMap := cur.(map[string]interface{})
+		if oldIsMap && curIsMap {
+			diffInto(changes, path+".", oldMap, curMap)
+			continue
+		}
+		if !reflect.DeepEqual(old, cur) {
+			*changes = append(*changes, models.ConfigChange{Path: path, Op: models.ConfigChanged, From: old, To: cur})
+		}
+	}
+	for k, cur := range to {
+		if _, ok := from[k]; !ok {
+			*changes = append(*changes, models.ConfigChange{Path: prefix + k, Op: models.ConfigAdded, To: cur})
+		}
+	}
+}
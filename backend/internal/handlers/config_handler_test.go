@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestDiffConfig(t *testing.T) {
+	from := map[string]interface{}{
+		"port":    float64(8080),
+		"debug":   false,
+		"removed": "x",
+		"tls":     map[string]interface{}{"enabled": true, "cert": "a.pem"},
+		"hosts":   []interface{}{"a", "b"},
+	}
+	to := map[string]interface{}{
+		"port":  float64(9090),
+		"debug": false,
+		"added": float64(1),
+		"tls":   map[string]interface{}{"enabled": true, "cert": "b.pem"},
+		"hosts": []interface{}{"a", "b", "c"},
+	}
+
+	want := []models.ConfigChange{
+		{Path: "added", Op: models.ConfigAdded, To: float64(1)},
+		{Path: "hosts", Op: models.ConfigChanged, From: []interface{}{"a", "b"}, To: []interface{}{"a", "b", "c"}},
+		{Path: "port", Op: models.ConfigChanged, From: float64(8080), To: float64(9090)},
+		{Path: "removed", Op: models.ConfigRemoved, From: "x"},
+		{Path: "tls.cert", Op: models.ConfigChanged, From: "a.pem", To: "b.pem"},
+	}
+
+	if got := diffConfig(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig() = %+v, want %+v", got, want)
+	}
+
+	if got := diffConfig(to, to); len(got) != 0 {
+		t.Errorf("diffConfig() of identical configs = %+v, want none", got)
+	}
+}
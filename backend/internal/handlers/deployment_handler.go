@@ -0,0 +1,1001 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	defaultBatchSize     = 1
+	defaultMaxErrorRate  = 5.0 // percent
+	defaultHealthTimeout = 120 // seconds
+	defaultBakeSeconds   = 30
+	maxDeploymentSeconds = 3600
+	healthPollInterval   = 5 * time.Second
+
+	defaultCanaryPercent      = 10
+	defaultAnalysisSeconds    = 300
+	defaultMaxErrorRateDelta  = 1.0  // percentage points
+	defaultMaxLatencyIncrease = 20.0 // percent
+	minCanarySamples          = 3    // per side, below this the analysis is inconclusive
+
+	deploymentHeartbeatInterval = 10 * time.Second
+	deploymentOwnerTimeout      = time.Minute // a deployment not heartbeated for this long is rolled back
+)
+
+// errDeploymentNotOwned stops a deployment another replica has taken over.
+var errDeploymentNotOwned = fmt.Errorf("another control plane replica took over the deployment")
+
+const deploymentColumns = "id, service_id, service_name, version, strategy, batch_size, max_error_rate, health_timeout_seconds, bake_seconds, canary_percent, analysis_seconds, max_error_rate_delta, max_latency_increase, analysis, status, current_batch, total_batches, message, COALESCE(created_by, ''), created_at, updated_at"
+
+// DeploymentHandler manages rolling and canary deployments. Each active deployment is
+// driven by its own goroutine on the replica that created it, its owner;
+// rollouts whose owner stopped are rolled back by Run.
+type DeploymentHandler struct {
+	db          *sql.DB
+	hub         *websocket.Hub
+	metrics     *MetricsHandler
+	assignments *AssignmentHandler
+	authz       *RoleBindingHandler
+	// owner identifies this replica as the owner of deployments
+	owner string
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
+}
+
+func NewDeploymentHandler(db *sql.DB, hub *websocket.Hub, metrics *MetricsHandler, assignments *AssignmentHandler, authz *RoleBindingHandler) *DeploymentHandler {
+	return &DeploymentHandler{
+		db:          db,
+		hub:         hub,
+		metrics:     metrics,
+		assignments: assignments,
+		authz:       authz,
+		owner:       uuid.NewString(),
+		running:     make(map[string]context.CancelCauseFunc),
+	}
+}
+
+func scanDeployment(row rowScanner) (models.Deployment, error) {
+	var d models.Deployment
+	var analysis []byte
+	err := row.Scan(&d.ID, &d.ServiceID, &d.ServiceName, &d.Version, &d.Strategy, &d.BatchSize, &d.MaxErrorRate, &d.HealthTimeoutSeconds, &d.BakeSeconds, &d.CanaryPercent, &d.AnalysisSeconds, &d.MaxErrorRateDelta, &d.MaxLatencyIncrease, &analysis, &d.Status, &d.CurrentBatch, &d.TotalBatches, &d.Message, &d.CreatedBy, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return d, err
+	}
+	if len(analysis) > 0 {
+		d.Analysis = &models.CanaryAnalysis{}
+		if err := json.Unmarshal(analysis, d.Analysis); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+func (h *DeploymentHandler) CreateDeployment(c *gin.Context) {
+	serviceID := c.Param("id")
+
+	var req models.CreateDeploymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	if req.BatchSize == 0 {
+		req.BatchSize = defaultBatchSize
+	}
+	if req.MaxErrorRate == 0 {
+		req.MaxErrorRate = defaultMaxErrorRate
+	}
+	if req.HealthTimeoutSeconds == 0 {
+		req.HealthTimeoutSeconds = defaultHealthTimeout
+	}
+	if req.BakeSeconds == 0 {
+		req.BakeSeconds = defaultBakeSeconds
+	}
+	if req.Strategy == "" {
+		req.Strategy = models.StrategyRolling
+	}
+	if req.Strategy == models.StrategyCanary {
+		if req.CanaryPercent == 0 {
+			req.CanaryPercent = defaultCanaryPercent
+		}
+		if req.AnalysisSeconds == 0 {
+			req.AnalysisSeconds = defaultAnalysisSeconds
+		}
+		if req.MaxErrorRateDelta == 0 {
+			req.MaxErrorRateDelta = defaultMaxErrorRateDelta
+		}
+		if req.MaxLatencyIncrease == 0 {
+			req.MaxLatencyIncrease = defaultMaxLatencyIncrease
+		}
+	}
+
+	var validationErrs validation.ValidationErrors
+	if err := validation.ValidateVersion(req.Version); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if req.BatchSize < 0 {
+		validationErrs = append(validationErrs, validation.ValidationError{Field: "batch_size", Message: "batch_size must be positive"})
+	}
+	if err := validation.ValidatePercentage("max_error_rate", req.MaxErrorRate); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateSeconds("health_timeout_seconds", req.HealthTimeoutSeconds, maxDeploymentSeconds); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateSeconds("bake_seconds", req.BakeSeconds, maxDeploymentSeconds); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateDeploymentStrategy(string(req.Strategy)); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if req.CanaryPercent < 0 || req.CanaryPercent > 99 {
+		validationErrs = append(validationErrs, validation.ValidationError{Field: "canary_percent", Message: "canary_percent must be between 1 and 99"})
+	}
+	if err := validation.ValidateSeconds("analysis_seconds", req.AnalysisSeconds, maxDeploymentSeconds); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidatePercentage("max_error_rate_delta", req.MaxErrorRateDelta); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if req.MaxLatencyIncrease < 0 {
+		validationErrs = append(validationErrs, validation.ValidationError{Field: "max_latency_increase", Message: "max_latency_increase must not be negative"})
+	}
+	for _, region := range req.Regions {
+		if err := validation.ValidateRegion(region); err != nil {
+			validationErrs = append(validationErrs, err.(validation.ValidationError))
+		}
+	}
+	if len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var serviceName, projectID string
+	err := h.db.QueryRowContext(ctx, "SELECT name, project_id FROM services WHERE id = $1", serviceID).Scan(&serviceName, &projectID)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to create deployment")
+		return
+	}
+	defer tx.Rollback()
+
+	// Holding the lock until the deployment is inserted keeps concurrent
+	// requests from both finding no active deployment
+	if err := lockDeployments(ctx, tx, projectID, serviceName); err != nil {
+		errors.InternalError(c, "Failed to lock deployments")
+		return
+	}
+	active, err := hasActiveDeployment(ctx, tx, projectID, serviceName)
+	if err != nil {
+		errors.InternalError(c, "Failed to check active deployments")
+		return
+	}
+	if active {
+		errors.Conflict(c, "A deployment is already in progress for this service")
+		return
+	}
+
+	// Every instance of the service in its project not already on the
+	// target version
+	query := "SELECT id, region, labels, version FROM services WHERE project_id = $1 AND name = $2 AND version <> $3"
+	args := []interface{}{projectID, serviceName, req.Version}
+	if len(req.Regions) > 0 {
+		query += " AND region = ANY($4)"
+		args = append(args, pq.Array(req.Regions))
+	}
+	query += " ORDER BY region, id"
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query service instances")
+		return
+	}
+	targets := []models.DeploymentTarget{}
+	instances := []models.Service{}
+	for rows.Next() {
+		var t models.DeploymentTarget
+		var labels []byte
+		if err := rows.Scan(&t.ServiceID, &t.Region, &labels, &t.FromVersion); err != nil {
+			rows.Close()
+			errors.InternalError(c, "Failed to scan service instance")
+			return
+		}
+		t.Status = models.TargetPending
+		targets = append(targets, t)
+		instance := models.Service{ID: t.ServiceID, Name: serviceName, Region: t.Region}
+		json.Unmarshal(labels, &instance.Labels)
+		instances = append(instances, instance)
+	}
+	rows.Close()
+
+	if len(targets) == 0 {
+		errors.BadRequest(c, "Every instance is already running version "+req.Version, nil)
+		return
+	}
+	// Role bindings may cover only some instances; limit the regions to
+	// deploy to those
+	if !h.authz.authorize(ctx, c, middleware.RoleOperator, instances...) {
+		return
+	}
+
+	// A canary needs at least one instance left on the old version to be
+	// compared against. The canaries form batch 1; the rest follow in
+	// batches of batch_size once the analysis passes.
+	canaries := 0
+	if req.Strategy == models.StrategyCanary {
+		if len(targets) < 2 {
+			errors.BadRequest(c, "A canary deployment needs at least two instances to update", nil)
+			return
+		}
+		canaries = canaryCount(len(targets), req.CanaryPercent)
+	}
+	for i := range targets {
+		if i < canaries {
+			targets[i].Batch = 1
+			targets[i].Canary = true
+		} else if canaries > 0 {
+			targets[i].Batch = batchNumber(i-canaries, req.BatchSize) + 1
+		} else {
+			targets[i].Batch = batchNumber(i, req.BatchSize)
+		}
+	}
+
+	now := time.Now()
+	d := models.Deployment{
+		ID:                   uuid.New().String(),
+		ServiceID:            serviceID,
+		ServiceName:          serviceName,
+		Version:              req.Version,
+		Strategy:             req.Strategy,
+		BatchSize:            req.BatchSize,
+		MaxErrorRate:         req.MaxErrorRate,
+		HealthTimeoutSeconds: req.HealthTimeoutSeconds,
+		BakeSeconds:          req.BakeSeconds,
+		CanaryPercent:        req.CanaryPercent,
+		AnalysisSeconds:      req.AnalysisSeconds,
+		MaxErrorRateDelta:    req.MaxErrorRateDelta,
+		MaxLatencyIncrease:   req.MaxLatencyIncrease,
+		Status:               models.DeploymentPending,
+		TotalBatches:         targets[len(targets)-1].Batch,
+		CreatedBy:            c.GetString("user_id"),
+		CreatedAt:            now,
+		UpdatedAt:            now,
+	}
+	for i := range targets {
+		targets[i].DeploymentID = d.ID
+	}
+	d.Targets = targets
+
+	if err := insertDeployment(ctx, tx, d, h.owner); err != nil {
+		errors.InternalError(c, "Failed to create deployment")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to create deployment")
+		return
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeDeployment, d)
+	if canaries > 0 {
+		recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "pending",
+			fmt.Sprintf("Canary deployment of version %s to %d of %d instance(s), analysing for %ds", d.Version, canaries, len(targets), d.AnalysisSeconds))
+	} else {
+		recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "pending",
+			fmt.Sprintf("Rolling deployment of version %s to %d instance(s) in %d batch(es)", d.Version, len(targets), d.TotalBatches))
+	}
+
+	h.start(d)
+
+	c.JSON(http.StatusCreated, d)
+}
+
+func (h *DeploymentHandler) ListDeployments(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var serviceName, projectID string
+	err := h.db.QueryRowContext(ctx, "SELECT name, project_id FROM services WHERE id = $1", c.Param("id")).Scan(&serviceName, &projectID)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+` FROM deployments
+		 WHERE service_name = $1 AND service_id IN (SELECT id FROM services WHERE project_id = $2)
+		 ORDER BY created_at DESC LIMIT 50`,
+		serviceName, projectID,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to query deployments")
+		return
+	}
+	defer rows.Close()
+
+	deployments := []models.Deployment{}
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan deployment")
+			return
+		}
+		deployments = append(deployments, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployments": deployments})
+}
+
+func (h *DeploymentHandler) GetDeployment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	d, err := h.loadDeployment(ctx, c.Param("id"))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Deployment")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get deployment")
+		return
+	}
+
+	c.JSON(http.StatusOK, d)
+}
+
+// AbortDeployment halts a running deployment and rolls it back. A
+// deployment owned by another replica is aborted by that replica on its
+// next heartbeat.
+func (h *DeploymentHandler) AbortDeployment(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancelQuery := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancelQuery()
+
+	var serviceID string
+	err := h.db.QueryRowContext(ctx, "SELECT service_id FROM deployments WHERE id = $1", id).Scan(&serviceID)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Deployment")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get deployment")
+		return
+	}
+	if !h.authz.authorizeService(ctx, c, middleware.RoleOperator, serviceID) {
+		return
+	}
+
+	h.mu.Lock()
+	cancel, ok := h.running[id]
+	h.mu.Unlock()
+
+	if ok {
+		cancel(fmt.Errorf("aborted by %s", c.GetString("user_id")))
+		c.JSON(http.StatusAccepted, gin.H{"message": "Deployment abort requested"})
+		return
+	}
+
+	result, err := h.db.ExecContext(ctx,
+		"UPDATE deployments SET abort_requested_by = $2 WHERE id = $1 AND status IN ($3, $4) AND owner <> $5",
+		id, c.GetString("user_id"), models.DeploymentPending, models.DeploymentInProgress, h.owner,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to abort deployment")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		errors.Conflict(c, "Deployment is not in progress")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Deployment abort requested"})
+}
+
+// Run heartbeats the deployments this replica owns, aborts those another
+// replica was asked to abort, and rolls back deployments whose owner
+// stopped heartbeating them. Their goroutines are gone, so they can neither
+// finish nor be health-gated any more.
+func (h *DeploymentHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(deploymentHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		h.heartbeat(ctx)
+		h.recoverInterrupted(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat marks this replica's active deployments as still driven and
+// stops those it no longer owns. The database clock is used for heartbeats,
+// so replicas' clocks need not agree.
+func (h *DeploymentHandler) heartbeat(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Only deployments running before the update can be missing from it
+	h.mu.Lock()
+	running := make([]string, 0, len(h.running))
+	for id := range h.running {
+		running = append(running, id)
+	}
+	h.mu.Unlock()
+
+	rows, err := h.db.QueryContext(qctx,
+		`UPDATE deployments SET heartbeat_at = NOW()
+		 WHERE owner = $1 AND status IN ($2, $3)
+		 RETURNING id, COALESCE(abort_requested_by, '')`,
+		h.owner, models.DeploymentPending, models.DeploymentInProgress,
+	)
+	if err != nil {
+		log.Printf("Failed to heartbeat deployments: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	owned := map[string]bool{}
+	for rows.Next() {
+		var id, abortedBy string
+		if err := rows.Scan(&id, &abortedBy); err != nil {
+			log.Printf("Failed to heartbeat deployments: %v", err)
+			return
+		}
+		owned[id] = true
+		if abortedBy != "" {
+			h.cancel(id, fmt.Errorf("aborted by %s", abortedBy))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to heartbeat deployments: %v", err)
+		return
+	}
+
+	for _, id := range running {
+		if !owned[id] {
+			h.cancel(id, errDeploymentNotOwned)
+		}
+	}
+}
+
+// cancel stops the deployment if this replica is driving it.
+func (h *DeploymentHandler) cancel(id string, cause error) {
+	h.mu.Lock()
+	cancel, ok := h.running[id]
+	h.mu.Unlock()
+	if ok {
+		cancel(cause)
+	}
+}
+
+// recoverInterrupted takes over and rolls back the deployments whose owner
+// stopped, including this replica before a restart.
+func (h *DeploymentHandler) recoverInterrupted(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Claiming them keeps other replicas from rolling them back too
+	rows, err := h.db.QueryContext(qctx,
+		`UPDATE deployments SET owner = $1, heartbeat_at = NOW()
+		 WHERE status IN ($2, $3) AND (owner IS NULL OR heartbeat_at IS NULL OR heartbeat_at < NOW() - $4 * INTERVAL '1 second')
+		 RETURNING id`,
+		h.owner, models.DeploymentPending, models.DeploymentInProgress, int(deploymentOwnerTimeout/time.Second),
+	)
+	if err != nil {
+		log.Printf("Failed to claim interrupted deployments: %v", err)
+		return
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		d, err := h.loadDeployment(qctx, id)
+		if err != nil {
+			log.Printf("Failed to load interrupted deployment %s: %v", id, err)
+			continue
+		}
+		go h.rollback(d, fmt.Errorf("interrupted: the control plane replica driving it stopped"))
+	}
+}
+
+func (h *DeploymentHandler) start(d models.Deployment) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	h.mu.Lock()
+	h.running[d.ID] = cancel
+	h.mu.Unlock()
+
+	go func() {
+		defer func() {
+			h.mu.Lock()
+			delete(h.running, d.ID)
+			h.mu.Unlock()
+			cancel(nil)
+		}()
+		h.run(ctx, d)
+	}()
+}
+
+func (h *DeploymentHandler) run(ctx context.Context, d models.Deployment) {
+	h.setStatus(&d, models.DeploymentInProgress, "")
+
+	for batch := 1; batch <= d.TotalBatches; batch++ {
+		d.CurrentBatch = batch
+		h.setStatus(&d, models.DeploymentInProgress, "")
+
+		regions := []string{}
+		for i := range d.Targets {
+			t := &d.Targets[i]
+			if t.Batch != batch {
+				continue
+			}
+			if err := h.setVersion(ctx, d.ID, t.ServiceID, d.Version, "deployment "+d.ID, d.CreatedBy); err != nil {
+				if ctx.Err() != nil {
+					err = context.Cause(ctx)
+				} else {
+					err = fmt.Errorf("failed to update instance in %s: %v", t.Region, err)
+				}
+				h.rollback(d, err)
+				return
+			}
+			h.setTargetStatus(t, models.TargetUpdated)
+			regions = append(regions, t.Region)
+		}
+
+		recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "pending",
+			fmt.Sprintf("Batch %d/%d: updated %s to version %s, waiting for health", batch, d.TotalBatches, strings.Join(regions, ", "), d.Version))
+
+		var err error
+		if d.Strategy == models.StrategyCanary && batch == 1 {
+			err = h.analyzeCanary(ctx, &d)
+		} else {
+			_, err = h.waitHealthy(ctx, d, batch, time.Now(), time.Duration(d.BakeSeconds)*time.Second)
+		}
+		if err != nil {
+			h.rollback(d, err)
+			return
+		}
+
+		for i := range d.Targets {
+			if d.Targets[i].Batch == batch {
+				h.setTargetStatus(&d.Targets[i], models.TargetHealthy)
+			}
+		}
+		recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "success",
+			fmt.Sprintf("Batch %d/%d healthy", batch, d.TotalBatches))
+	}
+
+	if !h.setStatus(&d, models.DeploymentSucceeded, "") {
+		return
+	}
+	recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "success",
+		fmt.Sprintf("Deployment of version %s completed", d.Version))
+}
+
+// waitHealthy waits until every instance in the batch reports running and
+// then stays under the error rate threshold for the bake period. Instances
+// that are meant to be stopped are not waited for. It returns when the batch
+// first became healthy.
+func (h *DeploymentHandler) waitHealthy(ctx context.Context, d models.Deployment, batch int, started time.Time, bake time.Duration) (time.Time, error) {
+	healthTimeout := time.Duration(d.HealthTimeoutSeconds) * time.Second
+	var healthySince time.Time
+
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ready := true
+		for _, t := range d.Targets {
+			if t.Batch != batch {
+				continue
+			}
+
+			var status, desired models.ServiceStatus
+			var message string
+			if err := h.db.QueryRowContext(ctx,
+				"SELECT status, desired_status, status_message FROM services WHERE id = $1", t.ServiceID,
+			).Scan(&status, &desired, &message); err != nil {
+				if ctx.Err() != nil {
+					return healthySince, context.Cause(ctx)
+				}
+				return healthySince, fmt.Errorf("instance in %s disappeared: %v", t.Region, err)
+			}
+
+			if desired == models.StatusStopped {
+				continue
+			}
+			if status == models.StatusError {
+				return healthySince, fmt.Errorf("instance in %s entered error: %s", t.Region, message)
+			}
+			if status != models.StatusRunning {
+				ready = false
+				continue
+			}
+
+			samples, err := h.metrics.MetricsSince(ctx, t.ServiceID, started)
+			if err != nil {
+				log.Printf("Failed to read metrics for %s: %v", t.ServiceID, err)
+				continue
+			}
+			if rate, ok := averageErrorRate(samples); ok && rate > d.MaxErrorRate {
+				return healthySince, fmt.Errorf("error rate %.2f%% in %s exceeds %.2f%%", rate, t.Region, d.MaxErrorRate)
+			}
+		}
+
+		now := time.Now()
+		if ready {
+			if healthySince.IsZero() {
+				healthySince = now
+			}
+			if now.Sub(healthySince) >= bake {
+				return healthySince, nil
+			}
+		} else if now.Sub(started) >= healthTimeout {
+			return healthySince, fmt.Errorf("batch %d not healthy within %s", batch, healthTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return healthySince, context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// analyzeCanary waits for the canaries (batch 1) to become healthy, keeps
+// them under the error rate threshold for the analysis window, then compares
+// their metrics over that window with the instances still on the old version.
+// Anything but a pass, including too few samples, aborts the deployment.
+func (h *DeploymentHandler) analyzeCanary(ctx context.Context, d *models.Deployment) error {
+	since, err := h.waitHealthy(ctx, *d, 1, time.Now(), time.Duration(d.AnalysisSeconds)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	var canary, baseline []models.ServiceMetrics
+	for _, t := range d.Targets {
+		samples, err := h.metrics.MetricsSince(ctx, t.ServiceID, since)
+		if err != nil {
+			log.Printf("Failed to read metrics for %s: %v", t.ServiceID, err)
+			continue
+		}
+		if t.Canary {
+			canary = append(canary, samples...)
+		} else {
+			baseline = append(baseline, samples...)
+		}
+	}
+
+	analysis := judgeCanary(canary, baseline, d.MaxErrorRateDelta, d.MaxLatencyIncrease)
+	d.Analysis = &analysis
+	h.setStatus(d, models.DeploymentInProgress, "")
+
+	if analysis.Verdict != models.VerdictPass {
+		return fmt.Errorf("canary analysis %s: %s", analysis.Verdict, analysis.Reason)
+	}
+	recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "success",
+		fmt.Sprintf("Canary analysis passed: error rate %.2f%% vs %.2f%%, p95 latency %.1fms vs %.1fms; promoting",
+			analysis.CanaryErrorRate, analysis.BaselineErrorRate, analysis.CanaryP95Latency, analysis.BaselineP95Latency))
+	return nil
+}
+
+// rollback restores every instance the deployment has touched to the version
+// it had before. It runs on its own context so an aborted deployment can
+// still be cleaned up. A deployment another replica took over is left to it.
+func (h *DeploymentHandler) rollback(d models.Deployment, reason error) {
+	if reason == errDeploymentNotOwned {
+		log.Printf("Deployment %s was taken over by another replica", d.ID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	recordDeploymentLog(h.db, h.hub, d.ServiceID, "deploy", "failed",
+		fmt.Sprintf("Deployment of version %s halted: %v; rolling back", d.Version, reason))
+
+	failed := 0
+	for i := range d.Targets {
+		t := &d.Targets[i]
+		if t.Status != models.TargetUpdated && t.Status != models.TargetHealthy {
+			continue
+		}
+		err := h.setVersion(ctx, d.ID, t.ServiceID, t.FromVersion, "rollback of deployment "+d.ID, d.CreatedBy)
+		if err == errDeploymentNotOwned {
+			log.Printf("Deployment %s was taken over by another replica while rolling back", d.ID)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to roll back %s to %s: %v", t.ServiceID, t.FromVersion, err)
+			failed++
+			continue
+		}
+		h.setTargetStatus(t, models.TargetRolledBack)
+	}
+
+	if failed > 0 {
+		if !h.setStatus(&d, models.DeploymentFailed, fmt.Sprintf("%v; %d instance(s) could not be rolled back", reason, failed)) {
+			return
+		}
+		recordDeploymentLog(h.db, h.hub, d.ServiceID, "rollback", "failed", d.Message)
+		return
+	}
+
+	if !h.setStatus(&d, models.DeploymentRolledBack, reason.Error()) {
+		return
+	}
+	recordDeploymentLog(h.db, h.hub, d.ServiceID, "rollback", "success",
+		fmt.Sprintf("Rolled back from version %s", d.Version))
+}
+
+// setVersion sets the version of one of the deployment's instances, as long
+// as this replica still owns the deployment.
+func (h *DeploymentHandler) setVersion(ctx context.Context, deploymentID, serviceID, version, reason, actor string) error {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := h.db.BeginTx(qctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The share lock keeps another replica from taking over until commit
+	var owned string
+	err = tx.QueryRowContext(qctx, "SELECT id FROM deployments WHERE id = $1 AND owner = $2 FOR SHARE", deploymentID, h.owner).Scan(&owned)
+	if err == sql.ErrNoRows {
+		h.cancel(deploymentID, errDeploymentNotOwned)
+		return errDeploymentNotOwned
+	}
+	if err != nil {
+		return err
+	}
+
+	// The update locks the service row, ordering this against other revisions
+	service, err := scanService(tx.QueryRowContext(qctx,
+		"UPDATE services SET version = $1, updated_at = $2 WHERE id = $3 RETURNING "+serviceColumns,
+		version, time.Now(), serviceID,
+	))
+	if err != nil {
+		return err
+	}
+	if _, err := recordRevision(qctx, tx, serviceID, reason, actor); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, service)
+	h.assignments.ServiceChanged(qctx, serviceID)
+	return nil
+}
+
+// setStatus records the deployment's status and reports whether this replica
+// still owns it.
+func (h *DeploymentHandler) setStatus(d *models.Deployment, status models.DeploymentStatus, message string) bool {
+	d.Status = status
+	d.Message = message
+	d.UpdatedAt = time.Now()
+
+	result, err := h.db.Exec(
+		"UPDATE deployments SET status = $1, current_batch = $2, message = $3, analysis = $4, updated_at = $5 WHERE id = $6 AND owner = $7",
+		d.Status, d.CurrentBatch, d.Message, analysisJSON(d.Analysis), d.UpdatedAt, d.ID, h.owner,
+	)
+	if err != nil {
+		log.Printf("Failed to update deployment %s: %v", d.ID, err)
+	} else if rows, _ := result.RowsAffected(); rows == 0 {
+		h.cancel(d.ID, errDeploymentNotOwned)
+		return false
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeDeployment, d)
+	return true
+}
+
+func (h *DeploymentHandler) setTargetStatus(t *models.DeploymentTarget, status models.DeploymentTargetStatus) {
+	t.Status = status
+	if _, err := h.db.Exec(
+		"UPDATE deployment_targets SET status = $1 WHERE deployment_id = $2 AND service_id = $3",
+		t.Status, t.DeploymentID, t.ServiceID,
+	); err != nil {
+		log.Printf("Failed to update deployment target %s/%s: %v", t.DeploymentID, t.ServiceID, err)
+	}
+}
+
+// insertDeployment inserts d and its targets, owned by the replica owner.
+func insertDeployment(ctx context.Context, tx *sql.Tx, d models.Deployment, owner string) error {
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO deployments (id, service_id, service_name, version, strategy, batch_size, max_error_rate, health_timeout_seconds, bake_seconds, canary_percent, analysis_seconds, max_error_rate_delta, max_latency_increase, status, current_batch, total_batches, message, created_by, created_at, updated_at, owner, heartbeat_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, NOW())`,
+		d.ID, d.ServiceID, d.ServiceName, d.Version, d.Strategy, d.BatchSize, d.MaxErrorRate, d.HealthTimeoutSeconds, d.BakeSeconds, d.CanaryPercent, d.AnalysisSeconds, d.MaxErrorRateDelta, d.MaxLatencyIncrease, d.Status, d.CurrentBatch, d.TotalBatches, d.Message, d.CreatedBy, d.CreatedAt, d.UpdatedAt, owner,
+	); err != nil {
+		return err
+	}
+
+	for _, t := range d.Targets {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO deployment_targets (deployment_id, service_id, region, from_version, batch, canary, status)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			t.DeploymentID, t.ServiceID, t.Region, t.FromVersion, t.Batch, t.Canary, t.Status,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *DeploymentHandler) loadDeployment(ctx context.Context, id string) (models.Deployment, error) {
+	d, err := scanDeployment(h.db.QueryRowContext(ctx, "SELECT "+deploymentColumns+" FROM deployments WHERE id = $1", id))
+	if err != nil {
+		return d, err
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT deployment_id, service_id, region, from_version, batch, canary, status FROM deployment_targets WHERE deployment_id = $1 ORDER BY batch, region",
+		id,
+	)
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+
+	d.Targets = []models.DeploymentTarget{}
+	for rows.Next() {
+		var t models.DeploymentTarget
+		if err := rows.Scan(&t.DeploymentID, &t.ServiceID, &t.Region, &t.FromVersion, &t.Batch, &t.Canary, &t.Status); err != nil {
+			return d, err
+		}
+		d.Targets = append(d.Targets, t)
+	}
+	return d, rows.Err()
+}
+
+// lockDeployments locks the deployments of the services named serviceName
+// in a project until tx ends.
+func lockDeployments(ctx context.Context, tx *sql.Tx, projectID, serviceName string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", "deploy:"+projectID+":"+serviceName)
+	return err
+}
+
+func hasActiveDeployment(ctx context.Context, db queryer, projectID, serviceName string) (bool, error) {
+	var active bool
+	err := db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM deployments d JOIN services s ON s.id = d.service_id
+		 WHERE s.project_id = $1 AND d.service_name = $2 AND d.status IN ($3, $4))`,
+		projectID, serviceName, models.DeploymentPending, models.DeploymentInProgress,
+	).Scan(&active)
+	return active, err
+}
+
+// batchNumber returns the 1-based batch of the target at index i.
+func batchNumber(i, batchSize int) int {
+	return i/batchSize + 1
+}
+
+// averageErrorRate averages the error rate over samples. ok is false when
+// there are no samples to judge by.
+func averageErrorRate(samples []models.ServiceMetrics) (rate float64, ok bool) {
+	if len(samples) == 0 {
+		return 0, false
+	}
+	var sum float64
+	for _, m := range samples {
+		sum += m.ErrorRate
+	}
+	return sum / float64(len(samples)), true
+}
+
+// canaryCount returns how many of n instances make up a percent canary:
+// rounded up, but never all of them so a baseline remains.
+func canaryCount(n, percent int) int {
+	count := (n*percent + 99) / 100
+	if count < 1 {
+		count = 1
+	}
+	if count > n-1 {
+		count = n - 1
+	}
+	return count
+}
+
+// judgeCanary compares canary samples against baseline samples. The canary
+// fails if its error rate exceeds the baseline's by more than maxErrorDelta
+// percentage points, or its p95 latency exceeds the baseline's by more than
+// maxLatencyIncrease percent.
+func judgeCanary(canary, baseline []models.ServiceMetrics, maxErrorDelta, maxLatencyIncrease float64) models.CanaryAnalysis {
+	a := models.CanaryAnalysis{
+		CanarySamples:   len(canary),
+		BaselineSamples: len(baseline),
+	}
+	if len(canary) < minCanarySamples || len(baseline) < minCanarySamples {
+		a.Verdict = models.VerdictInconclusive
+		a.Reason = fmt.Sprintf("need %d samples per side, got %d canary and %d baseline", minCanarySamples, len(canary), len(baseline))
+		return a
+	}
+
+	a.CanaryErrorRate, _ = averageErrorRate(canary)
+	a.BaselineErrorRate, _ = averageErrorRate(baseline)
+	a.CanaryP95Latency = averageP95Latency(canary)
+	a.BaselineP95Latency = averageP95Latency(baseline)
+
+	if a.CanaryErrorRate-a.BaselineErrorRate > maxErrorDelta {
+		a.Verdict = models.VerdictFail
+		a.Reason = fmt.Sprintf("error rate %.2f%% exceeds baseline %.2f%% by more than %.2f points", a.CanaryErrorRate, a.BaselineErrorRate, maxErrorDelta)
+		return a
+	}
+	if limit := a.BaselineP95Latency * (1 + maxLatencyIncrease/100); a.CanaryP95Latency > limit {
+		a.Verdict = models.VerdictFail
+		a.Reason = fmt.Sprintf("p95 latency %.1fms exceeds baseline %.1fms by more than %.0f%%", a.CanaryP95Latency, a.BaselineP95Latency, maxLatencyIncrease)
+		return a
+	}
+
+	a.Verdict = models.VerdictPass
+	return a
+}
+
+func averageP95Latency(samples []models.ServiceMetrics) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, m := range samples {
+		sum += m.P95Latency
+	}
+	return sum / float64(len(samples))
+}
+
+// analysisJSON encodes an analysis for the JSONB column, NULL when absent.
+func analysisJSON(a *models.CanaryAnalysis) interface{} {
+	if a == nil {
+		return nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestBatchNumber(t *testing.T) {
+	tests := []struct {
+		name      string
+		index     int
+		batchSize int
+		want      int
+	}{
+		{"first target", 0, 2, 1},
+		{"fills first batch", 1, 2, 1},
+		{"starts second batch", 2, 2, 2},
+		{"one per batch", 4, 1, 5},
+		{"everything in one batch", 6, 10, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := batchNumber(tt.index, tt.batchSize); got != tt.want {
+				t.Errorf("batchNumber(%d, %d) = %d, want %d", tt.index, tt.batchSize, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAverageErrorRate(t *testing.T) {
+	if _, ok := averageErrorRate(nil); ok {
+		t.Error("averageErrorRate(nil) should report no data")
+	}
+
+	samples := []models.ServiceMetrics{{ErrorRate: 1}, {ErrorRate: 2}, {ErrorRate: 6}}
+	rate, ok := averageErrorRate(samples)
+	if !ok || rate != 3 {
+		t.Errorf("averageErrorRate() = %v, %v, want 3, true", rate, ok)
+	}
+}
+
+func TestCanaryCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		percent int
+		want    int
+	}{
+		{"rounds up to one", 5, 10, 1},
+		{"exact", 10, 20, 2},
+		{"rounds up", 10, 25, 3},
+		{"keeps a baseline", 2, 99, 1},
+		{"half", 4, 50, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canaryCount(tt.n, tt.percent); got != tt.want {
+				t.Errorf("canaryCount(%d, %d) = %d, want %d", tt.n, tt.percent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJudgeCanary(t *testing.T) {
+	samples := func(errorRate, p95 float64) []models.ServiceMetrics {
+		s := make([]models.ServiceMetrics, minCanarySamples)
+		for i := range s {
+			s[i] = models.ServiceMetrics{ErrorRate: errorRate, P95Latency: p95}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		canary   []models.ServiceMetrics
+		baseline []models.ServiceMetrics
+		want     models.CanaryVerdict
+	}{
+		{"matches baseline", samples(2, 100), samples(2, 100), models.VerdictPass},
+		{"within error delta", samples(2.9, 100), samples(2, 100), models.VerdictPass},
+		{"error rate regression", samples(3.5, 100), samples(2, 100), models.VerdictFail},
+		{"within latency increase", samples(2, 119), samples(2, 100), models.VerdictPass},
+		{"latency regression", samples(2, 130), samples(2, 100), models.VerdictFail},
+		{"better than baseline", samples(0.5, 80), samples(2, 100), models.VerdictPass},
+		{"no canary samples", nil, samples(2, 100), models.VerdictInconclusive},
+		{"too few baseline samples", samples(2, 100), samples(2, 100)[:1], models.VerdictInconclusive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := judgeCanary(tt.canary, tt.baseline, 1.0, 20)
+			if got.Verdict != tt.want {
+				t.Errorf("judgeCanary() verdict = %s (%s), want %s", got.Verdict, got.Reason, tt.want)
+			}
+		})
+	}
+}
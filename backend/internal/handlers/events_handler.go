@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	ws "github.com/stratus/backend/internal/websocket"
+)
+
+// EventsHandler streams hub messages as Server-Sent Events, for clients
+// behind proxies that break WebSocket upgrades or that just want curl.
+type EventsHandler struct {
+	hub *ws.Hub
+}
+
+func NewEventsHandler(hub *ws.Hub) *EventsHandler {
+	return &EventsHandler{hub: hub}
+}
+
+// StreamEvents streams the messages /ws would send, one event each with the
+// message envelope as data and its seq as id. Topics are fixed by ?topics=.
+// Reconnecting clients resume after Last-Event-ID, or ?since= when they
+// cannot set headers.
+func (h *EventsHandler) StreamEvents(c *gin.Context) {
+	topics, ok := streamTopics(c)
+	if !ok {
+		return
+	}
+	param := c.GetHeader("Last-Event-ID")
+	if param == "" {
+		param = c.Query("since")
+	}
+	since, ok := streamSince(c, param)
+	if !ok {
+		return
+	}
+
+	// The server's write timeout would otherwise cut the stream off
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline for event stream: %v", err)
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	client := ws.NewClient(h.hub, nil, topics)
+	if since >= 0 {
+		client.ResumeAfter(since)
+	}
+	if projects, all := visibleProjects(c); !all {
+		client.RestrictToProjects(projects)
+	}
+	h.hub.Register(client)
+	defer h.hub.Unregister(client)
+
+	client.Stream(c.Request.Context(), func(message ws.Message) error {
+		if err := writeEvent(c.Writer, message); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}, func() error {
+		if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+}
+
+// writeEvent writes message as one event. Messages without a seq, such as
+// resync_required, get no id so they do not move the resume point.
+func writeEvent(w io.Writer, message ws.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return nil
+	}
+
+	if message.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", message.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
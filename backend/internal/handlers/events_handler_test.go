@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+
+	ws "github.com/stratus/backend/internal/websocket"
+)
+
+func TestWriteEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		message ws.Message
+		want    string
+	}{
+		{
+			name:    "numbered",
+			message: ws.Message{Seq: 42, Type: ws.MessageTypeLog, Payload: map[string]string{"message": "a\nb"}},
+			want:    "id: 42\ndata: {\"seq\":42,\"type\":\"log\",\"payload\":{\"message\":\"a\\nb\"}}\n\n",
+		},
+		{
+			name:    "resync",
+			message: ws.Message{Type: ws.MessageTypeResyncRequired, Payload: map[string]int{"since": 3}},
+			want:    "data: {\"type\":\"resync_required\",\"payload\":{\"since\":3}}\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeEvent(&buf, tt.message); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("writeEvent() = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
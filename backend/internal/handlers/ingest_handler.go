@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+)
+
+const (
+	maxIngestBatch     = 100 // bounds the work of a single request
+	maxSampleClockSkew = 5 * time.Minute
+	// Older samples could fall out of the raw series before their minutes
+	// are rolled up
+	maxSampleAge = rawRetention - maxSampleClockSkew
+)
+
+// IssueIngestToken issues a new ingestion token for a service, replacing any
+// previous one.
+func (h *MetricsHandler) IssueIngestToken(c *gin.Context) {
+	id := c.Param("id")
+
+	token, err := newNodeToken()
+	if err != nil {
+		errors.InternalError(c, "Failed to generate ingestion token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	result, err := h.db.ExecContext(ctx,
+		"UPDATE services SET ingest_token_hash = $1, updated_at = $2 WHERE id = $3",
+		hashNodeToken(token), time.Now(), id,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to store ingestion token")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		errors.NotFound(c, "Service")
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.IngestTokenResponse{ServiceID: id, Token: token})
+}
+
+// IngestAuth authenticates a push for the service in the path. It accepts the
+// service's own ingestion token, or the node token of the node the service is
+// scheduled on so agents can report for what they run.
+func (h *MetricsHandler) IngestAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.Split(c.GetHeader("Authorization"), " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			errors.Unauthorized(c, "Missing or malformed ingestion token")
+			c.Abort()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+
+		var serviceHash, nodeHash string
+		err := h.db.QueryRowContext(ctx,
+			`SELECT COALESCE(s.ingest_token_hash, ''), COALESCE(n.token_hash, '')
+			 FROM services s LEFT JOIN nodes n ON n.id = s.node_id
+			 WHERE s.id = $1`,
+			c.Param("id"),
+		).Scan(&serviceHash, &nodeHash)
+		if err == sql.ErrNoRows {
+			errors.Unauthorized(c, "Unknown service")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to authenticate ingestion")
+			c.Abort()
+			return
+		}
+
+		hash := []byte(hashNodeToken(parts[1]))
+		if (serviceHash == "" || subtle.ConstantTimeCompare([]byte(serviceHash), hash) != 1) &&
+			(nodeHash == "" || subtle.ConstantTimeCompare([]byte(nodeHash), hash) != 1) {
+			errors.Unauthorized(c, "Invalid ingestion token")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// IngestMetrics accepts a single sample.
+func (h *MetricsHandler) IngestMetrics(c *gin.Context) {
+	var sample models.ServiceMetrics
+	if err := c.ShouldBindJSON(&sample); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	h.ingest(c, []models.ServiceMetrics{sample})
+}
+
+// IngestMetricsBatch accepts up to maxIngestBatch samples at once.
+func (h *MetricsHandler) IngestMetricsBatch(c *gin.Context) {
+	var batch models.MetricsBatch
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if len(batch.Samples) == 0 || len(batch.Samples) > maxIngestBatch {
+		errors.BadRequest(c, fmt.Sprintf("A batch must contain between 1 and %d samples", maxIngestBatch), nil)
+		return
+	}
+	h.ingest(c, batch.Samples)
+}
+
+func (h *MetricsHandler) ingest(c *gin.Context, samples []models.ServiceMetrics) {
+	serviceID := c.Param("id")
+	now := time.Now()
+
+	var validationErrs validation.ValidationErrors
+	for i := range samples {
+		field := "sample"
+		if len(samples) > 1 {
+			field = fmt.Sprintf("samples[%d]", i)
+		}
+		validationErrs = append(validationErrs, prepareSample(&samples[i], serviceID, field, now)...)
+	}
+	if len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := h.store(ctx, serviceID, samples...); err != nil {
+		errors.InternalError(c, "Failed to store metrics")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"accepted": len(samples)})
+}
+
+// prepareSample validates an ingested sample and fills in the service ID and,
+// when missing, the timestamp.
+func prepareSample(m *models.ServiceMetrics, serviceID, field string, now time.Time) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+	invalid := func(name, message string) {
+		errs = append(errs, validation.ValidationError{Field: field + "." + name, Message: message})
+	}
+
+	if m.ServiceID != "" && m.ServiceID != serviceID {
+		invalid("service_id", "service_id does not match the service being reported for")
+	}
+	m.ServiceID = serviceID
+
+	if m.Timestamp.IsZero() {
+		m.Timestamp = now
+	}
+	if m.Timestamp.After(now.Add(maxSampleClockSkew)) {
+		invalid("timestamp", "timestamp is in the future")
+	}
+	if m.Timestamp.Before(now.Add(-maxSampleAge)) {
+		invalid("timestamp", fmt.Sprintf("timestamp is more than %s old", maxSampleAge))
+	}
+
+	if m.CPUUsage < 0 || m.CPUUsage > 100 {
+		invalid("cpu_usage", "cpu_usage must be between 0 and 100")
+	}
+	if m.MemoryUsage < 0 {
+		invalid("memory_usage", "memory_usage must not be negative")
+	}
+	if m.RequestCount < 0 {
+		invalid("request_count", "request_count must not be negative")
+	}
+	if m.ErrorRate < 0 || m.ErrorRate > 100 {
+		invalid("error_rate", "error_rate must be between 0 and 100")
+	}
+	if m.P95Latency < 0 {
+		invalid("p95_latency", "p95_latency must not be negative")
+	}
+
+	return errs
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestPrepareSample(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		sample models.ServiceMetrics
+		fields []string
+	}{
+		{"valid", models.ServiceMetrics{Timestamp: now.Add(-time.Minute), CPUUsage: 40, ErrorRate: 1.5, P95Latency: 120}, nil},
+		{"matching service id", models.ServiceMetrics{ServiceID: "svc-1"}, nil},
+		{"other service", models.ServiceMetrics{ServiceID: "svc-2"}, []string{"sample.service_id"}},
+		{"future", models.ServiceMetrics{Timestamp: now.Add(time.Hour)}, []string{"sample.timestamp"}},
+		{"buffered through an outage", models.ServiceMetrics{Timestamp: now.Add(-5 * time.Hour)}, nil},
+		{"too old", models.ServiceMetrics{Timestamp: now.Add(-25 * time.Hour)}, []string{"sample.timestamp"}},
+		{"out of range", models.ServiceMetrics{CPUUsage: 120, ErrorRate: -1, RequestCount: -5}, []string{"sample.cpu_usage", "sample.request_count", "sample.error_rate"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := tt.sample
+			errs := prepareSample(&sample, "svc-1", "sample", now)
+			if len(errs) != len(tt.fields) {
+				t.Fatalf("prepareSample() = %v, want errors for %v", errs, tt.fields)
+			}
+			for i, err := range errs {
+				if err.Field != tt.fields[i] {
+					t.Errorf("error %d field = %s, want %s", i, err.Field, tt.fields[i])
+				}
+			}
+			if sample.ServiceID != "svc-1" {
+				t.Errorf("ServiceID = %q, want svc-1", sample.ServiceID)
+			}
+		})
+	}
+
+	sample := models.ServiceMetrics{}
+	prepareSample(&sample, "svc-1", "sample", now)
+	if !sample.Timestamp.Equal(now) {
+		t.Errorf("missing timestamp set to %v, want %v", sample.Timestamp, now)
+	}
+}
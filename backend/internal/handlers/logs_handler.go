@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -36,11 +37,15 @@ func (h *LogsHandler) GetDeploymentLogs(c *gin.Context) {
 		SELECT dl.id, dl.service_id, s.name as service_name, dl.action, dl.status, dl.message, dl.created_at
 		FROM deployment_logs dl
 		LEFT JOIN services s ON dl.service_id = s.id
-		ORDER BY dl.created_at DESC
-		LIMIT $1 OFFSET $2
-	`
+		WHERE 1=1`
+	args := []interface{}{}
+	// Only logs of services in the caller's projects
+	filter, args := projectFilter(c, "s.project_id", args)
+	query += filter
+	query += fmt.Sprintf(" ORDER BY dl.created_at DESC LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
 
-	rows, err := h.db.Query(query, limit, offset)
+	rows, err := h.db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -2,55 +2,80 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
+	"github.com/stratus/backend/internal/errors"
 	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/telemetry"
+	"github.com/stratus/backend/internal/validation"
 	"github.com/stratus/backend/internal/websocket"
 )
 
+const (
+	defaultAggregationWindow = 15 * time.Minute
+	maxAggregationWindow     = rawRetention // aggregates are computed from raw samples
+)
+
 type MetricsHandler struct {
+	db         *sql.DB
 	redis      *redis.Client
 	hub        *websocket.Hub
 	simulators map[string]context.CancelFunc
 	mu         sync.RWMutex
 }
 
-func NewMetricsHandler(redisClient *redis.Client, hub *websocket.Hub) *MetricsHandler {
+func NewMetricsHandler(db *sql.DB, redisClient *redis.Client, hub *websocket.Hub) *MetricsHandler {
 	return &MetricsHandler{
+		db:         db,
 		redis:      redisClient,
 		hub:        hub,
 		simulators: make(map[string]context.CancelFunc),
 	}
 }
 
+// GetMetrics returns the latest 100 raw samples of a service, newest first.
+// With ?from=, ?to= or ?step= it returns a series instead; see GetMetricsSeries.
 func (h *MetricsHandler) GetMetrics(c *gin.Context) {
 	serviceID := c.Param("id")
+	if c.Query("from") != "" || c.Query("to") != "" || c.Query("step") != "" {
+		h.GetMetricsSeries(c)
+		return
+	}
 	ctx := context.Background()
 
 	// Get latest metrics from Redis
-	key := "metrics:" + serviceID
-	data, err := h.redis.LRange(ctx, key, 0, 99).Result()
+	data, err := h.redis.ZRevRange(ctx, rawKey(serviceID), 0, 99).Result()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	metrics := []models.ServiceMetrics{}
-	for _, item := range data {
-		var m models.ServiceMetrics
-		if err := json.Unmarshal([]byte(item), &m); err != nil {
-			continue
-		}
-		metrics = append(metrics, m)
-	}
+	c.JSON(http.StatusOK, gin.H{"metrics": decodeSamples(data)})
+}
 
-	c.JSON(http.StatusOK, gin.H{"metrics": metrics})
+// MetricsSince returns the raw samples for a service taken at or after since,
+// newest first.
+func (h *MetricsHandler) MetricsSince(ctx context.Context, serviceID string, since time.Time) ([]models.ServiceMetrics, error) {
+	data, err := h.redis.ZRevRangeByScore(ctx, rawKey(serviceID), &redis.ZRangeBy{
+		Min: strconv.FormatInt(since.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeSamples(data), nil
 }
 
 // StartSimulator starts metrics simulation for a service
@@ -80,8 +105,27 @@ func (h *MetricsHandler) StopSimulator(serviceID string) {
 	}
 }
 
+// SimulatorDriver is a reconciler.Driver that "runs" a service by generating
+// simulated metrics for it.
+type SimulatorDriver struct {
+	metrics *MetricsHandler
+}
+
+func NewSimulatorDriver(metrics *MetricsHandler) *SimulatorDriver {
+	return &SimulatorDriver{metrics: metrics}
+}
+
+func (d *SimulatorDriver) Start(ctx context.Context, service models.Service) error {
+	d.metrics.StartSimulator(service.ID)
+	return nil
+}
+
+func (d *SimulatorDriver) Stop(ctx context.Context, service models.Service) error {
+	d.metrics.StopSimulator(service.ID)
+	return nil
+}
+
 func (h *MetricsHandler) simulateMetrics(ctx context.Context, serviceID string) {
-	key := "metrics:" + serviceID
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -100,35 +144,316 @@ func (h *MetricsHandler) simulateMetrics(ctx context.Context, serviceID string)
 				P95Latency:   rand.Float64()*200 + 50,      // 50-250ms
 			}
 
-			data, _ := json.Marshal(metrics)
-			h.redis.LPush(ctx, key, data)
-			h.redis.LTrim(ctx, key, 0, 99) // Keep last 100 metrics
-			h.redis.Expire(ctx, key, 24*time.Hour)
-
-			// Broadcast metrics
-			h.hub.BroadcastJSON(websocket.MessageTypeMetrics, metrics)
+			h.store(ctx, serviceID, metrics)
 		}
 	}
 }
 
+// store adds samples to the service's raw series, drops samples older than
+// the raw retention, marks the minutes they fall in for rollup and broadcasts
+// them oldest first. Simulated and ingested samples share the series.
+func (h *MetricsHandler) store(ctx context.Context, serviceID string, samples ...models.ServiceMetrics) error {
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+
+	key := rawKey(serviceID)
+	pipe := h.redis.Pipeline()
+	dirty := map[string]bool{}
+	for _, m := range samples {
+		data, _ := json.Marshal(m)
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(m.Timestamp.UnixMilli()), Member: string(data)})
+		dirty[fmt.Sprintf("%s %d", serviceID, m.Timestamp.Truncate(time.Minute).Unix())] = true
+	}
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("(%d", time.Now().Add(-rawRetention).UnixMilli()))
+	pipe.Expire(ctx, key, rawRetention)
+	for member := range dirty {
+		pipe.SAdd(ctx, dirtyMinutesKey, member)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// Broadcast metrics
+	for _, m := range samples {
+		h.hub.BroadcastJSON(websocket.MessageTypeMetrics, m)
+	}
+	return nil
+}
+
+// GetAggregatedMetrics summarises every service, or those in ?region=, over
+// a time window: ?window=15m (the default) ending now, or explicit RFC 3339
+// ?from= and ?to=.
 func (h *MetricsHandler) GetAggregatedMetrics(c *gin.Context) {
-	// This would aggregate metrics across all services
-	// For now, return mock aggregated data
-	
-	aggregated := gin.H{
-		"total_services": 12,
-		"running_services": 10,
-		"avg_cpu_usage": 45.3,
-		"avg_memory_usage": 320.5,
-		"total_requests": 125000,
-		"avg_error_rate": 0.8,
-		"regions": gin.H{
-			"US-East": 4,
-			"US-West": 3,
-			"EU-West": 3,
-			"APAC": 2,
-		},
+	region := c.Query("region")
+	if region != "" {
+		if err := validation.ValidateRegion(region); err != nil {
+			errors.BadRequest(c, "Validation failed", err)
+			return
+		}
 	}
 
+	from, to, err := parseWindow(c.Query("window"), c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		errors.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	query := "SELECT id, region, status FROM services WHERE 1=1"
+	args := []interface{}{}
+	if region != "" {
+		args = append(args, region)
+		query += fmt.Sprintf(" AND region = $%d", len(args))
+	}
+	// Aggregate over the services of the caller's projects only
+	filter, args := projectFilter(c, "project_id", args)
+	query += filter
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query services")
+		return
+	}
+	services := []models.Service{}
+	for rows.Next() {
+		var s models.Service
+		if err := rows.Scan(&s.ID, &s.Region, &s.Status); err != nil {
+			rows.Close()
+			errors.InternalError(c, "Failed to scan service")
+			return
+		}
+		services = append(services, s)
+	}
+	rows.Close()
+
+	samples, err := h.samplesBetween(ctx, services, from, to)
+	if err != nil {
+		errors.InternalError(c, "Failed to read metrics")
+		return
+	}
+
+	aggregated := aggregateMetrics(services, samples)
+	aggregated.From = from
+	aggregated.To = to
+	aggregated.Region = region
+
 	c.JSON(http.StatusOK, aggregated)
 }
+
+// samplesBetween reads the raw samples of each service taken within
+// [from, to], in one Redis round trip.
+func (h *MetricsHandler) samplesBetween(ctx context.Context, services []models.Service, from, to time.Time) (map[string][]models.ServiceMetrics, error) {
+	pipe := h.redis.Pipeline()
+	cmds := make(map[string]*redis.StringSliceCmd, len(services))
+	for _, s := range services {
+		cmds[s.ID] = pipe.ZRangeByScore(ctx, rawKey(s.ID), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from.UnixMilli(), 10),
+			Max: strconv.FormatInt(to.UnixMilli(), 10),
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	samples := make(map[string][]models.ServiceMetrics, len(services))
+	for id, cmd := range cmds {
+		if metrics := decodeSamples(cmd.Val()); len(metrics) > 0 {
+			samples[id] = metrics
+		}
+	}
+	return samples, nil
+}
+
+// parseWindow resolves the aggregation window. from/to take precedence over
+// window; to defaults to now.
+func parseWindow(window, fromParam, toParam string, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toParam != "" {
+		t, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be an RFC 3339 timestamp")
+		}
+		to = t
+	}
+
+	var from time.Time
+	if fromParam != "" {
+		t, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be an RFC 3339 timestamp")
+		}
+		from = t
+	} else {
+		d := defaultAggregationWindow
+		if window != "" {
+			parsed, err := time.ParseDuration(window)
+			if err != nil || parsed <= 0 {
+				return time.Time{}, time.Time{}, fmt.Errorf("window must be a positive duration such as 15m")
+			}
+			d = parsed
+		}
+		from = to.Add(-d)
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > maxAggregationWindow {
+		return time.Time{}, time.Time{}, fmt.Errorf("window must be at most %s", maxAggregationWindow)
+	}
+	return from, to, nil
+}
+
+// aggregateMetrics builds the overall and per-region summaries.
+func aggregateMetrics(services []models.Service, samples map[string][]models.ServiceMetrics) models.AggregatedMetrics {
+	overall := newSummaryBuilder()
+	regions := map[string]*summaryBuilder{}
+
+	for _, s := range services {
+		overall.add(s, samples[s.ID])
+		b, ok := regions[s.Region]
+		if !ok {
+			b = newSummaryBuilder()
+			regions[s.Region] = b
+		}
+		b.add(s, samples[s.ID])
+	}
+
+	aggregated := models.AggregatedMetrics{
+		MetricsSummary: overall.build(),
+		Regions:        make(map[string]models.MetricsSummary, len(regions)),
+	}
+	for region, b := range regions {
+		aggregated.Regions[region] = b.build()
+	}
+	return aggregated
+}
+
+type summaryBuilder struct {
+	summary                         models.MetricsSummary
+	cpu, memory, errorRate, latency []float64
+}
+
+func newSummaryBuilder() *summaryBuilder {
+	return &summaryBuilder{summary: models.MetricsSummary{ByStatus: map[models.ServiceStatus]int{}}}
+}
+
+func (b *summaryBuilder) add(s models.Service, samples []models.ServiceMetrics) {
+	b.summary.TotalServices++
+	b.summary.ByStatus[s.Status]++
+	if s.Status == models.StatusRunning {
+		b.summary.RunningServices++
+	}
+
+	for _, m := range samples {
+		b.summary.Samples++
+		b.summary.TotalRequests += m.RequestCount
+		b.cpu = append(b.cpu, m.CPUUsage)
+		b.memory = append(b.memory, m.MemoryUsage)
+		b.errorRate = append(b.errorRate, m.ErrorRate)
+		b.latency = append(b.latency, m.P95Latency)
+	}
+}
+
+func (b *summaryBuilder) build() models.MetricsSummary {
+	s := b.summary
+	s.CPUUsage = metricStats(b.cpu)
+	s.MemoryUsage = metricStats(b.memory)
+	s.ErrorRate = metricStats(b.errorRate)
+	s.P95Latency = metricStats(b.latency)
+	return s
+}
+
+func metricStats(values []float64) models.MetricStats {
+	if len(values) == 0 {
+		return models.MetricStats{}
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return models.MetricStats{
+		Avg: sum / float64(len(sorted)),
+		P50: percentile(sorted, 50),
+		P95: percentile(sorted, 95),
+		P99: percentile(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ActiveSimulators returns the number of running metric simulators.
+func (h *MetricsHandler) ActiveSimulators() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.simulators)
+}
+
+// ServiceCollector re-exports the latest sample of every service as gauges
+// labelled with its ID, name and region.
+func (h *MetricsHandler) ServiceCollector() telemetry.Collector {
+	return telemetry.CollectorFunc(func() []telemetry.Family {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		rows, err := h.db.QueryContext(ctx, "SELECT id, name, region FROM services ORDER BY id")
+		if err != nil {
+			log.Printf("Failed to query services for export: %v", err)
+			return nil
+		}
+		services := []models.Service{}
+		for rows.Next() {
+			var s models.Service
+			if rows.Scan(&s.ID, &s.Name, &s.Region) == nil {
+				services = append(services, s)
+			}
+		}
+		rows.Close()
+
+		pipe := h.redis.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(services))
+		for i, s := range services {
+			cmds[i] = pipe.ZRevRange(ctx, rawKey(s.ID), 0, 0)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			log.Printf("Failed to read latest samples for export: %v", err)
+			return nil
+		}
+
+		families := []telemetry.Family{
+			{Name: "stratus_service_cpu_usage_percent", Help: "Latest CPU usage sample per service.", Type: telemetry.TypeGauge},
+			{Name: "stratus_service_memory_usage_mb", Help: "Latest memory usage sample per service.", Type: telemetry.TypeGauge},
+			{Name: "stratus_service_requests", Help: "Requests in the latest sample interval per service.", Type: telemetry.TypeGauge},
+			{Name: "stratus_service_error_rate_percent", Help: "Latest error rate sample per service.", Type: telemetry.TypeGauge},
+			{Name: "stratus_service_p95_latency_ms", Help: "Latest p95 latency sample per service.", Type: telemetry.TypeGauge},
+		}
+		for i, s := range services {
+			latest := decodeSamples(cmds[i].Val())
+			if len(latest) == 0 {
+				continue
+			}
+			m := latest[0]
+			labels := []telemetry.Label{{Name: "service_id", Value: s.ID}, {Name: "name", Value: s.Name}, {Name: "region", Value: s.Region}}
+			for j, v := range []float64{m.CPUUsage, m.MemoryUsage, float64(m.RequestCount), m.ErrorRate, m.P95Latency} {
+				families[j].Samples = append(families[j].Samples, telemetry.Sample{Labels: labels, Value: v})
+			}
+		}
+		return families
+	})
+}
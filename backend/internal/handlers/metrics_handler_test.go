@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{50, 5},
+		{95, 10},
+		{99, 10},
+		{100, 10},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile(nil) = %v, want 0", got)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		window   string
+		from, to string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{"default", "", "", "", now.Add(-15 * time.Minute), now, false},
+		{"window", "1h", "", "", now.Add(-time.Hour), now, false},
+		{"explicit", "", "2024-01-01T10:00:00Z", "2024-01-01T11:00:00Z", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"bad window", "soon", "", "", time.Time{}, time.Time{}, true},
+		{"negative window", "-5m", "", "", time.Time{}, time.Time{}, true},
+		{"too long", "48h", "", "", time.Time{}, time.Time{}, true},
+		{"reversed", "", "2024-01-01T11:00:00Z", "2024-01-01T10:00:00Z", time.Time{}, time.Time{}, true},
+		{"bad timestamp", "", "yesterday", "", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parseWindow(tt.window, tt.from, tt.to, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo)) {
+				t.Errorf("parseWindow() = %v, %v, want %v, %v", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	services := []models.Service{
+		{ID: "a", Region: "us-east-1", Status: models.StatusRunning},
+		{ID: "b", Region: "us-east-1", Status: models.StatusStopped},
+		{ID: "c", Region: "eu-west-1", Status: models.StatusRunning},
+	}
+	samples := map[string][]models.ServiceMetrics{
+		"a": {{CPUUsage: 10, RequestCount: 100, ErrorRate: 1, P95Latency: 100}, {CPUUsage: 30, RequestCount: 50, ErrorRate: 3, P95Latency: 200}},
+		"c": {{CPUUsage: 50, RequestCount: 10, ErrorRate: 2, P95Latency: 300}},
+	}
+
+	agg := aggregateMetrics(services, samples)
+
+	if agg.TotalServices != 3 || agg.RunningServices != 2 {
+		t.Errorf("totals = %d services, %d running, want 3, 2", agg.TotalServices, agg.RunningServices)
+	}
+	if agg.ByStatus[models.StatusStopped] != 1 {
+		t.Errorf("by_status[stopped] = %d, want 1", agg.ByStatus[models.StatusStopped])
+	}
+	if agg.Samples != 3 || agg.TotalRequests != 160 {
+		t.Errorf("samples = %d, requests = %d, want 3, 160", agg.Samples, agg.TotalRequests)
+	}
+	if agg.CPUUsage.Avg != 30 || agg.CPUUsage.Max != 50 || agg.P95Latency.P50 != 200 {
+		t.Errorf("stats = %+v / %+v", agg.CPUUsage, agg.P95Latency)
+	}
+
+	east := agg.Regions["us-east-1"]
+	if east.TotalServices != 2 || east.RunningServices != 1 || east.Samples != 2 || east.ErrorRate.Avg != 2 {
+		t.Errorf("us-east-1 = %+v", east)
+	}
+	if eu := agg.Regions["eu-west-1"]; eu.TotalServices != 1 || eu.P95Latency.Max != 300 {
+		t.Errorf("eu-west-1 = %+v", eu)
+	}
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+)
+
+// Metrics are kept in three tiers: raw samples in a Redis sorted set per
+// service, and 1-minute and 1-hour rollups in Postgres.
+const (
+	rawRetention    = 6 * time.Hour
+	minuteRetention = 7 * 24 * time.Hour
+	hourRetention   = 90 * 24 * time.Hour
+
+	rollupInterval      = time.Minute
+	defaultSeriesRange  = time.Hour
+	defaultSeriesPoints = 300
+	maxSeriesPoints     = 11000
+
+	// dirtyMinutesKey holds "<service id> <minute unix>" members for the
+	// minutes that received samples since the last rollup.
+	dirtyMinutesKey = "metrics:dirty"
+)
+
+func rawKey(serviceID string) string {
+	return "metrics:raw:" + serviceID
+}
+
+func decodeSamples(items []string) []models.ServiceMetrics {
+	metrics := []models.ServiceMetrics{}
+	for _, item := range items {
+		var m models.ServiceMetrics
+		if err := json.Unmarshal([]byte(item), &m); err != nil {
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// GetMetricsSeries returns a service's metrics between ?from= and ?to=
+// (RFC 3339, default the last hour) as one point per ?step=. The finest tier
+// that still covers from is used, and step is rounded up to its resolution.
+func (h *MetricsHandler) GetMetricsSeries(c *gin.Context) {
+	serviceID := c.Param("id")
+	now := time.Now()
+
+	from, to, step, err := parseSeriesRange(c.Query("from"), c.Query("to"), c.Query("step"), now)
+	if err != nil {
+		errors.BadRequest(c, err.Error(), nil)
+		return
+	}
+	resolution, step := chooseResolution(from, step, now)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var points []models.MetricsRollup
+	if resolution == models.ResolutionRaw {
+		data, err := h.redis.ZRangeByScore(ctx, rawKey(serviceID), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from.UnixMilli(), 10),
+			Max: "(" + strconv.FormatInt(to.UnixMilli(), 10),
+		}).Result()
+		if err != nil {
+			errors.InternalError(c, "Failed to read metrics")
+			return
+		}
+		points = bucketSamples(decodeSamples(data), step)
+	} else {
+		rollups, err := h.rollupsBetween(ctx, serviceID, resolution, from, to)
+		if err != nil {
+			errors.InternalError(c, "Failed to read metrics rollups")
+			return
+		}
+		points = bucketRollups(rollups, step)
+	}
+
+	c.JSON(http.StatusOK, models.MetricsSeries{
+		ServiceID:  serviceID,
+		From:       from,
+		To:         to,
+		Step:       step.String(),
+		Resolution: resolution,
+		Points:     points,
+	})
+}
+
+func (h *MetricsHandler) rollupsBetween(ctx context.Context, serviceID string, resolution models.MetricsResolution, from, to time.Time) ([]models.MetricsRollup, error) {
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT bucket, data FROM metric_rollups
+		 WHERE service_id = $1 AND resolution = $2 AND bucket >= $3 AND bucket < $4
+		 ORDER BY bucket`,
+		serviceID, resolution, from.UTC(), to.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollups := []models.MetricsRollup{}
+	for rows.Next() {
+		var bucket time.Time
+		var data []byte
+		if err := rows.Scan(&bucket, &data); err != nil {
+			return nil, err
+		}
+		var r models.MetricsRollup
+		if err := json.Unmarshal(data, &r); err != nil {
+			continue
+		}
+		r.Timestamp = bucket
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// RunRollups periodically folds newly stored raw samples into 1-minute and
+// 1-hour rollups and drops rollups past their retention.
+func (h *MetricsHandler) RunRollups(ctx context.Context) {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.rollup(ctx)
+		}
+	}
+}
+
+func (h *MetricsHandler) rollup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	members, err := h.redis.SPopN(ctx, dirtyMinutesKey, 10000).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to read minutes pending rollup: %v", err)
+		return
+	}
+
+	// service ID -> hour -> minutes within it that received samples
+	pending := map[string]map[int64][]time.Time{}
+	for _, member := range members {
+		serviceID, minuteStr, ok := strings.Cut(member, " ")
+		minute, err := strconv.ParseInt(minuteStr, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		t := time.Unix(minute, 0).UTC()
+		hour := t.Truncate(time.Hour).Unix()
+		if pending[serviceID] == nil {
+			pending[serviceID] = map[int64][]time.Time{}
+		}
+		pending[serviceID][hour] = append(pending[serviceID][hour], t)
+	}
+
+	// Minutes of hours that fail to roll up are marked again, to be retried
+	// on the next pass
+	var failed []interface{}
+	for serviceID, hours := range pending {
+		for hour, minutes := range hours {
+			if err := h.rollupHour(ctx, serviceID, time.Unix(hour, 0).UTC(), minutes); err != nil {
+				log.Printf("Failed to roll up metrics for service %s: %v", serviceID, err)
+				for _, minute := range minutes {
+					failed = append(failed, fmt.Sprintf("%s %d", serviceID, minute.Unix()))
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		// ctx may be what ran out
+		rctx, rcancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := h.redis.SAdd(rctx, dirtyMinutesKey, failed...).Err(); err != nil {
+			log.Printf("Failed to mark %d minute(s) for rollup again: %v", len(failed), err)
+		}
+		rcancel()
+	}
+
+	now := time.Now().UTC()
+	if _, err := h.db.ExecContext(ctx,
+		`DELETE FROM metric_rollups
+		 WHERE (resolution = $1 AND bucket < $2) OR (resolution = $3 AND bucket < $4)`,
+		models.ResolutionMinute, now.Add(-minuteRetention), models.ResolutionHour, now.Add(-hourRetention),
+	); err != nil {
+		log.Printf("Failed to expire metrics rollups: %v", err)
+	}
+}
+
+// rollupHour recomputes the rollups of the given minutes of an hour from the
+// raw samples, then the hour's rollup from all of its minute rollups. Raw
+// samples are kept for less time than minute rollups, so the hour is built
+// from the latter to keep minutes whose samples are gone. Rollups are replaced
+// rather than merged, so samples arriving late for a minute are picked up the
+// next time it is marked.
+func (h *MetricsHandler) rollupHour(ctx context.Context, serviceID string, hour time.Time, minutes []time.Time) error {
+	data, err := h.redis.ZRangeByScore(ctx, rawKey(serviceID), &redis.ZRangeBy{
+		Min: strconv.FormatInt(hour.UnixMilli(), 10),
+		Max: "(" + strconv.FormatInt(hour.Add(time.Hour).UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	samples := decodeSamples(data)
+	if len(samples) == 0 {
+		return nil
+	}
+
+	byMinute := map[time.Time][]models.ServiceMetrics{}
+	for _, m := range samples {
+		minute := m.Timestamp.Truncate(time.Minute).UTC()
+		byMinute[minute] = append(byMinute[minute], m)
+	}
+
+	for _, minute := range minutes {
+		if s := byMinute[minute]; len(s) > 0 {
+			if err := h.saveRollup(ctx, serviceID, models.ResolutionMinute, rollupSamples(minute, s)); err != nil {
+				return err
+			}
+		}
+	}
+
+	parts, err := h.rollupsBetween(ctx, serviceID, models.ResolutionMinute, hour, hour.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return h.saveRollup(ctx, serviceID, models.ResolutionHour, mergeRollups(hour, parts))
+}
+
+func (h *MetricsHandler) saveRollup(ctx context.Context, serviceID string, resolution models.MetricsResolution, r models.MetricsRollup) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO metric_rollups (service_id, resolution, bucket, data) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (service_id, resolution, bucket) DO UPDATE SET data = EXCLUDED.data`,
+		serviceID, resolution, r.Timestamp.UTC(), data,
+	)
+	return err
+}
+
+// parseSeriesRange resolves the range and step of a series query. to
+// defaults to now, from to an hour before to, and step to whatever gives
+// about defaultSeriesPoints points.
+func parseSeriesRange(fromParam, toParam, stepParam string, now time.Time) (time.Time, time.Time, time.Duration, error) {
+	to := now
+	if toParam != "" {
+		t, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("to must be an RFC 3339 timestamp")
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultSeriesRange)
+	if fromParam != "" {
+		t, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("from must be an RFC 3339 timestamp")
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > hourRetention {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("range must be at most %d days", int(hourRetention.Hours()/24))
+	}
+
+	step := (to.Sub(from) / defaultSeriesPoints).Truncate(time.Second)
+	if stepParam != "" {
+		parsed, err := time.ParseDuration(stepParam)
+		if err != nil || parsed < time.Second {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("step must be a duration of at least 1s, such as 1m")
+		}
+		step = parsed
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	if to.Sub(from)/step > maxSeriesPoints {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("step is too small for the range; at most %d points are returned", maxSeriesPoints)
+	}
+	return from, to, step, nil
+}
+
+// chooseResolution picks the finest tier no finer than step that still holds
+// data at from, and rounds step up to a multiple of its resolution.
+func chooseResolution(from time.Time, step time.Duration, now time.Time) (models.MetricsResolution, time.Duration) {
+	var resolution models.MetricsResolution
+	var width time.Duration
+	switch {
+	case step < time.Minute && !from.Before(now.Add(-rawRetention)):
+		return models.ResolutionRaw, step
+	case step < time.Hour && !from.Before(now.Add(-minuteRetention)):
+		resolution, width = models.ResolutionMinute, time.Minute
+	default:
+		resolution, width = models.ResolutionHour, time.Hour
+	}
+	if rem := step % width; rem != 0 {
+		step += width - rem
+	}
+	return resolution, step
+}
+
+// rollupSamples summarises samples into a bucket starting at bucket.
+func rollupSamples(bucket time.Time, samples []models.ServiceMetrics) models.MetricsRollup {
+	r := models.MetricsRollup{Timestamp: bucket, Samples: len(samples)}
+	cpu := make([]float64, 0, len(samples))
+	memory := make([]float64, 0, len(samples))
+	errorRate := make([]float64, 0, len(samples))
+	latency := make([]float64, 0, len(samples))
+	for _, m := range samples {
+		r.RequestCount += m.RequestCount
+		cpu = append(cpu, m.CPUUsage)
+		memory = append(memory, m.MemoryUsage)
+		errorRate = append(errorRate, m.ErrorRate)
+		latency = append(latency, m.P95Latency)
+	}
+	r.CPUUsage = rollupStats(cpu)
+	r.MemoryUsage = rollupStats(memory)
+	r.ErrorRate = rollupStats(errorRate)
+	r.P95Latency = rollupStats(latency)
+	return r
+}
+
+func rollupStats(values []float64) models.RollupStats {
+	if len(values) == 0 {
+		return models.RollupStats{}
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return models.RollupStats{
+		Min: sorted[0],
+		Max: sorted[len(sorted)-1],
+		Avg: sum / float64(len(sorted)),
+		P95: percentile(sorted, 95),
+	}
+}
+
+// mergeRollups combines rollups into one bucket starting at bucket. Min, max
+// and the average are exact; the p95 is the highest p95 among the parts, an
+// upper bound of the true value.
+func mergeRollups(bucket time.Time, parts []models.MetricsRollup) models.MetricsRollup {
+	r := models.MetricsRollup{Timestamp: bucket}
+	merge := func(dst *models.RollupStats, s models.RollupStats, first bool, n int) {
+		if first || s.Min < dst.Min {
+			dst.Min = s.Min
+		}
+		if first || s.Max > dst.Max {
+			dst.Max = s.Max
+		}
+		if first || s.P95 > dst.P95 {
+			dst.P95 = s.P95
+		}
+		dst.Avg += s.Avg * float64(n)
+	}
+
+	for _, p := range parts {
+		if p.Samples == 0 {
+			continue
+		}
+		first := r.Samples == 0
+		merge(&r.CPUUsage, p.CPUUsage, first, p.Samples)
+		merge(&r.MemoryUsage, p.MemoryUsage, first, p.Samples)
+		merge(&r.ErrorRate, p.ErrorRate, first, p.Samples)
+		merge(&r.P95Latency, p.P95Latency, first, p.Samples)
+		r.Samples += p.Samples
+		r.RequestCount += p.RequestCount
+	}
+	if r.Samples > 0 {
+		n := float64(r.Samples)
+		r.CPUUsage.Avg /= n
+		r.MemoryUsage.Avg /= n
+		r.ErrorRate.Avg /= n
+		r.P95Latency.Avg /= n
+	}
+	return r
+}
+
+// bucketSamples groups raw samples into step-wide buckets, oldest first.
+func bucketSamples(samples []models.ServiceMetrics, step time.Duration) []models.MetricsRollup {
+	groups := map[time.Time][]models.ServiceMetrics{}
+	for _, m := range samples {
+		bucket := m.Timestamp.Truncate(step).UTC()
+		groups[bucket] = append(groups[bucket], m)
+	}
+
+	points := make([]models.MetricsRollup, 0, len(groups))
+	for bucket, group := range groups {
+		points = append(points, rollupSamples(bucket, group))
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	return points
+}
+
+// bucketRollups merges rollups into step-wide buckets, oldest first.
+func bucketRollups(rollups []models.MetricsRollup, step time.Duration) []models.MetricsRollup {
+	groups := map[time.Time][]models.MetricsRollup{}
+	for _, r := range rollups {
+		bucket := r.Timestamp.Truncate(step).UTC()
+		groups[bucket] = append(groups[bucket], r)
+	}
+
+	points := make([]models.MetricsRollup, 0, len(groups))
+	for bucket, group := range groups {
+		points = append(points, mergeRollups(bucket, group))
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	return points
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestChooseResolution(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		from           time.Time
+		step           time.Duration
+		wantResolution models.MetricsResolution
+		wantStep       time.Duration
+	}{
+		{"recent fine step", now.Add(-time.Hour), 10 * time.Second, models.ResolutionRaw, 10 * time.Second},
+		{"recent minute step", now.Add(-time.Hour), time.Minute, models.ResolutionMinute, time.Minute},
+		{"beyond raw retention", now.Add(-12 * time.Hour), 10 * time.Second, models.ResolutionMinute, time.Minute},
+		{"step rounded up", now.Add(-time.Hour), 90 * time.Second, models.ResolutionMinute, 2 * time.Minute},
+		{"beyond minute retention", now.Add(-8 * 24 * time.Hour), 5 * time.Minute, models.ResolutionHour, time.Hour},
+		{"hour step", now.Add(-time.Hour), 3 * time.Hour, models.ResolutionHour, 3 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolution, step := chooseResolution(tt.from, tt.step, now)
+			if resolution != tt.wantResolution || step != tt.wantStep {
+				t.Errorf("chooseResolution() = %s, %s, want %s, %s", resolution, step, tt.wantResolution, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestParseSeriesRange(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		from, to, step string
+		wantFrom       time.Time
+		wantStep       time.Duration
+		wantErr        bool
+	}{
+		{"defaults", "", "", "", now.Add(-time.Hour), 12 * time.Second, false},
+		{"explicit", "2024-01-10T10:00:00Z", "", "1m", now.Add(-2 * time.Hour), time.Minute, false},
+		{"reversed", "2024-01-10T13:00:00Z", "", "", time.Time{}, 0, true},
+		{"too long", "2023-01-01T00:00:00Z", "", "", time.Time{}, 0, true},
+		{"bad step", "", "", "fast", time.Time{}, 0, true},
+		{"too many points", "2024-01-03T12:00:00Z", "", "1s", time.Time{}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, step, err := parseSeriesRange(tt.from, tt.to, tt.step, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSeriesRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!from.Equal(tt.wantFrom) || !to.Equal(now) || step != tt.wantStep) {
+				t.Errorf("parseSeriesRange() = %v, %v, %s, want %v, %v, %s", from, to, step, tt.wantFrom, now, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestRollups(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	samples := []models.ServiceMetrics{
+		{Timestamp: base, CPUUsage: 10, RequestCount: 5},
+		{Timestamp: base.Add(20 * time.Second), CPUUsage: 30, RequestCount: 5},
+		{Timestamp: base.Add(70 * time.Second), CPUUsage: 80, RequestCount: 10},
+	}
+
+	minutes := bucketSamples(samples, time.Minute)
+	if len(minutes) != 2 {
+		t.Fatalf("bucketSamples() returned %d buckets, want 2", len(minutes))
+	}
+	first := minutes[0]
+	if !first.Timestamp.Equal(base) || first.Samples != 2 || first.RequestCount != 10 {
+		t.Errorf("first bucket = %+v", first)
+	}
+	if first.CPUUsage != (models.RollupStats{Min: 10, Max: 30, Avg: 20, P95: 30}) {
+		t.Errorf("first bucket cpu = %+v", first.CPUUsage)
+	}
+
+	merged := bucketRollups(minutes, time.Hour)
+	if len(merged) != 1 {
+		t.Fatalf("bucketRollups() returned %d buckets, want 1", len(merged))
+	}
+	want := models.RollupStats{Min: 10, Max: 80, Avg: 40, P95: 80}
+	if got := merged[0]; got.Samples != 3 || got.RequestCount != 20 || got.CPUUsage != want {
+		t.Errorf("merged = %+v, want 3 samples, 20 requests, cpu %+v", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/reconciler"
+)
+
+// NodeDriver is a reconciler.Driver that runs services by scheduling them
+// onto a ready node in their region; the node's agent then reports the
+// observed status. Regions with no registered nodes at all fall back to the
+// given driver so a control plane without agents still works end to end.
+type NodeDriver struct {
+	db          *sql.DB
+	assignments *AssignmentHandler
+	fallback    reconciler.Driver
+}
+
+func NewNodeDriver(db *sql.DB, assignments *AssignmentHandler, fallback reconciler.Driver) *NodeDriver {
+	return &NodeDriver{
+		db:          db,
+		assignments: assignments,
+		fallback:    fallback,
+	}
+}
+
+func (d *NodeDriver) Start(ctx context.Context, service models.Service) error {
+	var nodes int
+	if err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM nodes WHERE region = $1", service.Region).Scan(&nodes); err != nil {
+		return err
+	}
+	if nodes == 0 {
+		return d.fallback.Start(ctx, service)
+	}
+
+	nodeID, err := d.pickNode(ctx, service)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no ready node with free capacity in %s", service.Region)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.db.ExecContext(ctx, "UPDATE services SET node_id = $1 WHERE id = $2", nodeID, service.ID); err != nil {
+		return err
+	}
+	if service.NodeID != "" && service.NodeID != nodeID {
+		if err := d.assignments.BumpGeneration(ctx, service.NodeID); err != nil {
+			return err
+		}
+	}
+	if err := d.assignments.BumpGeneration(ctx, nodeID); err != nil {
+		return err
+	}
+
+	return reconciler.ErrInProgress
+}
+
+func (d *NodeDriver) Stop(ctx context.Context, service models.Service) error {
+	if err := d.fallback.Stop(ctx, service); err != nil {
+		return err
+	}
+	if service.NodeID == "" {
+		return nil
+	}
+
+	if _, err := d.db.ExecContext(ctx, "UPDATE services SET node_id = NULL WHERE id = $1", service.ID); err != nil {
+		return err
+	}
+	return d.assignments.BumpGeneration(ctx, service.NodeID)
+}
+
+// pickNode keeps a service on its current node while that node is ready and
+// otherwise picks the least loaded ready node in the region.
+func (d *NodeDriver) pickNode(ctx context.Context, service models.Service) (string, error) {
+	if service.NodeID != "" {
+		var status models.NodeStatus
+		err := d.db.QueryRowContext(ctx, "SELECT status FROM nodes WHERE id = $1", service.NodeID).Scan(&status)
+		if err == nil && status == models.NodeStatusReady {
+			return service.NodeID, nil
+		}
+	}
+
+	var nodeID string
+	err := d.db.QueryRowContext(ctx,
+		`SELECT n.id
+		 FROM nodes n
+		 LEFT JOIN services s ON s.node_id = n.id AND s.id <> $3
+		 WHERE n.region = $1 AND n.status = $2
+		 GROUP BY n.id, n.name, n.capacity
+		 HAVING COUNT(s.id) < COALESCE((n.capacity->>'max_services')::int, 0)
+		 ORDER BY COUNT(s.id), n.name
+		 LIMIT 1`,
+		service.Region, models.NodeStatusReady, service.ID,
+	).Scan(&nodeID)
+	return nodeID, err
+}
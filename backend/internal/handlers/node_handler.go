@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	// A node is unhealthy after missing three heartbeats and lost after two
+	// minutes of silence.
+	unhealthyAfter = 3 * heartbeatInterval
+	lostAfter      = 2 * time.Minute
+)
+
+const nodeColumns = "id, name, region, capacity, labels, status, generation, last_heartbeat_at, created_at, updated_at"
+
+type NodeHandler struct {
+	db  *sql.DB
+	hub *websocket.Hub
+}
+
+func NewNodeHandler(db *sql.DB, hub *websocket.Hub) *NodeHandler {
+	return &NodeHandler{
+		db:  db,
+		hub: hub,
+	}
+}
+
+func scanNode(row rowScanner) (models.Node, error) {
+	var n models.Node
+	var capacity, labels []byte
+	if err := row.Scan(&n.ID, &n.Name, &n.Region, &capacity, &labels, &n.Status, &n.Generation, &n.LastHeartbeatAt, &n.CreatedAt, &n.UpdatedAt); err != nil {
+		return n, err
+	}
+	if err := json.Unmarshal(capacity, &n.Capacity); err != nil {
+		return n, err
+	}
+	if err := json.Unmarshal(labels, &n.Labels); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (h *NodeHandler) ListNodes(c *gin.Context) {
+	query := "SELECT " + nodeColumns + " FROM nodes WHERE 1=1"
+	args := []interface{}{}
+	argCount := 1
+
+	if region := c.Query("region"); region != "" {
+		query += fmt.Sprintf(" AND region = $%d", argCount)
+		args = append(args, region)
+		argCount++
+	}
+
+	if status := c.Query("status"); status != "" {
+		query += fmt.Sprintf(" AND status = $%d", argCount)
+		args = append(args, status)
+	}
+
+	query += " ORDER BY name"
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query nodes")
+		return
+	}
+	defer rows.Close()
+
+	nodes := []models.Node{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan node")
+			return
+		}
+		nodes = append(nodes, n)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"nodes": nodes})
+}
+
+func (h *NodeHandler) GetNode(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	n, err := scanNode(h.db.QueryRowContext(ctx, "SELECT "+nodeColumns+" FROM nodes WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Node")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get node")
+		return
+	}
+
+	c.JSON(http.StatusOK, n)
+}
+
+// RegisterNode registers an agent, or re-registers it under the same name.
+// Re-registering rotates the node token.
+func (h *NodeHandler) RegisterNode(c *gin.Context) {
+	var req models.RegisterNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	var validationErrs validation.ValidationErrors
+	if err := validation.ValidateNodeName(req.Name); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateRegion(req.Region); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateNodeCapacity(req.Capacity.CPUCores, req.Capacity.MemoryMB, req.Capacity.MaxServices); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if err := validation.ValidateLabels(req.Labels); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
+	if len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	if req.Labels == nil {
+		req.Labels = map[string]string{}
+	}
+
+	token, err := newNodeToken()
+	if err != nil {
+		errors.InternalError(c, "Failed to generate node token")
+		return
+	}
+
+	capacity, _ := json.Marshal(req.Capacity)
+	labels, _ := json.Marshal(req.Labels)
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	node, err := scanNode(h.db.QueryRowContext(ctx,
+		`INSERT INTO nodes (id, name, region, capacity, labels, status, token_hash, last_heartbeat_at, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $8)
+		 ON CONFLICT (name) DO UPDATE SET
+			region = EXCLUDED.region,
+			capacity = EXCLUDED.capacity,
+			labels = EXCLUDED.labels,
+			status = EXCLUDED.status,
+			token_hash = EXCLUDED.token_hash,
+			last_heartbeat_at = EXCLUDED.last_heartbeat_at,
+			updated_at = EXCLUDED.updated_at
+		 RETURNING `+nodeColumns,
+		uuid.New().String(), req.Name, req.Region, capacity, labels, models.NodeStatusReady, hashNodeToken(token), now,
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to register node")
+		return
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeNodeUpdate, node)
+
+	c.JSON(http.StatusCreated, models.RegisterNodeResponse{
+		Node:                     node,
+		Token:                    token,
+		HeartbeatIntervalSeconds: int(heartbeatInterval / time.Second),
+	})
+}
+
+func (h *NodeHandler) DeregisterNode(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := h.evictServices(ctx, id, "node deregistered"); err != nil {
+		errors.InternalError(c, "Failed to evict services from node")
+		return
+	}
+
+	node, err := scanNode(h.db.QueryRowContext(ctx, "DELETE FROM nodes WHERE id = $1 RETURNING "+nodeColumns, id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Node")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete node")
+		return
+	}
+	auditBefore(c, node)
+
+	h.hub.Broadcast(websocket.MessageTypeNodeUpdate, gin.H{
+		"id":     id,
+		"action": "deleted",
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Node deleted successfully"})
+}
+
+// Heartbeat records that the calling agent is alive. A node that had been
+// marked unhealthy or lost becomes ready again.
+func (h *NodeHandler) Heartbeat(c *gin.Context) {
+	id := c.GetString("node_id")
+	now := time.Now()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var previous models.NodeStatus
+	if err := h.db.QueryRowContext(ctx, "SELECT status FROM nodes WHERE id = $1", id).Scan(&previous); err != nil {
+		errors.InternalError(c, "Failed to load node")
+		return
+	}
+
+	node, err := scanNode(h.db.QueryRowContext(ctx,
+		"UPDATE nodes SET status = $1, last_heartbeat_at = $2, updated_at = $2 WHERE id = $3 RETURNING "+nodeColumns,
+		models.NodeStatusReady, now, id,
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to record heartbeat")
+		return
+	}
+
+	if previous != models.NodeStatusReady {
+		h.hub.BroadcastJSON(websocket.MessageTypeNodeUpdate, node)
+	}
+
+	c.JSON(http.StatusOK, models.HeartbeatResponse{
+		Status:                   node.Status,
+		HeartbeatIntervalSeconds: int(heartbeatInterval / time.Second),
+	})
+}
+
+// AgentAuth authenticates an agent by the node token it received at
+// registration. The token must belong to the node named in the path.
+func (h *NodeHandler) AgentAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.Split(c.GetHeader("Authorization"), " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			errors.Unauthorized(c, "Missing or malformed node token")
+			c.Abort()
+			return
+		}
+
+		token := parts[1]
+		id := c.Param("id")
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+
+		var tokenHash string
+		err := h.db.QueryRowContext(ctx, "SELECT token_hash FROM nodes WHERE id = $1", id).Scan(&tokenHash)
+		if err == sql.ErrNoRows {
+			errors.Unauthorized(c, "Unknown node")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to authenticate node")
+			c.Abort()
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashNodeToken(token))) != 1 {
+			errors.Unauthorized(c, "Invalid node token")
+			c.Abort()
+			return
+		}
+
+		c.Set("node_id", id)
+		c.Next()
+	}
+}
+
+// RunHealthMonitor marks nodes unhealthy or lost when their heartbeats stop.
+func (h *NodeHandler) RunHealthMonitor(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.checkHeartbeats(ctx)
+		}
+	}
+}
+
+func (h *NodeHandler) checkHeartbeats(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(qctx, "SELECT "+nodeColumns+" FROM nodes WHERE status <> $1", models.NodeStatusLost)
+	if err != nil {
+		log.Printf("Failed to query nodes for heartbeat check: %v", err)
+		return
+	}
+
+	now := time.Now()
+	changed := []models.Node{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			continue
+		}
+		if status := nodeHealth(n.LastHeartbeatAt, now); status != n.Status {
+			n.Status = status
+			n.UpdatedAt = now
+			changed = append(changed, n)
+		}
+	}
+	rows.Close()
+
+	for _, n := range changed {
+		// Guard on last_heartbeat_at so a heartbeat that raced this check wins
+		result, err := h.db.ExecContext(qctx,
+			"UPDATE nodes SET status = $1, updated_at = $2 WHERE id = $3 AND last_heartbeat_at = $4",
+			n.Status, n.UpdatedAt, n.ID, n.LastHeartbeatAt,
+		)
+		if err != nil {
+			log.Printf("Failed to mark node %s %s: %v", n.ID, n.Status, err)
+			continue
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			continue
+		}
+		h.hub.BroadcastJSON(websocket.MessageTypeNodeUpdate, n)
+
+		if n.Status == models.NodeStatusLost {
+			if err := h.evictServices(qctx, n.ID, "node lost"); err != nil {
+				log.Printf("Failed to evict services from lost node %s: %v", n.ID, err)
+			}
+		}
+	}
+}
+
+// evictServices unassigns every service from a node and marks it errored, so
+// the reconciler schedules it somewhere else.
+func (h *NodeHandler) evictServices(ctx context.Context, nodeID, reason string) error {
+	rows, err := h.db.QueryContext(ctx,
+		`UPDATE services SET status = $1, status_message = $2, node_id = NULL, updated_at = $3
+		 WHERE node_id = $4
+		 RETURNING `+serviceColumns,
+		models.StatusError, reason, time.Now(), nodeID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanService(rows)
+		if err != nil {
+			return err
+		}
+		h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, s)
+	}
+	return rows.Err()
+}
+
+// nodeHealth derives a node's status from the age of its last heartbeat.
+func nodeHealth(lastHeartbeat, now time.Time) models.NodeStatus {
+	silence := now.Sub(lastHeartbeat)
+	switch {
+	case silence >= lostAfter:
+		return models.NodeStatusLost
+	case silence >= unhealthyAfter:
+		return models.NodeStatusUnhealthy
+	default:
+		return models.NodeStatusReady
+	}
+}
+
+func newNodeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashNodeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestNodeHealth(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		silence time.Duration
+		want    models.NodeStatus
+	}{
+		{"fresh heartbeat", 0, models.NodeStatusReady},
+		{"one missed heartbeat", heartbeatInterval + time.Second, models.NodeStatusReady},
+		{"three missed heartbeats", unhealthyAfter, models.NodeStatusUnhealthy},
+		{"just before lost", lostAfter - time.Second, models.NodeStatusUnhealthy},
+		{"lost", lostAfter, models.NodeStatusLost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeHealth(now.Add(-tt.silence), now); got != tt.want {
+				t.Errorf("nodeHealth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeTokenHash(t *testing.T) {
+	token, err := newNodeToken()
+	if err != nil {
+		t.Fatalf("newNodeToken() error = %v", err)
+	}
+	if len(token) != 64 {
+		t.Errorf("newNodeToken() length = %d, want 64", len(token))
+	}
+
+	other, _ := newNodeToken()
+	if token == other {
+		t.Error("newNodeToken() returned the same token twice")
+	}
+
+	if hashNodeToken(token) != hashNodeToken(token) {
+		t.Error("hashNodeToken() is not deterministic")
+	}
+	if hashNodeToken(token) == hashNodeToken(other) {
+		t.Error("hashNodeToken() collided for different tokens")
+	}
+}
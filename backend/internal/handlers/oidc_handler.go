@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/oidc"
+)
+
+// oidcLoginTTL bounds how long a user may take at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var roleRank = map[middleware.Role]int{
+	middleware.RoleViewer:   1,
+	middleware.RoleOperator: 2,
+	middleware.RoleAdmin:    3,
+}
+
+// oidcLogin is what a login keeps in Redis, under its state, until the
+// callback.
+type oidcLogin struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+// OIDCHandler signs users in through an OpenID provider with the
+// authorization code flow and PKCE, and issues them session tokens with the
+// role their IdP groups map to.
+type OIDCHandler struct {
+	provider     *oidc.Provider
+	redis        *redis.Client
+	auth         *middleware.AuthMiddleware
+	roles        map[string]middleware.Role
+	defaultRole  middleware.Role
+	postLoginURL string
+}
+
+func NewOIDCHandler(provider *oidc.Provider, redisClient *redis.Client, auth *middleware.AuthMiddleware, roleMapping, defaultRole, postLoginURL string) (*OIDCHandler, error) {
+	roles, err := parseRoleMapping(roleMapping)
+	if err != nil {
+		return nil, err
+	}
+	if defaultRole != "" && roleRank[middleware.Role(defaultRole)] == 0 {
+		return nil, fmt.Errorf("default role %q must be viewer, operator or admin", defaultRole)
+	}
+	return &OIDCHandler{
+		provider:     provider,
+		redis:        redisClient,
+		auth:         auth,
+		roles:        roles,
+		defaultRole:  middleware.Role(defaultRole),
+		postLoginURL: postLoginURL,
+	}, nil
+}
+
+func oidcLoginKey(state string) string {
+	return "oidc:login:" + state
+}
+
+// Login redirects to the identity provider. ?login_hint= is passed on.
+func (h *OIDCHandler) Login(c *gin.Context) {
+	state, err := oidc.RandomString()
+	if err != nil {
+		errors.InternalError(c, "Failed to start login")
+		return
+	}
+	login := oidcLogin{}
+	if login.Verifier, err = oidc.RandomString(); err != nil {
+		errors.InternalError(c, "Failed to start login")
+		return
+	}
+	if login.Nonce, err = oidc.RandomString(); err != nil {
+		errors.InternalError(c, "Failed to start login")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	extra := url.Values{}
+	if hint := c.Query("login_hint"); hint != "" {
+		extra.Set("login_hint", hint)
+	}
+	authURL, err := h.provider.AuthCodeURL(ctx, state, login.Nonce, login.Verifier, extra)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		errors.InternalError(c, "Identity provider is unavailable")
+		return
+	}
+
+	data, _ := json.Marshal(login)
+	if err := h.redis.Set(ctx, oidcLoginKey(state), data, oidcLoginTTL).Err(); err != nil {
+		errors.InternalError(c, "Failed to start login")
+		return
+	}
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Callback completes a login: it redeems the code, verifies the ID token and
+// issues session tokens, either as JSON or, with a post-login URL, in the
+// fragment of a redirect there.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	if idpErr := c.Query("error"); idpErr != "" {
+		errors.Unauthorized(c, fmt.Sprintf("Identity provider refused the login: %s %s", idpErr, c.Query("error_description")))
+		return
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		errors.BadRequest(c, "state and code are required", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+
+	// Each state can complete one login only
+	data, err := h.redis.GetDel(ctx, oidcLoginKey(state)).Bytes()
+	if err == redis.Nil {
+		errors.BadRequest(c, "Unknown or expired login; please sign in again", nil)
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to complete login")
+		return
+	}
+	var login oidcLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		errors.InternalError(c, "Failed to complete login")
+		return
+	}
+
+	rawIDToken, err := h.provider.Exchange(ctx, code, login.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		errors.Unauthorized(c, "Failed to redeem the authorization code")
+		return
+	}
+	idToken, err := h.provider.Verify(ctx, rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		errors.Unauthorized(c, "Invalid ID token")
+		return
+	}
+
+	role, ok := mapRole(idToken.Groups, h.roles, h.defaultRole)
+	if !ok {
+		errors.Forbidden(c, "None of your groups grants access to Stratus")
+		return
+	}
+	userID := idToken.Email
+	if userID == "" {
+		userID = idToken.Subject
+	}
+
+	projects, err := h.auth.Projects(ctx, userID, idToken.Groups)
+	if err != nil {
+		errors.InternalError(c, "Failed to look up project memberships")
+		return
+	}
+	tokens, err := h.auth.GenerateTokenPair(userID, role, idToken.Groups, projects)
+	if err != nil {
+		errors.InternalError(c, "Failed to issue session token")
+		return
+	}
+
+	if h.postLoginURL != "" {
+		fragment := url.Values{
+			"token":         {tokens.AccessToken},
+			"refresh_token": {tokens.RefreshToken},
+			"expires_in":    {strconv.Itoa(tokens.ExpiresIn)},
+		}
+		c.Redirect(http.StatusFound, h.postLoginURL+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user_id":       userID,
+		"role":          role,
+	})
+}
+
+// parseRoleMapping parses "group=role,group=role".
+func parseRoleMapping(mapping string) (map[string]middleware.Role, error) {
+	roles := make(map[string]middleware.Role)
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(entry, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("role mapping entry %q must be group=role", entry)
+		}
+		if roleRank[middleware.Role(role)] == 0 {
+			return nil, fmt.Errorf("role mapping entry %q: role must be viewer, operator or admin", entry)
+		}
+		roles[group] = middleware.Role(role)
+	}
+	return roles, nil
+}
+
+// mapRole returns the highest role any of groups maps to, or defaultRole.
+func mapRole(groups []string, roles map[string]middleware.Role, defaultRole middleware.Role) (middleware.Role, bool) {
+	best := defaultRole
+	for _, group := range groups {
+		if role, ok := roles[group]; ok && roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	return best, best != ""
+}
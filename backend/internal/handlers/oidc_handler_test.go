@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stratus/backend/internal/middleware"
+)
+
+func TestParseRoleMapping(t *testing.T) {
+	roles, err := parseRoleMapping(" sre = admin, devs=operator ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles["sre"] != middleware.RoleAdmin || roles["devs"] != middleware.RoleOperator {
+		t.Errorf("parseRoleMapping() = %v", roles)
+	}
+
+	for _, bad := range []string{"sre", "sre=root", "=admin"} {
+		if _, err := parseRoleMapping(bad); err == nil {
+			t.Errorf("parseRoleMapping(%q) should fail", bad)
+		}
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	roles := map[string]middleware.Role{"sre": middleware.RoleAdmin, "devs": middleware.RoleOperator, "all": middleware.RoleViewer}
+
+	tests := []struct {
+		name        string
+		groups      []string
+		defaultRole middleware.Role
+		want        middleware.Role
+		wantOK      bool
+	}{
+		{"highest wins", []string{"all", "sre", "devs"}, "", middleware.RoleAdmin, true},
+		{"single group", []string{"devs"}, "", middleware.RoleOperator, true},
+		{"unmapped refused", []string{"sales"}, "", "", false},
+		{"unmapped gets default", []string{"sales"}, middleware.RoleViewer, middleware.RoleViewer, true},
+		{"default does not cap", []string{"sre"}, middleware.RoleViewer, middleware.RoleAdmin, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mapRole(tt.groups, roles, tt.defaultRole)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("mapRole() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
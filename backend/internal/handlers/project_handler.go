@@ -0,0 +1,657 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+// serviceProjectTTL is how long ProjectOf trusts a cached project. Moves
+// on other replicas drop it as soon as they are relayed here; the TTL
+// covers relays that were lost.
+const serviceProjectTTL = time.Minute
+
+// ProjectHandler manages organizations, projects and project membership,
+// and keeps callers to the services of their projects. Callers see the
+// projects in their token and the default project; admins see every
+// project, and move services between them.
+type ProjectHandler struct {
+	db     *sql.DB
+	hub    *websocket.Hub
+	quotas *QuotaHandler
+	// serviceProjects caches ProjectOf as serviceProject values
+	serviceProjects sync.Map
+}
+
+type serviceProject struct {
+	project  string
+	cachedAt time.Time
+}
+
+func NewProjectHandler(db *sql.DB, hub *websocket.Hub, quotas *QuotaHandler) *ProjectHandler {
+	return &ProjectHandler{db: db, hub: hub, quotas: quotas}
+}
+
+// organizationColumns is the column list scanOrganization expects, in order.
+const organizationColumns = "id, name, COALESCE(created_by, ''), created_at"
+
+func scanOrganization(row rowScanner) (models.Organization, error) {
+	var o models.Organization
+	err := row.Scan(&o.ID, &o.Name, &o.CreatedBy, &o.CreatedAt)
+	return o, err
+}
+
+// projectColumns is the column list scanProject expects, in order.
+const projectColumns = "id, organization_id, name, COALESCE(created_by, ''), created_at"
+
+func scanProject(row rowScanner) (models.Project, error) {
+	var p models.Project
+	err := row.Scan(&p.ID, &p.OrganizationID, &p.Name, &p.CreatedBy, &p.CreatedAt)
+	return p, err
+}
+
+// projectMemberColumns is the column list scanProjectMember expects, in order.
+const projectMemberColumns = "project_id, subject_kind, subject, COALESCE(created_by, ''), created_at"
+
+func scanProjectMember(row rowScanner) (models.ProjectMember, error) {
+	var m models.ProjectMember
+	err := row.Scan(&m.ProjectID, &m.SubjectKind, &m.Subject, &m.CreatedBy, &m.CreatedAt)
+	return m, err
+}
+
+func (h *ProjectHandler) ListOrganizations(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, "SELECT "+organizationColumns+" FROM organizations ORDER BY name")
+	if err != nil {
+		errors.InternalError(c, "Failed to query organizations")
+		return
+	}
+	defer rows.Close()
+
+	organizations := []models.Organization{}
+	for rows.Next() {
+		o, err := scanOrganization(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan organization")
+			return
+		}
+		organizations = append(organizations, o)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organizations": organizations})
+}
+
+func (h *ProjectHandler) CreateOrganization(c *gin.Context) {
+	var req models.OrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if err := validation.ValidateServiceName(req.Name); err != nil {
+		errors.BadRequest(c, "Validation failed", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	o, err := scanOrganization(h.db.QueryRowContext(ctx,
+		`INSERT INTO organizations (id, name, created_by, created_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (name) DO NOTHING
+		 RETURNING `+organizationColumns,
+		uuid.New().String(), req.Name, c.GetString("user_id"), time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.Conflict(c, "An organization with this name already exists")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to create organization")
+		return
+	}
+
+	c.JSON(http.StatusCreated, o)
+}
+
+// DeleteOrganization deletes an organization that has no projects left.
+func (h *ProjectHandler) DeleteOrganization(c *gin.Context) {
+	id := c.Param("id")
+	if id == models.DefaultOrganizationID {
+		errors.BadRequest(c, "The default organization cannot be deleted", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var hasProjects bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE organization_id = $1)", id).Scan(&hasProjects); err != nil {
+		errors.InternalError(c, "Failed to delete organization")
+		return
+	}
+	if hasProjects {
+		errors.Conflict(c, "The organization still has projects")
+		return
+	}
+
+	o, err := scanOrganization(h.db.QueryRowContext(ctx, "DELETE FROM organizations WHERE id = $1 RETURNING "+organizationColumns, id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Organization")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete organization")
+		return
+	}
+	auditBefore(c, o)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization deleted successfully"})
+}
+
+// ListProjects lists the projects the caller can see, optionally only
+// those of ?organization_id=.
+func (h *ProjectHandler) ListProjects(c *gin.Context) {
+	query := "SELECT " + projectColumns + " FROM projects WHERE 1=1"
+	args := []interface{}{}
+	if org := c.Query("organization_id"); org != "" {
+		args = append(args, org)
+		query += fmt.Sprintf(" AND organization_id = $%d", len(args))
+	}
+	filter, args := projectFilter(c, "id", args)
+	query += filter + " ORDER BY organization_id, name"
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query projects")
+		return
+	}
+	defer rows.Close()
+
+	projects := []models.Project{}
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan project")
+			return
+		}
+		projects = append(projects, p)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"projects": projects})
+}
+
+func (h *ProjectHandler) GetProject(c *gin.Context) {
+	id := c.Param("id")
+	if !canSeeProject(c, id) {
+		errors.NotFound(c, "Project")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	p, err := scanProject(h.db.QueryRowContext(ctx, "SELECT "+projectColumns+" FROM projects WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Project")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+func (h *ProjectHandler) CreateProject(c *gin.Context) {
+	var req models.ProjectRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if err := validation.ValidateServiceName(req.Name); err != nil {
+		errors.BadRequest(c, "Validation failed", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM organizations WHERE id = $1)", req.OrganizationID).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get organization")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Organization")
+		return
+	}
+
+	p, err := scanProject(h.db.QueryRowContext(ctx,
+		`INSERT INTO projects (id, organization_id, name, created_by, created_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (organization_id, name) DO NOTHING
+		 RETURNING `+projectColumns,
+		uuid.New().String(), req.OrganizationID, req.Name, c.GetString("user_id"), time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.Conflict(c, "The organization already has a project with this name")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to create project")
+		return
+	}
+
+	c.JSON(http.StatusCreated, p)
+}
+
+// DeleteProject deletes a project that has no services left, together
+// with its memberships.
+func (h *ProjectHandler) DeleteProject(c *gin.Context) {
+	id := c.Param("id")
+	if id == models.DefaultProjectID {
+		errors.BadRequest(c, "The default project cannot be deleted", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var hasServices bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM services WHERE project_id = $1)", id).Scan(&hasServices); err != nil {
+		errors.InternalError(c, "Failed to delete project")
+		return
+	}
+	if hasServices {
+		errors.Conflict(c, "The project still has services")
+		return
+	}
+
+	p, err := scanProject(h.db.QueryRowContext(ctx, "DELETE FROM projects WHERE id = $1 RETURNING "+projectColumns, id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Project")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete project")
+		return
+	}
+	auditBefore(c, p)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project deleted successfully"})
+}
+
+// MoveService moves a service, with its alert rules, to another project,
+// within the project's quota. Services of the default project are moved
+// out of it this way to hide them from non-members. Both projects are
+// told: the old one that the service moved out, the new one that it moved
+// in.
+func (h *ProjectHandler) MoveService(c *gin.Context) {
+	id := c.Param("id")
+
+	var req models.MoveServiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to move service")
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := scanService(tx.QueryRowContext(ctx, "SELECT "+serviceColumns+" FROM services WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+	auditBefore(c, current)
+	if current.ProjectID == req.ProjectID {
+		c.JSON(http.StatusOK, current)
+		return
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)", req.ProjectID).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Project")
+		return
+	}
+
+	// A rollout targets the services of one project
+	if err := lockDeployments(ctx, tx, current.ProjectID, current.Name); err != nil {
+		errors.InternalError(c, "Failed to lock deployments")
+		return
+	}
+	deploying, err := hasActiveDeployment(ctx, tx, current.ProjectID, current.Name)
+	if err != nil {
+		errors.InternalError(c, "Failed to check active deployments")
+		return
+	}
+	if deploying {
+		errors.Conflict(c, "A deployment is in progress for this service")
+		return
+	}
+
+	// The service counts against its new project's quota, and its creator's
+	// quota does not change
+	moved := current
+	moved.ProjectID = req.ProjectID
+	if !h.quotas.admit(ctx, tx, c, moved, "", false) {
+		return
+	}
+	if moved.DesiredStatus == models.StatusRunning && !h.quotas.admit(ctx, tx, c, moved, "", true) {
+		return
+	}
+
+	service, err := scanService(tx.QueryRowContext(ctx,
+		"UPDATE services SET project_id = $2, updated_at = $3 WHERE id = $1 RETURNING "+serviceColumns,
+		id, req.ProjectID, time.Now(),
+	))
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE alert_rules SET project_id = $2 WHERE service_id = $1", id, req.ProjectID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to move service")
+		return
+	}
+	h.serviceProjects.Delete(id)
+
+	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, gin.H{
+		"id":         id,
+		"name":       current.Name,
+		"project_id": current.ProjectID,
+		"moved_to":   service.ProjectID,
+		"action":     "moved_out",
+	})
+	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, struct {
+		models.Service
+		MovedFrom string `json:"moved_from"`
+		Action    string `json:"action"`
+	}{service, current.ProjectID, "moved_in"})
+	recordDeploymentLog(h.db, h.hub, id, "move", "success",
+		fmt.Sprintf("Moved from project %s to %s", current.ProjectID, service.ProjectID))
+
+	c.JSON(http.StatusOK, service)
+}
+
+func (h *ProjectHandler) ListProjectMembers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+projectMemberColumns+" FROM project_members WHERE project_id = $1 ORDER BY subject_kind, subject",
+		c.Param("id"),
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to query project members")
+		return
+	}
+	defer rows.Close()
+
+	members := []models.ProjectMember{}
+	for rows.Next() {
+		m, err := scanProjectMember(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan project member")
+			return
+		}
+		members = append(members, m)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// AddProjectMember makes a user or group a member of a project. Members
+// see the project from their next sign-in or token refresh.
+func (h *ProjectHandler) AddProjectMember(c *gin.Context) {
+	projectID := c.Param("id")
+
+	var req models.ProjectMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if validationErrs := validateProjectMember(req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)", projectID).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Project")
+		return
+	}
+
+	m, err := scanProjectMember(h.db.QueryRowContext(ctx,
+		`INSERT INTO project_members (project_id, subject_kind, subject, created_by, created_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (project_id, subject_kind, subject) DO NOTHING
+		 RETURNING `+projectMemberColumns,
+		projectID, req.SubjectKind, req.Subject, c.GetString("user_id"), time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.Conflict(c, "Already a member of this project")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to add project member")
+		return
+	}
+
+	c.JSON(http.StatusCreated, m)
+}
+
+// RemoveProjectMember removes the member :kind/:subject from a project.
+// Tokens already issued keep the project until they are refreshed.
+func (h *ProjectHandler) RemoveProjectMember(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	m, err := scanProjectMember(h.db.QueryRowContext(ctx,
+		"DELETE FROM project_members WHERE project_id = $1 AND subject_kind = $2 AND subject = $3 RETURNING "+projectMemberColumns,
+		c.Param("id"), c.Param("kind"), c.Param("subject"),
+	))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Project member")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to remove project member")
+		return
+	}
+	auditBefore(c, m)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Project member removed successfully"})
+}
+
+// ProjectsFor implements middleware.ProjectMemberships.
+func (h *ProjectHandler) ProjectsFor(ctx context.Context, userID string, groups []string) ([]string, error) {
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT DISTINCT project_id FROM project_members
+		 WHERE (subject_kind = $1 AND subject = $2) OR (subject_kind = $3 AND subject = ANY($4))
+		 ORDER BY project_id`,
+		models.SubjectUser, userID, models.SubjectGroup, pq.Array(groups),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		projects = append(projects, id)
+	}
+	return projects, rows.Err()
+}
+
+// ProjectOf returns the project of a service, or "" if it cannot be found.
+// The hub uses it to deliver events about a service to its project only.
+func (h *ProjectHandler) ProjectOf(serviceID string) string {
+	if cached, ok := h.serviceProjects.Load(serviceID); ok {
+		if sp := cached.(serviceProject); time.Since(sp.cachedAt) < serviceProjectTTL {
+			return sp.project
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var project string
+	if err := h.db.QueryRowContext(ctx, "SELECT project_id FROM services WHERE id = $1", serviceID).Scan(&project); err != nil {
+		return ""
+	}
+	h.serviceProjects.Store(serviceID, serviceProject{project: project, cachedAt: time.Now()})
+	return project
+}
+
+// ForgetMovedService drops the cached project of a service another replica
+// moved. Register it with Hub.ListenRelayed.
+func (h *ProjectHandler) ForgetMovedService(message websocket.Message) {
+	if message.Type != websocket.MessageTypeServiceUpdate {
+		return
+	}
+	payload, ok := message.Payload.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if action := payload["action"]; action != "moved_in" && action != "moved_out" {
+		return
+	}
+	if id, ok := payload["id"].(string); ok {
+		h.serviceProjects.Delete(id)
+	}
+}
+
+// RequireServiceProject lets a request through if the caller can see the
+// project of the service named by the :id parameter, and responds 404 as
+// if there were no such service otherwise. Handlers find the project under
+// "project_id".
+func (h *ProjectHandler) RequireServiceProject() gin.HandlerFunc {
+	return h.requireProject("SELECT project_id FROM services WHERE id = $1", "Service")
+}
+
+// RequireDeploymentProject is RequireServiceProject for the deployment
+// named by :id, which belongs to the project of the service it was
+// started from.
+func (h *ProjectHandler) RequireDeploymentProject() gin.HandlerFunc {
+	return h.requireProject(
+		"SELECT s.project_id FROM deployments d JOIN services s ON s.id = d.service_id WHERE d.id = $1",
+		"Deployment",
+	)
+}
+
+func (h *ProjectHandler) requireProject(query, resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+
+		var project string
+		err := h.db.QueryRowContext(ctx, query, c.Param("id")).Scan(&project)
+		if err == sql.ErrNoRows || (err == nil && !canSeeProject(c, project)) {
+			errors.NotFound(c, resource)
+			c.Abort()
+			return
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to get "+resource)
+			c.Abort()
+			return
+		}
+
+		c.Set("project_id", project)
+		c.Next()
+	}
+}
+
+// visibleProjects returns the projects the caller can see, or all when the
+// caller can see every project.
+func visibleProjects(c *gin.Context) (projects []string, all bool) {
+	if callerRole(c) == middleware.RoleAdmin {
+		return nil, true
+	}
+	return append([]string{models.DefaultProjectID}, c.GetStringSlice("projects")...), false
+}
+
+func canSeeProject(c *gin.Context, project string) bool {
+	projects, all := visibleProjects(c)
+	if all {
+		return true
+	}
+	for _, p := range projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// projectFilter returns a condition keeping a query to the caller's
+// projects, whose IDs are in column, and args with the condition's
+// argument added.
+func projectFilter(c *gin.Context, column string, args []interface{}) (string, []interface{}) {
+	projects, all := visibleProjects(c)
+	if all {
+		return "", args
+	}
+	args = append(args, pq.Array(projects))
+	return fmt.Sprintf(" AND %s = ANY($%d)", column, len(args)), args
+}
+
+func validateProjectMember(req models.ProjectMemberRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	if req.SubjectKind != models.SubjectUser && req.SubjectKind != models.SubjectGroup {
+		errs = append(errs, validation.ValidationError{Field: "subject_kind", Message: "subject_kind must be user or group"})
+	}
+	if len(req.Subject) > 255 {
+		errs = append(errs, validation.ValidationError{Field: "subject", Message: "subject must be at most 255 characters"})
+	}
+
+	return errs
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestProjectFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	caller := func(role middleware.Role, projects []string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set("role", role)
+		c.Set("projects", projects)
+		return c
+	}
+
+	viewer := caller(middleware.RoleViewer, []string{"payments"})
+	filter, args := projectFilter(viewer, "project_id", []interface{}{"eu-west-1"})
+	if filter != " AND project_id = ANY($2)" {
+		t.Errorf("filter = %q", filter)
+	}
+	want := []interface{}{"eu-west-1", pq.Array([]string{models.DefaultProjectID, "payments"})}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+	if !canSeeProject(viewer, "payments") || !canSeeProject(viewer, models.DefaultProjectID) || canSeeProject(viewer, "search") {
+		t.Error("a viewer should see the default project and their own only")
+	}
+
+	admin := caller(middleware.RoleAdmin, nil)
+	if filter, args := projectFilter(admin, "project_id", nil); filter != "" || len(args) != 0 {
+		t.Errorf("admins should not be filtered, got %q %v", filter, args)
+	}
+	if !canSeeProject(admin, "search") {
+		t.Error("admins should see every project")
+	}
+
+	// API keys of service accounts in no project
+	apiKey := caller(middleware.RoleOperator, nil)
+	if projects, all := visibleProjects(apiKey); all || !reflect.DeepEqual(projects, []string{models.DefaultProjectID}) {
+		t.Errorf("visibleProjects() = %v, %v", projects, all)
+	}
+}
+
+func TestValidateProjectMember(t *testing.T) {
+	if errs := validateProjectMember(models.ProjectMemberRequest{SubjectKind: "user", Subject: "alice@example.com"}); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if errs := validateProjectMember(models.ProjectMemberRequest{SubjectKind: "team", Subject: "payments"}); len(errs) != 1 || errs[0].Field != "subject_kind" {
+		t.Errorf("errors = %v, want subject_kind", errs)
+	}
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+)
+
+// quotaColumns is the column list scanQuota expects, in order.
+const quotaColumns = "scope_kind, scope, max_services, max_running_services, max_services_per_region, COALESCE(updated_by, ''), updated_at"
+
+// quotaServiceColumn is the services column that places a service within
+// each kind of quota.
+var quotaServiceColumn = map[string]string{
+	models.QuotaProject: "project_id",
+	models.QuotaUser:    "created_by",
+}
+
+// QuotaHandler manages quotas on the services of projects and users, and
+// admits services that stay within them.
+type QuotaHandler struct {
+	db *sql.DB
+}
+
+func NewQuotaHandler(db *sql.DB) *QuotaHandler {
+	return &QuotaHandler{db: db}
+}
+
+func scanQuota(row rowScanner) (models.Quota, error) {
+	var q models.Quota
+	var maxServices, maxRunning, maxPerRegion sql.NullInt64
+	var updatedAt sql.NullTime
+	err := row.Scan(&q.ScopeKind, &q.Scope, &maxServices, &maxRunning, &maxPerRegion, &q.UpdatedBy, &updatedAt)
+	q.MaxServices = nullInt(maxServices)
+	q.MaxRunningServices = nullInt(maxRunning)
+	q.MaxServicesPerRegion = nullInt(maxPerRegion)
+	if updatedAt.Valid {
+		q.UpdatedAt = &updatedAt.Time
+	}
+	return q, err
+}
+
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// GetProjectQuota shows a project's quota and usage to those who can see
+// the project.
+func (h *QuotaHandler) GetProjectQuota(c *gin.Context) {
+	if !canSeeProject(c, c.Param("id")) {
+		errors.NotFound(c, "Project")
+		return
+	}
+	h.getQuota(c, models.QuotaProject, c.Param("id"))
+}
+
+// GetUserQuota shows a user's quota and usage to the user and to admins.
+func (h *QuotaHandler) GetUserQuota(c *gin.Context) {
+	userID := c.Param("user_id")
+	if userID != c.GetString("user_id") && callerRole(c) != "admin" {
+		errors.Forbidden(c, "Only admins can see other users' quotas")
+		return
+	}
+	h.getQuota(c, models.QuotaUser, userID)
+}
+
+func (h *QuotaHandler) getQuota(c *gin.Context, kind, scope string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	q, err := loadQuota(ctx, h.db, kind, scope)
+	if err != nil {
+		errors.InternalError(c, "Failed to get quota")
+		return
+	}
+	usage, err := quotaUsage(ctx, h.db, kind, scope)
+	if err != nil {
+		errors.InternalError(c, "Failed to get quota usage")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.QuotaStatus{Quota: q, Usage: usage})
+}
+
+// PutProjectQuota sets a project's quota.
+func (h *QuotaHandler) PutProjectQuota(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)", c.Param("id")).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Project")
+		return
+	}
+	h.putQuota(ctx, c, models.QuotaProject, c.Param("id"))
+}
+
+// PutUserQuota sets the quota on the services a user creates, in any
+// project.
+func (h *QuotaHandler) PutUserQuota(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	h.putQuota(ctx, c, models.QuotaUser, c.Param("user_id"))
+}
+
+// putQuota replaces a quota's limits. Lowering a limit below current usage
+// refuses new services without affecting existing ones.
+func (h *QuotaHandler) putQuota(ctx context.Context, c *gin.Context, kind, scope string) {
+	var req models.QuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if validationErrs := validateQuota(req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	before, err := loadQuota(ctx, h.db, kind, scope)
+	if err != nil {
+		errors.InternalError(c, "Failed to get quota")
+		return
+	}
+	auditBefore(c, before)
+
+	q, err := scanQuota(h.db.QueryRowContext(ctx,
+		`INSERT INTO quotas (scope_kind, scope, max_services, max_running_services, max_services_per_region, updated_by, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (scope_kind, scope) DO UPDATE SET max_services = $3, max_running_services = $4,
+			max_services_per_region = $5, updated_by = $6, updated_at = $7
+		 RETURNING `+quotaColumns,
+		kind, scope, req.MaxServices, req.MaxRunningServices, req.MaxServicesPerRegion, c.GetString("user_id"), time.Now(),
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to save quota")
+		return
+	}
+	usage, err := quotaUsage(ctx, h.db, kind, scope)
+	if err != nil {
+		errors.InternalError(c, "Failed to get quota usage")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.QuotaStatus{Quota: q, Usage: usage})
+}
+
+// DeleteProjectQuota lifts a project's quota.
+func (h *QuotaHandler) DeleteProjectQuota(c *gin.Context) {
+	h.deleteQuota(c, models.QuotaProject, c.Param("id"))
+}
+
+// DeleteUserQuota lifts a user's quota.
+func (h *QuotaHandler) DeleteUserQuota(c *gin.Context) {
+	h.deleteQuota(c, models.QuotaUser, c.Param("user_id"))
+}
+
+func (h *QuotaHandler) deleteQuota(c *gin.Context, kind, scope string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	q, err := scanQuota(h.db.QueryRowContext(ctx,
+		"DELETE FROM quotas WHERE scope_kind = $1 AND scope = $2 RETURNING "+quotaColumns, kind, scope))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Quota")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete quota")
+		return
+	}
+	auditBefore(c, q)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Quota deleted successfully"})
+}
+
+// admit checks that svc may be created or, when starting, have its
+// desired status set to running without exceeding the quota of its project
+// or of the user who created it. It responds if not. It must run in the
+// transaction making the change, which it locks the quotas for until it
+// ends, so concurrent requests are admitted one at a time.
+func (h *QuotaHandler) admit(ctx context.Context, tx *sql.Tx, c *gin.Context, svc models.Service, creator string, starting bool) bool {
+	scopes := []struct{ kind, scope string }{{models.QuotaProject, svc.ProjectID}}
+	if creator != "" {
+		scopes = append(scopes, struct{ kind, scope string }{models.QuotaUser, creator})
+	}
+
+	for _, s := range scopes {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", "quota:"+s.kind+":"+s.scope); err != nil {
+			errors.InternalError(c, "Failed to lock quota")
+			return false
+		}
+		q, err := loadQuota(ctx, tx, s.kind, s.scope)
+		if err != nil {
+			errors.InternalError(c, "Failed to get quota")
+			return false
+		}
+		if q.MaxServices == nil && q.MaxRunningServices == nil && q.MaxServicesPerRegion == nil {
+			continue
+		}
+		usage, err := quotaUsage(ctx, tx, s.kind, s.scope)
+		if err != nil {
+			errors.InternalError(c, "Failed to get quota usage")
+			return false
+		}
+		if v := quotaViolation(q, usage, svc.Region, starting); v != nil {
+			status := http.StatusForbidden
+			if starting {
+				// Stopping another service makes room
+				status = http.StatusConflict
+			}
+			errors.QuotaExceeded(c, status, quotaMessage(*v), v)
+			return false
+		}
+	}
+	return true
+}
+
+// queryer is a *sql.DB or a *sql.Tx, for queries run in or out of a
+// transaction.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadQuota returns a quota, with no limits when none was set.
+func loadQuota(ctx context.Context, db queryer, kind, scope string) (models.Quota, error) {
+	q, err := scanQuota(db.QueryRowContext(ctx,
+		"SELECT "+quotaColumns+" FROM quotas WHERE scope_kind = $1 AND scope = $2", kind, scope))
+	if err == sql.ErrNoRows {
+		return models.Quota{ScopeKind: kind, Scope: scope}, nil
+	}
+	return q, err
+}
+
+func quotaUsage(ctx context.Context, db queryer, kind, scope string) (models.QuotaUsage, error) {
+	usage := models.QuotaUsage{ServicesByRegion: map[string]int{}}
+	rows, err := db.QueryContext(ctx,
+		`SELECT region, COUNT(*), COUNT(*) FILTER (WHERE desired_status = $2)
+		 FROM services WHERE `+quotaServiceColumn[kind]+` = $1 GROUP BY region`,
+		scope, models.StatusRunning,
+	)
+	if err != nil {
+		return usage, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var region string
+		var services, running int
+		if err := rows.Scan(&region, &services, &running); err != nil {
+			return usage, err
+		}
+		usage.ServicesByRegion[region] = services
+		usage.Services += services
+		usage.RunningServices += running
+	}
+	return usage, rows.Err()
+}
+
+// quotaViolation returns the limit of q that one more service in region
+// would exceed, or, when starting, one more running service.
+func quotaViolation(q models.Quota, usage models.QuotaUsage, region string, starting bool) *models.QuotaViolation {
+	violation := func(limit string, max, used int) *models.QuotaViolation {
+		return &models.QuotaViolation{ScopeKind: q.ScopeKind, Scope: q.Scope, Limit: limit, Max: max, Used: used}
+	}
+
+	if starting {
+		if q.MaxRunningServices != nil && usage.RunningServices+1 > *q.MaxRunningServices {
+			return violation("max_running_services", *q.MaxRunningServices, usage.RunningServices)
+		}
+		return nil
+	}
+	if q.MaxServices != nil && usage.Services+1 > *q.MaxServices {
+		return violation("max_services", *q.MaxServices, usage.Services)
+	}
+	if q.MaxServicesPerRegion != nil && usage.ServicesByRegion[region]+1 > *q.MaxServicesPerRegion {
+		v := violation("max_services_per_region", *q.MaxServicesPerRegion, usage.ServicesByRegion[region])
+		v.Region = region
+		return v
+	}
+	return nil
+}
+
+func quotaMessage(v models.QuotaViolation) string {
+	switch v.Limit {
+	case "max_running_services":
+		return fmt.Sprintf("Quota exceeded: %s %s may run at most %d services", v.ScopeKind, v.Scope, v.Max)
+	case "max_services_per_region":
+		return fmt.Sprintf("Quota exceeded: %s %s may have at most %d services in %s", v.ScopeKind, v.Scope, v.Max, v.Region)
+	default:
+		return fmt.Sprintf("Quota exceeded: %s %s may have at most %d services", v.ScopeKind, v.Scope, v.Max)
+	}
+}
+
+func validateQuota(req models.QuotaRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	for _, limit := range []struct {
+		field string
+		value *int
+	}{
+		{"max_services", req.MaxServices},
+		{"max_running_services", req.MaxRunningServices},
+		{"max_services_per_region", req.MaxServicesPerRegion},
+	} {
+		if limit.value != nil && *limit.value < 0 {
+			errs = append(errs, validation.ValidationError{Field: limit.field, Message: limit.field + " must not be negative"})
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestQuotaViolation(t *testing.T) {
+	limit := func(n int) *int { return &n }
+	quota := models.Quota{
+		ScopeKind:            models.QuotaProject,
+		Scope:                "payments",
+		MaxServices:          limit(3),
+		MaxRunningServices:   limit(2),
+		MaxServicesPerRegion: limit(2),
+	}
+
+	tests := []struct {
+		name      string
+		quota     models.Quota
+		usage     models.QuotaUsage
+		region    string
+		starting  bool
+		wantLimit string
+	}{
+		{"no limits", models.Quota{}, models.QuotaUsage{Services: 50, RunningServices: 50}, "us-east-1", false, ""},
+		{"room to create", quota, models.QuotaUsage{Services: 2, ServicesByRegion: map[string]int{"us-east-1": 1}}, "us-east-1", false, ""},
+		{"too many services", quota, models.QuotaUsage{Services: 3}, "us-east-1", false, "max_services"},
+		{"full region", quota, models.QuotaUsage{Services: 2, ServicesByRegion: map[string]int{"us-east-1": 2}}, "us-east-1", false, "max_services_per_region"},
+		{"another region", quota, models.QuotaUsage{Services: 2, ServicesByRegion: map[string]int{"us-east-1": 2}}, "eu-west-1", false, ""},
+		{"creating ignores running", quota, models.QuotaUsage{Services: 2, RunningServices: 2}, "us-east-1", false, ""},
+		{"room to start", quota, models.QuotaUsage{Services: 3, RunningServices: 1}, "us-east-1", true, ""},
+		{"too many running", quota, models.QuotaUsage{Services: 3, RunningServices: 2}, "us-east-1", true, "max_running_services"},
+		{"zero allows none", models.Quota{MaxServices: limit(0)}, models.QuotaUsage{}, "us-east-1", false, "max_services"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quotaViolation(tt.quota, tt.usage, tt.region, tt.starting)
+			if tt.wantLimit == "" {
+				if got != nil {
+					t.Errorf("quotaViolation() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Limit != tt.wantLimit {
+				t.Fatalf("quotaViolation() = %+v, want limit %s", got, tt.wantLimit)
+			}
+			if got.Scope != tt.quota.Scope {
+				t.Errorf("scope = %q, want %q", got.Scope, tt.quota.Scope)
+			}
+		})
+	}
+
+	v := quotaViolation(quota, models.QuotaUsage{Services: 2, ServicesByRegion: map[string]int{"us-east-1": 2}}, "us-east-1", false)
+	if v.Region != "us-east-1" || v.Max != 2 || v.Used != 2 {
+		t.Errorf("unexpected region violation: %+v", v)
+	}
+	if got, want := quotaMessage(*v), "Quota exceeded: project payments may have at most 2 services in us-east-1"; got != want {
+		t.Errorf("quotaMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateQuota(t *testing.T) {
+	limit := func(n int) *int { return &n }
+
+	if errs := validateQuota(models.QuotaRequest{MaxServices: limit(0), MaxRunningServices: limit(5)}); len(errs) != 0 {
+		t.Errorf("validateQuota() = %v, want no errors", errs)
+	}
+	errs := validateQuota(models.QuotaRequest{MaxServices: limit(-1), MaxServicesPerRegion: limit(-2)})
+	if len(errs) != 2 || errs[0].Field != "max_services" || errs[1].Field != "max_services_per_region" {
+		t.Errorf("validateQuota() = %v, want errors on max_services and max_services_per_region", errs)
+	}
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const revisionColumns = "id, service_id, revision, image, version, config, COALESCE(config_version, 0), reason, COALESCE(created_by, ''), created_at"
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func scanRevision(row rowScanner) (models.ServiceRevision, error) {
+	var r models.ServiceRevision
+	var config []byte
+	err := row.Scan(&r.ID, &r.ServiceID, &r.Revision, &r.Image, &r.Version, &config, &r.ConfigVersion, &r.Reason, &r.CreatedBy, &r.CreatedAt)
+	if len(config) > 0 {
+		r.Config = config
+	}
+	return r, err
+}
+
+// recordRevision snapshots the service's current image, version and latest
+// config as its next revision.
+func recordRevision(ctx context.Context, db queryRower, serviceID, reason, createdBy string) (models.ServiceRevision, error) {
+	return scanRevision(db.QueryRowContext(ctx,
+		`INSERT INTO service_revisions (id, service_id, revision, image, version, config, config_version, reason, created_by, created_at)
+		 SELECT $1, s.id, COALESCE((SELECT MAX(revision) FROM service_revisions WHERE service_id = s.id), 0) + 1,
+		        s.image, s.version, c.config, c.version, $2, $3, $4
+		 FROM services s
+		 LEFT JOIN LATERAL (SELECT config, version FROM service_configs WHERE service_id = s.id ORDER BY version DESC LIMIT 1) c ON TRUE
+		 WHERE s.id = $5
+		 RETURNING `+revisionColumns,
+		uuid.New().String(), reason, createdBy, time.Now(), serviceID,
+	))
+}
+
+func (h *ServiceHandler) ListRevisions(c *gin.Context) {
+	id := c.Param("id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM services WHERE id = $1)", id).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Service")
+		return
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+revisionColumns+" FROM service_revisions WHERE service_id = $1 ORDER BY revision DESC LIMIT 100",
+		id,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to query revisions")
+		return
+	}
+	defer rows.Close()
+
+	revisions := []models.ServiceRevision{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan revision")
+			return
+		}
+		revisions = append(revisions, r)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+// RollbackService restores the image, version and config of an earlier
+// revision. The rollback is itself recorded as a new revision, so history is
+// never rewritten.
+func (h *ServiceHandler) RollbackService(c *gin.Context) {
+	id := c.Param("id")
+	user := c.GetString("user_id")
+
+	var req models.RollbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to roll back service")
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := scanService(tx.QueryRowContext(ctx, "SELECT "+serviceColumns+" FROM services WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+	auditBefore(c, current)
+
+	target, err := scanRevision(tx.QueryRowContext(ctx,
+		"SELECT "+revisionColumns+" FROM service_revisions WHERE service_id = $1 AND revision = $2",
+		id, req.Revision,
+	))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Revision")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get revision")
+		return
+	}
+
+	// The lock keeps a deployment from being created until the rollback
+	// commits
+	if err := lockDeployments(ctx, tx, current.ProjectID, current.Name); err != nil {
+		errors.InternalError(c, "Failed to lock deployments")
+		return
+	}
+	deploying, err := hasActiveDeployment(ctx, tx, current.ProjectID, current.Name)
+	if err != nil {
+		errors.InternalError(c, "Failed to check active deployments")
+		return
+	}
+	if deploying {
+		errors.Conflict(c, "A deployment is in progress for this service")
+		return
+	}
+
+	// Config versions are append-only too: an older config comes back as a
+	// new version with the same content.
+	var latestConfig []byte
+	err = tx.QueryRowContext(ctx,
+		"SELECT config FROM service_configs WHERE service_id = $1 ORDER BY version DESC LIMIT 1", id,
+	).Scan(&latestConfig)
+	if err != nil && err != sql.ErrNoRows {
+		errors.InternalError(c, "Failed to get service config")
+		return
+	}
+	configChanged := target.Config != nil && !bytes.Equal(compactJSON(latestConfig), compactJSON(target.Config))
+
+	if target.Image == current.Image && target.Version == current.Version && !configChanged {
+		errors.BadRequest(c, fmt.Sprintf("Service already matches revision %d", target.Revision), nil)
+		return
+	}
+
+	service, err := scanService(tx.QueryRowContext(ctx,
+		"UPDATE services SET image = $1, version = $2, updated_at = $3 WHERE id = $4 RETURNING "+serviceColumns,
+		target.Image, target.Version, time.Now(), id,
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to roll back service")
+		return
+	}
+
+	var restored *models.ServiceConfig
+	if configChanged {
+		cfg, err := scanConfig(tx.QueryRowContext(ctx,
+			`INSERT INTO service_configs (id, service_id, config, version, created_at, created_by)
+			 SELECT $1, $2, $3, COALESCE(MAX(version), 0) + 1, $4, $5 FROM service_configs WHERE service_id = $2
+			 RETURNING `+configColumns,
+			uuid.New().String(), id, []byte(target.Config), time.Now(), user,
+		))
+		if err != nil {
+			errors.InternalError(c, "Failed to restore service config")
+			return
+		}
+		restored = &cfg
+	}
+
+	revision, err := recordRevision(ctx, tx, id, fmt.Sprintf("rollback to revision %d", target.Revision), user)
+	if err != nil {
+		errors.InternalError(c, "Failed to record revision")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to roll back service")
+		return
+	}
+
+	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, service)
+	if restored != nil {
+		h.hub.BroadcastJSON(websocket.MessageTypeConfigUpdate, restored)
+	}
+	h.createDeploymentLog(id, "rollback", "success",
+		fmt.Sprintf("Rolled back to revision %d (%s:%s)", target.Revision, target.Image, target.Version))
+	h.assignments.ServiceChanged(ctx, id)
+
+	c.JSON(http.StatusOK, gin.H{"service": service, "revision": revision})
+}
+
+// compactJSON normalises whitespace so stored JSONB and raw JSON compare equal.
+func compactJSON(data []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+)
+
+// RoleBindingHandler manages role bindings and decides what callers may do
+// to individual services: the role in their token, raised by any bindings
+// for them or their groups whose scope covers the service. Bindings only
+// ever add to a caller's role.
+type RoleBindingHandler struct {
+	db *sql.DB
+}
+
+func NewRoleBindingHandler(db *sql.DB) *RoleBindingHandler {
+	return &RoleBindingHandler{db: db}
+}
+
+// roleBindingColumns is the column list scanRoleBinding expects, in order.
+const roleBindingColumns = "id, subject_kind, subject, role, COALESCE(service_id, ''), region, selector, COALESCE(created_by, ''), created_at"
+
+func scanRoleBinding(row rowScanner) (models.RoleBinding, error) {
+	var b models.RoleBinding
+	var selector []byte
+	if err := row.Scan(&b.ID, &b.SubjectKind, &b.Subject, &b.Role, &b.ServiceID, &b.Region, &selector, &b.CreatedBy, &b.CreatedAt); err != nil {
+		return b, err
+	}
+	err := json.Unmarshal(selector, &b.Selector)
+	return b, err
+}
+
+// ListRoleBindings lists bindings, optionally filtered by ?subject_kind=,
+// ?subject= and ?service_id=.
+func (h *RoleBindingHandler) ListRoleBindings(c *gin.Context) {
+	query := "SELECT " + roleBindingColumns + " FROM role_bindings WHERE 1=1"
+	args := []interface{}{}
+	for _, filter := range []string{"subject_kind", "subject", "service_id"} {
+		if value := c.Query(filter); value != "" {
+			args = append(args, value)
+			query += fmt.Sprintf(" AND %s = $%d", filter, len(args))
+		}
+	}
+	query += " ORDER BY subject_kind, subject, created_at"
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query role bindings")
+		return
+	}
+	defer rows.Close()
+
+	bindings := []models.RoleBinding{}
+	for rows.Next() {
+		b, err := scanRoleBinding(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan role binding")
+			return
+		}
+		bindings = append(bindings, b)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"role_bindings": bindings})
+}
+
+func (h *RoleBindingHandler) GetRoleBinding(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	b, err := scanRoleBinding(h.db.QueryRowContext(ctx, "SELECT "+roleBindingColumns+" FROM role_bindings WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Role binding")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get role binding")
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func (h *RoleBindingHandler) CreateRoleBinding(c *gin.Context) {
+	var req models.RoleBindingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if validationErrs := validateRoleBinding(req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+	if req.Selector == nil {
+		req.Selector = map[string]string{}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var serviceID interface{}
+	if req.ServiceID != "" {
+		var exists bool
+		if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM services WHERE id = $1)", req.ServiceID).Scan(&exists); err != nil {
+			errors.InternalError(c, "Failed to get service")
+			return
+		}
+		if !exists {
+			errors.NotFound(c, "Service")
+			return
+		}
+		serviceID = req.ServiceID
+	}
+
+	selector, _ := json.Marshal(req.Selector)
+	b, err := scanRoleBinding(h.db.QueryRowContext(ctx,
+		`INSERT INTO role_bindings (id, subject_kind, subject, role, service_id, region, selector, created_by, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 RETURNING `+roleBindingColumns,
+		uuid.New().String(), req.SubjectKind, req.Subject, req.Role, serviceID, req.Region, selector, c.GetString("user_id"), time.Now(),
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to create role binding")
+		return
+	}
+
+	c.JSON(http.StatusCreated, b)
+}
+
+func (h *RoleBindingHandler) DeleteRoleBinding(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	binding, err := scanRoleBinding(h.db.QueryRowContext(ctx, "DELETE FROM role_bindings WHERE id = $1 RETURNING "+roleBindingColumns, c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Role binding")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete role binding")
+		return
+	}
+	auditBefore(c, binding)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role binding deleted successfully"})
+}
+
+// CanI tells callers whether they hold ?role= on a service, named by
+// ?service_id=, or on a service they would create with ?region= and
+// ?labels=key=value,...
+func (h *RoleBindingHandler) CanI(c *gin.Context) {
+	role := middleware.Role(c.Query("role"))
+	if roleRank[role] == 0 {
+		errors.BadRequest(c, "role must be viewer, operator or admin", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var svc models.Service
+	if id := c.Query("service_id"); id != "" {
+		var err error
+		svc, err = h.serviceScope(ctx, id)
+		if err == sql.ErrNoRows || (err == nil && !canSeeProject(c, svc.ProjectID)) {
+			errors.NotFound(c, "Service")
+			return
+		}
+		if err != nil {
+			errors.InternalError(c, "Failed to get service")
+			return
+		}
+	} else {
+		labels, err := parseSelector(c.Query("labels"))
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+		svc = models.Service{Region: c.Query("region"), Labels: labels}
+	}
+
+	bindings, err := h.bindingsFor(ctx, c)
+	if err != nil {
+		errors.InternalError(c, "Failed to query role bindings")
+		return
+	}
+	effective := effectiveRole(callerRole(c), bindings, svc)
+	granting := []string{}
+	for _, b := range bindings {
+		if bindingCovers(b, svc) {
+			granting = append(granting, b.ID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"allowed":  roleRank[effective] >= roleRank[role],
+		"role":     effective,
+		"bindings": granting,
+	})
+}
+
+// RequireServiceRole lets a request through if the caller holds role on the
+// service named by the :id parameter.
+func (h *RoleBindingHandler) RequireServiceRole(role middleware.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+
+		if !h.authorizeService(ctx, c, role, c.Param("id")) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorizeService is authorize for a service known by ID. It responds
+// 404 if there is no such service.
+func (h *RoleBindingHandler) authorizeService(ctx context.Context, c *gin.Context, role middleware.Role, id string) bool {
+	if roleRank[callerRole(c)] >= roleRank[role] {
+		return true
+	}
+	svc, err := h.serviceScope(ctx, id)
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return false
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return false
+	}
+	return h.authorize(ctx, c, role, svc)
+}
+
+// authorize reports whether the caller holds role on every one of
+// services, responding 403 if not. Only ID, Name, Region and Labels of the
+// services are looked at.
+func (h *RoleBindingHandler) authorize(ctx context.Context, c *gin.Context, role middleware.Role, services ...models.Service) bool {
+	own := callerRole(c)
+	if roleRank[own] >= roleRank[role] {
+		return true
+	}
+
+	bindings, err := h.bindingsFor(ctx, c)
+	if err != nil {
+		errors.InternalError(c, "Failed to query role bindings")
+		return false
+	}
+	for _, svc := range services {
+		if roleRank[effectiveRole(own, bindings, svc)] < roleRank[role] {
+			name := svc.Name
+			if name == "" {
+				name = svc.ID
+			}
+			errors.Forbidden(c, fmt.Sprintf("Insufficient permissions: %s role required on service %s in %s", role, name, svc.Region))
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeRelabel reports whether the caller may replace the labels of
+// svc with labels, responding 403 if not. The caller needs operator on the
+// relabelled service, and relabelling must not raise their role on it: a
+// label a binding selects on could otherwise grant the caller admin.
+func (h *RoleBindingHandler) authorizeRelabel(ctx context.Context, c *gin.Context, svc models.Service, labels map[string]string) bool {
+	own := callerRole(c)
+	if roleRank[own] >= roleRank[middleware.RoleAdmin] {
+		return true
+	}
+
+	bindings, err := h.bindingsFor(ctx, c)
+	if err != nil {
+		errors.InternalError(c, "Failed to query role bindings")
+		return false
+	}
+	relabelled := svc
+	relabelled.Labels = labels
+	if roleRank[effectiveRole(own, bindings, relabelled)] < roleRank[middleware.RoleOperator] {
+		errors.Forbidden(c, fmt.Sprintf("Insufficient permissions: %s role required on service %s in %s", middleware.RoleOperator, svc.Name, svc.Region))
+		return false
+	}
+	if relabelEscalates(own, bindings, svc, relabelled) {
+		errors.Forbidden(c, fmt.Sprintf("Insufficient permissions: these labels would raise your role on service %s to %s", svc.Name, effectiveRole(own, bindings, relabelled)))
+		return false
+	}
+	return true
+}
+
+// serviceScope loads what role bindings match a service on.
+func (h *RoleBindingHandler) serviceScope(ctx context.Context, id string) (models.Service, error) {
+	var svc models.Service
+	var labels []byte
+	err := h.db.QueryRowContext(ctx, "SELECT id, project_id, name, region, labels FROM services WHERE id = $1", id).
+		Scan(&svc.ID, &svc.ProjectID, &svc.Name, &svc.Region, &labels)
+	if err != nil {
+		return svc, err
+	}
+	err = json.Unmarshal(labels, &svc.Labels)
+	return svc, err
+}
+
+// bindingsFor returns the bindings for the caller and the caller's groups.
+func (h *RoleBindingHandler) bindingsFor(ctx context.Context, c *gin.Context) ([]models.RoleBinding, error) {
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+roleBindingColumns+` FROM role_bindings
+		 WHERE (subject_kind = $1 AND subject = $2) OR (subject_kind = $3 AND subject = ANY($4))`,
+		models.SubjectUser, c.GetString("user_id"), models.SubjectGroup, pq.Array(c.GetStringSlice("groups")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bindings []models.RoleBinding
+	for rows.Next() {
+		b, err := scanRoleBinding(rows)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, rows.Err()
+}
+
+func callerRole(c *gin.Context) middleware.Role {
+	role, _ := c.Get("role")
+	r, _ := role.(middleware.Role)
+	return r
+}
+
+// bindingCovers reports whether a binding's scope includes svc.
+func bindingCovers(b models.RoleBinding, svc models.Service) bool {
+	if b.ServiceID != "" {
+		return b.ServiceID == svc.ID
+	}
+	if b.Region != "" && b.Region != svc.Region {
+		return false
+	}
+	for key, value := range b.Selector {
+		if got, ok := svc.Labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// effectiveRole returns the highest of role and the roles of the bindings
+// covering svc.
+func effectiveRole(role middleware.Role, bindings []models.RoleBinding, svc models.Service) middleware.Role {
+	best := role
+	for _, b := range bindings {
+		if r := middleware.Role(b.Role); roleRank[r] > roleRank[best] && bindingCovers(b, svc) {
+			best = r
+		}
+	}
+	return best
+}
+
+// relabelEscalates reports whether bindings give role a higher effective
+// role on relabelled than on svc, the same service with its current labels.
+func relabelEscalates(role middleware.Role, bindings []models.RoleBinding, svc, relabelled models.Service) bool {
+	return roleRank[effectiveRole(role, bindings, relabelled)] > roleRank[effectiveRole(role, bindings, svc)]
+}
+
+// parseSelector parses "key=value,key=value".
+func parseSelector(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := validation.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func validateRoleBinding(req models.RoleBindingRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	if req.SubjectKind != models.SubjectUser && req.SubjectKind != models.SubjectGroup {
+		errs = append(errs, validation.ValidationError{Field: "subject_kind", Message: "subject_kind must be user or group"})
+	}
+	if len(req.Subject) > 255 {
+		errs = append(errs, validation.ValidationError{Field: "subject", Message: "subject must be at most 255 characters"})
+	}
+	if roleRank[middleware.Role(req.Role)] == 0 {
+		errs = append(errs, validation.ValidationError{Field: "role", Message: "role must be viewer, operator or admin"})
+	}
+	if req.ServiceID != "" && (req.Region != "" || len(req.Selector) > 0) {
+		errs = append(errs, validation.ValidationError{Field: "service_id", Message: "service_id cannot be combined with region or selector"})
+	}
+	if req.Region != "" {
+		if err := validation.ValidateRegion(req.Region); err != nil {
+			errs = append(errs, err.(validation.ValidationError))
+		}
+	}
+	if err := validation.ValidateLabels(req.Selector); err != nil {
+		verr := err.(validation.ValidationError)
+		verr.Field = "selector"
+		errs = append(errs, verr)
+	}
+
+	return errs
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestBindingCovers(t *testing.T) {
+	payments := models.Service{ID: "svc-1", Region: "eu-west-1", Labels: map[string]string{"team": "payments", "tier": "web"}}
+
+	tests := []struct {
+		name    string
+		binding models.RoleBinding
+		want    bool
+	}{
+		{"everything", models.RoleBinding{}, true},
+		{"same service", models.RoleBinding{ServiceID: "svc-1"}, true},
+		{"other service", models.RoleBinding{ServiceID: "svc-2"}, false},
+		{"same region", models.RoleBinding{Region: "eu-west-1"}, true},
+		{"other region", models.RoleBinding{Region: "us-east-1"}, false},
+		{"matching selector", models.RoleBinding{Selector: map[string]string{"team": "payments"}}, true},
+		{"selector and region", models.RoleBinding{Region: "eu-west-1", Selector: map[string]string{"team": "payments", "tier": "web"}}, true},
+		{"selector value differs", models.RoleBinding{Selector: map[string]string{"team": "search"}}, false},
+		{"selector label missing", models.RoleBinding{Selector: map[string]string{"owner": ""}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bindingCovers(tt.binding, payments); got != tt.want {
+				t.Errorf("bindingCovers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if bindingCovers(models.RoleBinding{ServiceID: "svc-1"}, models.Service{Region: "eu-west-1"}) {
+		t.Error("a service binding should not cover a service that does not exist yet")
+	}
+}
+
+func TestEffectiveRole(t *testing.T) {
+	bindings := []models.RoleBinding{
+		{Role: "operator", Region: "eu-west-1", Selector: map[string]string{"team": "payments"}},
+		{Role: "admin", ServiceID: "svc-1"},
+		{Role: "viewer"},
+	}
+
+	tests := []struct {
+		name string
+		role middleware.Role
+		svc  models.Service
+		want middleware.Role
+	}{
+		{"raised by selector", middleware.RoleViewer, models.Service{ID: "svc-2", Region: "eu-west-1", Labels: map[string]string{"team": "payments"}}, middleware.RoleOperator},
+		{"highest binding wins", middleware.RoleViewer, models.Service{ID: "svc-1", Region: "eu-west-1", Labels: map[string]string{"team": "payments"}}, middleware.RoleAdmin},
+		{"no binding applies", middleware.RoleViewer, models.Service{ID: "svc-3", Region: "us-east-1"}, middleware.RoleViewer},
+		{"bindings never lower a role", middleware.RoleAdmin, models.Service{ID: "svc-3"}, middleware.RoleAdmin},
+		{"no role of its own", "", models.Service{ID: "svc-3"}, middleware.RoleViewer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := effectiveRole(tt.role, bindings, tt.svc); got != tt.want {
+				t.Errorf("effectiveRole() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelabelEscalates(t *testing.T) {
+	bindings := []models.RoleBinding{
+		{Role: "operator", Selector: map[string]string{"team": "payments"}},
+		{Role: "admin", Selector: map[string]string{"team": "payments", "owner": "alice"}},
+	}
+	svc := models.Service{ID: "svc-1", Region: "eu-west-1", Labels: map[string]string{"team": "payments"}}
+	relabel := func(labels map[string]string) models.Service {
+		s := svc
+		s.Labels = labels
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		role   middleware.Role
+		labels map[string]string
+		want   bool
+	}{
+		{"same role", middleware.RoleViewer, map[string]string{"team": "payments", "tier": "web"}, false},
+		{"into an admin binding", middleware.RoleViewer, map[string]string{"team": "payments", "owner": "alice"}, true},
+		{"out of every binding", middleware.RoleViewer, map[string]string{}, false},
+		{"own role already as high", middleware.RoleAdmin, map[string]string{"team": "payments", "owner": "alice"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relabelEscalates(tt.role, bindings, svc, relabel(tt.labels)); got != tt.want {
+				t.Errorf("relabelEscalates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	labels, err := parseSelector(" team=payments, tier = web ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 2 || labels["team"] != "payments" || labels["tier"] != "web" {
+		t.Errorf("parseSelector() = %v", labels)
+	}
+
+	for _, bad := range []string{"team", "=payments", "Team Name=payments"} {
+		if _, err := parseSelector(bad); err == nil {
+			t.Errorf("parseSelector(%q) should fail", bad)
+		}
+	}
+}
+
+func TestValidateRoleBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     models.RoleBindingRequest
+		wantErr bool
+	}{
+		{"group on labelled services", models.RoleBindingRequest{SubjectKind: "group", Subject: "team-payments", Role: "operator", Region: "eu-west-1", Selector: map[string]string{"team": "payments"}}, false},
+		{"user on one service", models.RoleBindingRequest{SubjectKind: "user", Subject: "alice@example.com", Role: "admin", ServiceID: "svc-1"}, false},
+		{"unknown subject kind", models.RoleBindingRequest{SubjectKind: "team", Subject: "payments", Role: "operator"}, true},
+		{"unknown role", models.RoleBindingRequest{SubjectKind: "user", Subject: "alice", Role: "owner"}, true},
+		{"service with selector", models.RoleBindingRequest{SubjectKind: "user", Subject: "alice", Role: "operator", ServiceID: "svc-1", Selector: map[string]string{"team": "payments"}}, true},
+		{"invalid region", models.RoleBindingRequest{SubjectKind: "user", Subject: "alice", Role: "operator", Region: "mars-1"}, true},
+		{"invalid selector", models.RoleBindingRequest{SubjectKind: "user", Subject: "alice", Role: "operator", Selector: map[string]string{"bad key": "x"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateRoleBinding(tt.req)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateRoleBinding() = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
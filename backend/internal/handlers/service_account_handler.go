@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+)
+
+const (
+	maxAPIKeyDays         = 3650
+	maxRotationGrace      = 7 * 24 * 3600 // seconds
+	apiKeyDisplayLength   = 8             // characters of the key after APIKeyPrefix kept as its prefix
+	apiKeyLastUsedEvery   = time.Minute   // last_used_at is only written this often per key
+	serviceAccountSubject = "service-account:"
+)
+
+// ServiceAccountHandler manages service accounts and their API keys, and
+// validates API keys for the auth middleware.
+type ServiceAccountHandler struct {
+	db *sql.DB
+}
+
+func NewServiceAccountHandler(db *sql.DB) *ServiceAccountHandler {
+	return &ServiceAccountHandler{db: db}
+}
+
+// serviceAccountColumns is the column list scanServiceAccount expects, in order.
+const serviceAccountColumns = "id, name, description, role, COALESCE(created_by, ''), created_at"
+
+func scanServiceAccount(row rowScanner) (models.ServiceAccount, error) {
+	var a models.ServiceAccount
+	err := row.Scan(&a.ID, &a.Name, &a.Description, &a.Role, &a.CreatedBy, &a.CreatedAt)
+	return a, err
+}
+
+// apiKeyColumns is the column list scanAPIKey expects, in order.
+const apiKeyColumns = "id, service_account_id, name, prefix, expires_at, last_used_at, revoked_at, COALESCE(created_by, ''), created_at"
+
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	var k models.APIKey
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.ServiceAccountID, &k.Name, &k.Prefix, &expiresAt, &lastUsedAt, &revokedAt, &k.CreatedBy, &k.CreatedAt)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, err
+}
+
+func (h *ServiceAccountHandler) ListServiceAccounts(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, "SELECT "+serviceAccountColumns+" FROM service_accounts ORDER BY name")
+	if err != nil {
+		errors.InternalError(c, "Failed to query service accounts")
+		return
+	}
+	defer rows.Close()
+
+	accounts := []models.ServiceAccount{}
+	for rows.Next() {
+		a, err := scanServiceAccount(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan service account")
+			return
+		}
+		accounts = append(accounts, a)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+}
+
+func (h *ServiceAccountHandler) GetServiceAccount(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	a, err := scanServiceAccount(h.db.QueryRowContext(ctx, "SELECT "+serviceAccountColumns+" FROM service_accounts WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service account")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service account")
+		return
+	}
+
+	c.JSON(http.StatusOK, a)
+}
+
+func (h *ServiceAccountHandler) CreateServiceAccount(c *gin.Context) {
+	var req models.ServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if validationErrs := validateServiceAccount(req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	a, err := scanServiceAccount(h.db.QueryRowContext(ctx,
+		`INSERT INTO service_accounts (id, name, description, role, created_by, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (name) DO NOTHING
+		 RETURNING `+serviceAccountColumns,
+		uuid.New().String(), req.Name, req.Description, req.Role, c.GetString("user_id"), time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.Conflict(c, "A service account with this name already exists")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to create service account")
+		return
+	}
+
+	c.JSON(http.StatusCreated, a)
+}
+
+// DeleteServiceAccount deletes a service account together with its keys.
+func (h *ServiceAccountHandler) DeleteServiceAccount(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	a, err := scanServiceAccount(h.db.QueryRowContext(ctx, "DELETE FROM service_accounts WHERE id = $1 RETURNING "+serviceAccountColumns, c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service account")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete service account")
+		return
+	}
+	auditBefore(c, a)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deleted successfully"})
+}
+
+func validateServiceAccount(req models.ServiceAccountRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	if err := validation.ValidateServiceName(req.Name); err != nil {
+		errs = append(errs, err.(validation.ValidationError))
+	}
+	switch middleware.Role(req.Role) {
+	case middleware.RoleViewer, middleware.RoleOperator, middleware.RoleAdmin:
+	default:
+		errs = append(errs, validation.ValidationError{Field: "role", Message: "role must be viewer, operator or admin"})
+	}
+	if len(req.Description) > 500 {
+		errs = append(errs, validation.ValidationError{Field: "description", Message: "description must be at most 500 characters"})
+	}
+
+	return errs
+}
+
+// ListAPIKeys lists a service account's keys, including expired and revoked
+// ones.
+func (h *ServiceAccountHandler) ListAPIKeys(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if !h.serviceAccountExists(ctx, c) {
+		return
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE service_account_id = $1 ORDER BY created_at DESC", c.Param("id"))
+	if err != nil {
+		errors.InternalError(c, "Failed to query API keys")
+		return
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan API key")
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// CreateAPIKey issues a key for a service account. The key is only returned
+// here.
+func (h *ServiceAccountHandler) CreateAPIKey(c *gin.Context) {
+	var req models.APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return
+	}
+	if validationErrs := validateAPIKey(req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if !h.serviceAccountExists(ctx, c) {
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	resp, err := issueAPIKey(ctx, h.db, c.Param("id"), req.Name, expiresAt, c.GetString("user_id"))
+	if err != nil {
+		errors.InternalError(c, "Failed to create API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// RotateAPIKey issues a replacement for a key, with the same name and
+// lifetime, and retires the old one after the requested grace period.
+func (h *ServiceAccountHandler) RotateAPIKey(c *gin.Context) {
+	var req models.RotateAPIKeyRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errors.BadRequest(c, "Invalid request body", err.Error())
+			return
+		}
+	}
+	if err := validation.ValidateSeconds("grace_seconds", req.GraceSeconds, maxRotationGrace); err != nil {
+		errors.BadRequest(c, "Validation failed", validation.ValidationErrors{err.(validation.ValidationError)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to rotate API key")
+		return
+	}
+	defer tx.Rollback()
+
+	old, err := scanAPIKey(tx.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1 FOR UPDATE", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "API key")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get API key")
+		return
+	}
+
+	now := time.Now()
+	if !apiKeyActive(old, now) {
+		errors.Conflict(c, "API key is expired or revoked")
+		return
+	}
+
+	var expiresAt *time.Time
+	if old.ExpiresAt != nil {
+		t := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+		expiresAt = &t
+	}
+	resp, err := issueAPIKey(ctx, tx, old.ServiceAccountID, old.Name, expiresAt, c.GetString("user_id"))
+	if err != nil {
+		errors.InternalError(c, "Failed to rotate API key")
+		return
+	}
+
+	if req.GraceSeconds == 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE api_keys SET revoked_at = $2 WHERE id = $1", old.ID, now)
+	} else {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE api_keys SET expires_at = LEAST(COALESCE(expires_at, $2), $2) WHERE id = $1",
+			old.ID, now.Add(time.Duration(req.GraceSeconds)*time.Second))
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to retire old API key")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to rotate API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// RevokeAPIKey revokes a key immediately. Revoked keys are kept for the
+// record.
+func (h *ServiceAccountHandler) RevokeAPIKey(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	k, err := scanAPIKey(h.db.QueryRowContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1 RETURNING "+apiKeyColumns,
+		c.Param("id"), time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "API key")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to revoke API key")
+		return
+	}
+
+	c.JSON(http.StatusOK, k)
+}
+
+func validateAPIKey(req models.APIKeyRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	if len(req.Name) > 100 {
+		errs = append(errs, validation.ValidationError{Field: "name", Message: "name must be at most 100 characters"})
+	}
+	if req.ExpiresInDays != nil && (*req.ExpiresInDays < 1 || *req.ExpiresInDays > maxAPIKeyDays) {
+		errs = append(errs, validation.ValidationError{Field: "expires_in_days", Message: "expires_in_days must be between 1 and 3650"})
+	}
+
+	return errs
+}
+
+func issueAPIKey(ctx context.Context, q queryRower, accountID, name string, expiresAt *time.Time, createdBy string) (models.CreateAPIKeyResponse, error) {
+	token, err := newNodeToken()
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, err
+	}
+	key := middleware.APIKeyPrefix + token
+
+	k, err := scanAPIKey(q.QueryRowContext(ctx,
+		`INSERT INTO api_keys (id, service_account_id, name, prefix, key_hash, expires_at, created_by, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING `+apiKeyColumns,
+		uuid.New().String(), accountID, name, key[:len(middleware.APIKeyPrefix)+apiKeyDisplayLength], hashNodeToken(key),
+		expiresAt, createdBy, time.Now(),
+	))
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, err
+	}
+	return models.CreateAPIKeyResponse{APIKey: k, Key: key}, nil
+}
+
+func (h *ServiceAccountHandler) serviceAccountExists(ctx context.Context, c *gin.Context) bool {
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM service_accounts WHERE id = $1)", c.Param("id")).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get service account")
+		return false
+	}
+	if !exists {
+		errors.NotFound(c, "Service account")
+		return false
+	}
+	return true
+}
+
+// ValidateAPIKey implements middleware.APIKeyValidator. A key authenticates
+// as its service account, with the account's role.
+func (h *ServiceAccountHandler) ValidateAPIKey(ctx context.Context, key string) (*middleware.Claims, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var k models.APIKey
+	var role string
+	var expiresAt, revokedAt sql.NullTime
+	err := h.db.QueryRowContext(ctx,
+		`SELECT k.id, k.service_account_id, k.expires_at, k.revoked_at, a.role
+		 FROM api_keys k JOIN service_accounts a ON a.id = k.service_account_id
+		 WHERE k.key_hash = $1`,
+		hashNodeToken(key),
+	).Scan(&k.ID, &k.ServiceAccountID, &expiresAt, &revokedAt, &role)
+	if err == sql.ErrNoRows {
+		return nil, middleware.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+
+	now := time.Now()
+	if !apiKeyActive(k, now) {
+		return nil, middleware.ErrInvalidAPIKey
+	}
+
+	if _, err := h.db.ExecContext(ctx,
+		"UPDATE api_keys SET last_used_at = $2 WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $3)",
+		k.ID, now, now.Add(-apiKeyLastUsedEvery),
+	); err != nil {
+		log.Printf("Failed to record API key use: %v", err)
+	}
+
+	return &middleware.Claims{UserID: serviceAccountSubject + k.ServiceAccountID, Role: middleware.Role(role)}, nil
+}
+
+// apiKeyActive reports whether a key is neither revoked nor expired at now.
+func apiKeyActive(k models.APIKey, now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestAPIKeyActive(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		key  models.APIKey
+		want bool
+	}{
+		{"no expiry", models.APIKey{}, true},
+		{"not yet expired", models.APIKey{ExpiresAt: &future}, true},
+		{"expired", models.APIKey{ExpiresAt: &past}, false},
+		{"revoked", models.APIKey{RevokedAt: &past, ExpiresAt: &future}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := apiKeyActive(tt.key, now); got != tt.want {
+				t.Errorf("apiKeyActive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     models.ServiceAccountRequest
+		wantErr bool
+	}{
+		{"valid", models.ServiceAccountRequest{Name: "ci-deployer", Role: "operator"}, false},
+		{"unknown role", models.ServiceAccountRequest{Name: "ci-deployer", Role: "root"}, true},
+		{"bad name", models.ServiceAccountRequest{Name: "ci deployer", Role: "viewer"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := validateServiceAccount(tt.req); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateServiceAccount() = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	days := func(n int) *int { return &n }
+
+	tests := []struct {
+		name    string
+		req     models.APIKeyRequest
+		wantErr bool
+	}{
+		{"never expires", models.APIKeyRequest{Name: "github-actions"}, false},
+		{"expires", models.APIKeyRequest{Name: "github-actions", ExpiresInDays: days(90)}, false},
+		{"zero days", models.APIKeyRequest{Name: "github-actions", ExpiresInDays: days(0)}, true},
+		{"too long", models.APIKeyRequest{Name: "github-actions", ExpiresInDays: days(5000)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := validateAPIKey(tt.req); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateAPIKey() = %v, wantErr %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
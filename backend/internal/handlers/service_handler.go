@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,28 +12,56 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
 	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/reconciler"
 	"github.com/stratus/backend/internal/validation"
 	"github.com/stratus/backend/internal/websocket"
 )
 
+// serviceColumns is the column list scanService expects, in order.
+const serviceColumns = "id, project_id, name, region, labels, image, version, status, desired_status, status_message, COALESCE(node_id, ''), uptime, created_at, updated_at"
+
 type ServiceHandler struct {
-	db      *sql.DB
-	hub     *websocket.Hub
-	metrics *MetricsHandler
+	db          *sql.DB
+	hub         *websocket.Hub
+	metrics     *MetricsHandler
+	reconciler  *reconciler.Reconciler
+	assignments *AssignmentHandler
+	authz       *RoleBindingHandler
+	quotas      *QuotaHandler
 }
 
-func NewServiceHandler(db *sql.DB, hub *websocket.Hub, metrics *MetricsHandler) *ServiceHandler {
+func NewServiceHandler(db *sql.DB, hub *websocket.Hub, metrics *MetricsHandler, rec *reconciler.Reconciler, assignments *AssignmentHandler, authz *RoleBindingHandler, quotas *QuotaHandler) *ServiceHandler {
 	return &ServiceHandler{
-		db:      db,
-		hub:     hub,
-		metrics: metrics,
+		db:          db,
+		hub:         hub,
+		metrics:     metrics,
+		reconciler:  rec,
+		assignments: assignments,
+		authz:       authz,
+		quotas:      quotas,
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanService(row rowScanner) (models.Service, error) {
+	var s models.Service
+	var labels []byte
+	if err := row.Scan(&s.ID, &s.ProjectID, &s.Name, &s.Region, &labels, &s.Image, &s.Version, &s.Status, &s.DesiredStatus, &s.StatusMessage, &s.NodeID, &s.Uptime, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return s, err
 	}
+	err := json.Unmarshal(labels, &s.Labels)
+	return s, err
 }
 
 func (h *ServiceHandler) ListServices(c *gin.Context) {
 	region := c.Query("region")
 	status := c.Query("status")
+	desiredStatus := c.Query("desired_status")
 
 	// Pagination
 	limit := 50
@@ -52,9 +81,17 @@ func (h *ServiceHandler) ListServices(c *gin.Context) {
 		}
 	}
 
-	query := "SELECT id, name, region, image, version, status, uptime, created_at, updated_at FROM services WHERE 1=1"
+	query := "SELECT " + serviceColumns + " FROM services WHERE 1=1"
 	args := []interface{}{}
-	argCount := 1
+	filter, args := projectFilter(c, "project_id", args)
+	query += filter
+	argCount := len(args) + 1
+
+	if project := c.Query("project_id"); project != "" {
+		query += fmt.Sprintf(" AND project_id = $%d", argCount)
+		args = append(args, project)
+		argCount++
+	}
 
 	if region != "" {
 		query += fmt.Sprintf(" AND region = $%d", argCount)
@@ -65,6 +102,31 @@ func (h *ServiceHandler) ListServices(c *gin.Context) {
 	if status != "" {
 		query += fmt.Sprintf(" AND status = $%d", argCount)
 		args = append(args, status)
+		argCount++
+	}
+
+	if desiredStatus != "" {
+		query += fmt.Sprintf(" AND desired_status = $%d", argCount)
+		args = append(args, desiredStatus)
+		argCount++
+	}
+
+	// labels=key=value,... lists services carrying all of those labels
+	if selector := c.Query("labels"); selector != "" {
+		labels, err := parseSelector(selector)
+		if err != nil {
+			errors.BadRequest(c, err.Error(), nil)
+			return
+		}
+		encoded, _ := json.Marshal(labels)
+		query += fmt.Sprintf(" AND labels @> $%d", argCount)
+		args = append(args, encoded)
+		argCount++
+	}
+
+	// drift=true lists services whose observed status differs from the desired one
+	if c.Query("drift") == "true" {
+		query += " AND status <> desired_status"
 	}
 
 	query += " ORDER BY created_at DESC"
@@ -83,8 +145,8 @@ func (h *ServiceHandler) ListServices(c *gin.Context) {
 
 	services := []models.Service{}
 	for rows.Next() {
-		var s models.Service
-		if err := rows.Scan(&s.ID, &s.Name, &s.Region, &s.Image, &s.Version, &s.Status, &s.Uptime, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		s, err := scanService(rows)
+		if err != nil {
 			errors.InternalError(c, "Failed to scan service")
 			return
 		}
@@ -100,11 +162,10 @@ func (h *ServiceHandler) GetService(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	var s models.Service
-	err := h.db.QueryRowContext(ctx,
-		"SELECT id, name, region, image, version, status, uptime, created_at, updated_at FROM services WHERE id = $1",
+	s, err := scanService(h.db.QueryRowContext(ctx,
+		"SELECT "+serviceColumns+" FROM services WHERE id = $1",
 		id,
-	).Scan(&s.ID, &s.Name, &s.Region, &s.Image, &s.Version, &s.Status, &s.Uptime, &s.CreatedAt, &s.UpdatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		errors.NotFound(c, "Service")
@@ -139,46 +200,98 @@ func (h *ServiceHandler) CreateService(c *gin.Context) {
 	if err := validation.ValidateVersion(req.Version); err != nil {
 		validationErrs = append(validationErrs, err.(validation.ValidationError))
 	}
+	if err := validation.ValidateLabels(req.Labels); err != nil {
+		validationErrs = append(validationErrs, err.(validation.ValidationError))
+	}
 	if len(validationErrs) > 0 {
 		errors.BadRequest(c, "Validation failed", validationErrs)
 		return
 	}
+	if req.Labels == nil {
+		req.Labels = map[string]string{}
+	}
+	if req.ProjectID == "" {
+		req.ProjectID = models.DefaultProjectID
+	}
+	if !canSeeProject(c, req.ProjectID) {
+		errors.Forbidden(c, fmt.Sprintf("Not a member of project %s", req.ProjectID))
+		return
+	}
 
 	service := models.Service{
-		ID:        uuid.New().String(),
-		Name:      req.Name,
-		Region:    req.Region,
-		Image:     req.Image,
-		Version:   req.Version,
-		Status:    models.StatusStopped,
-		Uptime:    0,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:            uuid.New().String(),
+		ProjectID:     req.ProjectID,
+		Name:          req.Name,
+		Region:        req.Region,
+		Labels:        req.Labels,
+		Image:         req.Image,
+		Version:       req.Version,
+		Status:        models.StatusStopped,
+		DesiredStatus: models.StatusStopped,
+		Uptime:        0,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
 	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	_, err := h.db.ExecContext(ctx,
-		`INSERT INTO services (id, name, region, image, version, status, uptime, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		service.ID, service.Name, service.Region, service.Image, service.Version, service.Status, service.Uptime, service.CreatedAt, service.UpdatedAt,
-	)
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)", service.ProjectID).Scan(&exists); err != nil {
+		errors.InternalError(c, "Failed to get project")
+		return
+	}
+	if !exists {
+		errors.NotFound(c, "Project")
+		return
+	}
+
+	// Role bindings may grant operator on the service about to exist
+	if !h.authz.authorize(ctx, c, middleware.RoleOperator, service) {
+		return
+	}
 
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
 		errors.InternalError(c, "Failed to create service")
 		return
 	}
+	defer tx.Rollback()
 
-	// Broadcast service creation
-	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, service)
+	creator := c.GetString("user_id")
+	if !h.quotas.admit(ctx, tx, c, service, creator, false) {
+		return
+	}
+
+	labels, _ := json.Marshal(service.Labels)
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO services (id, project_id, name, region, labels, image, version, status, desired_status, uptime, created_at, updated_at, created_by)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''))`,
+		service.ID, service.ProjectID, service.Name, service.Region, labels, service.Image, service.Version, service.Status, service.DesiredStatus, service.Uptime, service.CreatedAt, service.UpdatedAt, creator,
+	)
+	if err != nil {
+		errors.InternalError(c, "Failed to create service")
+		return
+	}
+	if _, err := recordRevision(ctx, tx, service.ID, "create", creator); err != nil {
+		errors.InternalError(c, "Failed to record revision")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to create service")
+		return
+	}
+
+	// Broadcast service creation. Like deletions, it carries an action so
+	// listeners can tell it from an update.
+	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, struct {
+		models.Service
+		Action string `json:"action"`
+	}{service, "created"})
 
 	// Create deployment log
 	h.createDeploymentLog(service.ID, "create", "success", "Service created successfully")
 
-	// Start metrics simulator for new service
-	h.metrics.StartSimulator(service.ID)
-
 	c.JSON(http.StatusCreated, service)
 }
 
@@ -191,6 +304,18 @@ func (h *ServiceHandler) UpdateService(c *gin.Context) {
 		return
 	}
 
+	// status is the legacy name for desired_status
+	desired := req.DesiredStatus
+	if desired == nil {
+		desired = req.Status
+	}
+	if desired != nil {
+		if err := validation.ValidateDesiredStatus(string(*desired)); err != nil {
+			errors.BadRequest(c, "Validation failed", err)
+			return
+		}
+	}
+
 	// Validate version if provided
 	if req.Version != nil {
 		if err := validation.ValidateVersion(*req.Version); err != nil {
@@ -198,15 +323,68 @@ func (h *ServiceHandler) UpdateService(c *gin.Context) {
 			return
 		}
 	}
+	if req.Labels != nil {
+		if err := validation.ValidateLabels(*req.Labels); err != nil {
+			errors.BadRequest(c, "Validation failed", err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to update service")
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := scanService(tx.QueryRowContext(ctx, "SELECT "+serviceColumns+" FROM services WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get service")
+		return
+	}
+	auditBefore(c, current)
+
+	// Relabelling must neither move a service out of the caller's reach
+	// nor into the scope of bindings granting them more
+	if req.Labels != nil {
+		if !h.authz.authorizeRelabel(ctx, c, current, *req.Labels) {
+			return
+		}
+	}
+
+	// Version changes go through the deployment while one is rolling out.
+	// The lock keeps one from being created until this change commits.
+	if req.Version != nil {
+		if err := lockDeployments(ctx, tx, current.ProjectID, current.Name); err != nil {
+			errors.InternalError(c, "Failed to lock deployments")
+			return
+		}
+		deploying, err := hasActiveDeployment(ctx, tx, current.ProjectID, current.Name)
+		if err != nil {
+			errors.InternalError(c, "Failed to check active deployments")
+			return
+		}
+		if deploying {
+			errors.Conflict(c, "A deployment is in progress for this service")
+			return
+		}
+	}
 
 	// Build update query dynamically
 	updates := []string{}
 	args := []interface{}{}
 	argCount := 1
 
-	if req.Status != nil {
-		updates = append(updates, fmt.Sprintf("status = $%d", argCount))
-		args = append(args, *req.Status)
+	if desired != nil {
+		updates = append(updates, fmt.Sprintf("desired_status = $%d", argCount))
+		args = append(args, *desired)
 		argCount++
 	}
 
@@ -216,6 +394,13 @@ func (h *ServiceHandler) UpdateService(c *gin.Context) {
 		argCount++
 	}
 
+	if req.Labels != nil {
+		labels, _ := json.Marshal(*req.Labels)
+		updates = append(updates, fmt.Sprintf("labels = $%d", argCount))
+		args = append(args, labels)
+		argCount++
+	}
+
 	if len(updates) == 0 {
 		errors.BadRequest(c, "No fields to update", nil)
 		return
@@ -229,10 +414,19 @@ func (h *ServiceHandler) UpdateService(c *gin.Context) {
 
 	query := "UPDATE services SET " + strings.Join(updates, ", ") + fmt.Sprintf(" WHERE id = $%d", argCount)
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
-	defer cancel()
+	// Starting a service counts against its running quotas
+	if desired != nil && *desired == models.StatusRunning {
+		var creator string
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(created_by, '') FROM services WHERE id = $1", id).Scan(&creator); err != nil {
+			errors.InternalError(c, "Failed to get service")
+			return
+		}
+		if current.DesiredStatus != models.StatusRunning && !h.quotas.admit(ctx, tx, c, current, creator, true) {
+			return
+		}
+	}
 
-	result, err := h.db.ExecContext(ctx, query, args...)
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		errors.InternalError(c, "Failed to update service")
 		return
@@ -243,32 +437,40 @@ func (h *ServiceHandler) UpdateService(c *gin.Context) {
 		errors.NotFound(c, "Service")
 		return
 	}
+	// The row lock taken above orders this against other revisions
+	if req.Version != nil {
+		if _, err := recordRevision(ctx, tx, id, "update", c.GetString("user_id")); err != nil {
+			errors.InternalError(c, "Failed to record revision")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		errors.InternalError(c, "Failed to update service")
+		return
+	}
 
 	// Fetch updated service
-	var service models.Service
-	h.db.QueryRowContext(ctx,
-		"SELECT id, name, region, image, version, status, uptime, created_at, updated_at FROM services WHERE id = $1",
+	service, _ := scanService(h.db.QueryRowContext(ctx,
+		"SELECT "+serviceColumns+" FROM services WHERE id = $1",
 		id,
-	).Scan(&service.ID, &service.Name, &service.Region, &service.Image, &service.Version, &service.Status, &service.Uptime, &service.CreatedAt, &service.UpdatedAt)
+	))
 
 	// Broadcast update
 	h.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, service)
 
-	action := "update"
-	if req.Status != nil {
-		switch *req.Status {
-		case models.StatusRunning:
-			action = "start"
-			// Start metrics simulator when service starts
-			h.metrics.StartSimulator(id)
-		case models.StatusStopped:
+	if desired != nil {
+		// The reconciler performs the actual start/stop and logs the outcome
+		action := "start"
+		if *desired == models.StatusStopped {
 			action = "stop"
-			// Stop metrics simulator when service stops
-			h.metrics.StopSimulator(id)
 		}
+		h.createDeploymentLog(id, action, "pending", fmt.Sprintf("Desired status set to %s", *desired))
+		h.reconciler.Trigger(id)
+	}
+	if req.Version != nil {
+		h.createDeploymentLog(id, "update", "success", fmt.Sprintf("Version set to %s", *req.Version))
+		h.assignments.ServiceChanged(ctx, id)
 	}
-
-	h.createDeploymentLog(id, action, "success", "Service updated successfully")
 
 	c.JSON(http.StatusOK, service)
 }
@@ -279,32 +481,42 @@ func (h *ServiceHandler) DeleteService(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	result, err := h.db.ExecContext(ctx, "DELETE FROM services WHERE id = $1", id)
-	if err != nil {
-		errors.InternalError(c, "Failed to delete service")
+	service, err := scanService(h.db.QueryRowContext(ctx, "DELETE FROM services WHERE id = $1 RETURNING "+serviceColumns, id))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Service")
 		return
 	}
-
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		errors.NotFound(c, "Service")
+	if err != nil {
+		errors.InternalError(c, "Failed to delete service")
 		return
 	}
+	auditBefore(c, service)
 
 	// Stop metrics simulator
 	h.metrics.StopSimulator(id)
 
+	// Tell the agent running it, if any, that it is gone
+	if service.NodeID != "" {
+		h.assignments.BumpGeneration(ctx, service.NodeID)
+	}
+
 	h.hub.Broadcast(websocket.MessageTypeServiceUpdate, gin.H{
-		"id":     id,
-		"action": "deleted",
+		"id":         id,
+		"project_id": service.ProjectID,
+		"action":     "deleted",
 	})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Service deleted successfully"})
 }
 
 func (h *ServiceHandler) createDeploymentLog(serviceID, action, status, message string) {
+	recordDeploymentLog(h.db, h.hub, serviceID, action, status, message)
+}
+
+// recordDeploymentLog writes a deployment log entry and broadcasts it.
+func recordDeploymentLog(db *sql.DB, hub *websocket.Hub, serviceID, action, status, message string) {
 	logID := uuid.New().String()
-	h.db.Exec(
+	db.Exec(
 		`INSERT INTO deployment_logs (id, service_id, action, status, message, created_at)
 		 VALUES ($1, $2, $3, $4, $5, $6)`,
 		logID, serviceID, action, status, message, time.Now(),
@@ -319,5 +531,5 @@ func (h *ServiceHandler) createDeploymentLog(serviceID, action, status, message
 		CreatedAt: time.Now(),
 	}
 
-	h.hub.BroadcastJSON(websocket.MessageTypeLog, log)
+	hub.BroadcastJSON(websocket.MessageTypeLog, log)
 }
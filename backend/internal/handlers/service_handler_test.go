@@ -28,7 +28,7 @@ func TestCreateServiceValidation(t *testing.T) {
 	metricsHandler := &MetricsHandler{
 		simulators: make(map[string]context.CancelFunc),
 	}
-	handler := NewServiceHandler(nil, hub, metricsHandler)
+	handler := NewServiceHandler(nil, hub, metricsHandler, nil, nil, nil, nil)
 
 	tests := []struct {
 		name       string
@@ -96,7 +96,7 @@ func TestListServicesPagination(t *testing.T) {
 	metricsHandler := &MetricsHandler{
 		simulators: make(map[string]context.CancelFunc),
 	}
-	handler := NewServiceHandler(nil, hub, metricsHandler)
+	handler := NewServiceHandler(nil, hub, metricsHandler, nil, nil, nil, nil)
 
 	tests := []struct {
 		name       string
@@ -143,3 +143,11 @@ func TestListServicesPagination(t *testing.T) {
 		})
 	}
 }
+
+func TestCompactJSON(t *testing.T) {
+	stored := []byte(`{"port": 8080, "tags": ["a", "b"]}`)
+	raw := []byte(`{"port":8080,"tags":["a","b"]}`)
+	if string(compactJSON(stored)) != string(compactJSON(raw)) {
+		t.Errorf("compactJSON(%s) = %s, want %s", stored, compactJSON(stored), raw)
+	}
+}
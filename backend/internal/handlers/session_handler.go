@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+)
+
+const (
+	// revokedTokenPrefix + jti marks a token revoked until it expires.
+	revokedTokenPrefix = "auth:revoked:"
+	// revokedUserPrefix + user_id holds the Unix time before which all of
+	// the user's tokens were revoked.
+	revokedUserPrefix = "auth:revoked-user:"
+)
+
+// SessionHandler refreshes and revokes the tokens the auth middleware
+// issues, and tells the middleware which ones are revoked. Revocations live
+// in Redis only as long as the tokens they revoke would.
+type SessionHandler struct {
+	redis *redis.Client
+	auth  *middleware.AuthMiddleware
+}
+
+func NewSessionHandler(redisClient *redis.Client, auth *middleware.AuthMiddleware) *SessionHandler {
+	return &SessionHandler{redis: redisClient, auth: auth}
+}
+
+// Revoked implements middleware.TokenRevocations.
+func (h *SessionHandler) Revoked(ctx context.Context, claims *middleware.Claims) (bool, error) {
+	vals, err := h.redis.MGet(ctx, revokedTokenPrefix+claims.ID, revokedUserPrefix+claims.UserID).Result()
+	if err != nil {
+		return false, err
+	}
+	if vals[0] != nil {
+		return true, nil
+	}
+	return issuedBeforeCutoff(claims, vals[1]), nil
+}
+
+// revoke revokes one token. It reports false if the token was already
+// revoked, so a refresh token can be redeemed once only.
+func (h *SessionHandler) revoke(ctx context.Context, claims *middleware.Claims) (bool, error) {
+	if claims.ExpiresAt == nil {
+		return false, nil
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return false, nil
+	}
+	return h.redis.SetNX(ctx, revokedTokenPrefix+claims.ID, 1, ttl).Result()
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token,
+// within the session the old one belongs to.
+func (h *SessionHandler) Refresh(c *gin.Context) {
+	var req models.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "refresh_token is required", nil)
+		return
+	}
+	claims, err := h.auth.ParseRefreshToken(req.RefreshToken)
+	if err != nil {
+		errors.Unauthorized(c, "Invalid or expired refresh token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	revoked, err := h.Revoked(ctx, claims)
+	if err != nil {
+		errors.InternalError(c, "Failed to refresh session")
+		return
+	}
+	if revoked {
+		errors.Unauthorized(c, "Refresh token has been revoked")
+		return
+	}
+	// Revoking the old token first means two concurrent refreshes cannot
+	// both succeed
+	first, err := h.revoke(ctx, claims)
+	if err != nil {
+		errors.InternalError(c, "Failed to refresh session")
+		return
+	}
+	if !first {
+		errors.Unauthorized(c, "Refresh token has been revoked")
+		return
+	}
+
+	// Memberships are looked up again, so changes reach the new tokens
+	projects, err := h.auth.Projects(ctx, claims.UserID, claims.Groups)
+	if err != nil {
+		errors.InternalError(c, "Failed to look up project memberships")
+		return
+	}
+	pair, err := h.auth.RefreshTokenPair(claims, projects)
+	if err != nil {
+		errors.InternalError(c, "Failed to issue tokens")
+		return
+	}
+	c.JSON(http.StatusOK, pair)
+}
+
+// Logout revokes the access token the request was made with and, when
+// given, the session's refresh token.
+func (h *SessionHandler) Logout(c *gin.Context) {
+	value, ok := c.Get("claims")
+	if !ok {
+		errors.BadRequest(c, "API keys cannot log out; revoke them instead", nil)
+		return
+	}
+	claims := value.(*middleware.Claims)
+
+	var req models.LogoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errors.BadRequest(c, "Invalid request body", nil)
+			return
+		}
+	}
+	var refresh *middleware.Claims
+	if req.RefreshToken != "" {
+		var err error
+		refresh, err = h.auth.ParseRefreshToken(req.RefreshToken)
+		if err != nil || refresh.UserID != claims.UserID {
+			errors.BadRequest(c, "Invalid refresh token", nil)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	for _, token := range []*middleware.Claims{claims, refresh} {
+		if token == nil {
+			continue
+		}
+		if _, err := h.revoke(ctx, token); err != nil {
+			errors.InternalError(c, "Failed to log out")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// RevokeUserSessions revokes every token issued to a user so far. The user
+// can sign in again afterwards.
+func (h *SessionHandler) RevokeUserSessions(c *gin.Context) {
+	userID := c.Param("user_id")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	// Outlive the longest-lived token issued before now
+	now := time.Now()
+	if err := h.redis.Set(ctx, revokedUserPrefix+userID, now.Unix(), middleware.RefreshTokenTTL).Err(); err != nil {
+		errors.InternalError(c, "Failed to revoke sessions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "revoked_before": now.UTC().Truncate(time.Second)})
+}
+
+// issuedBeforeCutoff reports whether a token was issued no later than the
+// user's revocation cutoff, a Unix time as read back from Redis. Tokens
+// issued within the cutoff's second are revoked too.
+func issuedBeforeCutoff(claims *middleware.Claims, cutoff interface{}) bool {
+	s, ok := cutoff.(string)
+	if !ok {
+		return false
+	}
+	before, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return false
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Unix() <= before
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stratus/backend/internal/middleware"
+)
+
+func TestIssuedBeforeCutoff(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	claims := &middleware.Claims{RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(issued)}}
+
+	tests := []struct {
+		name   string
+		cutoff interface{}
+		want   bool
+	}{
+		{"no cutoff", nil, false},
+		{"issued before", "1700000001", true},
+		{"issued in the same second", "1700000000", true},
+		{"issued after", "1699999999", false},
+		{"garbled cutoff", "yesterday", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := issuedBeforeCutoff(claims, tt.cutoff); got != tt.want {
+				t.Errorf("issuedBeforeCutoff(%v) = %v, want %v", tt.cutoff, got, tt.want)
+			}
+		})
+	}
+
+	if !issuedBeforeCutoff(&middleware.Claims{}, "1") {
+		t.Error("a token without iat should count as issued before any cutoff")
+	}
+}
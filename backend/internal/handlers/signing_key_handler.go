@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/oidc"
+)
+
+const (
+	signingKeyInterval = time.Minute
+	// A new key is published this long before it signs anything, so
+	// verifiers caching the key set pick it up first.
+	signingKeyLead = time.Hour
+	// A replaced key stays published until every token it signed has
+	// expired, plus this margin for clock skew.
+	signingKeyMargin = 5 * time.Minute
+	// Unknown kids trigger a reload at most this often, for keys rotated
+	// by another replica.
+	signingKeyReloadEvery = 10 * time.Second
+)
+
+var signingMethods = map[string]jwt.SigningMethod{
+	"RS256": jwt.SigningMethodRS256,
+	"ES256": jwt.SigningMethodES256,
+}
+
+type signingKey struct {
+	models.SigningKey
+	private crypto.Signer
+}
+
+// SigningKeyHandler keeps the keys tokens are signed with in Postgres, so
+// every replica shares them, and rotates them on a schedule. It implements
+// middleware.SigningKeys and serves the public keys as a JWKS.
+type SigningKeyHandler struct {
+	db        *sql.DB
+	algorithm string
+	rotation  time.Duration
+
+	mu       sync.RWMutex
+	keys     []signingKey // newest first
+	loadedAt time.Time
+}
+
+// NewSigningKeyHandler loads the key ring, creating the first key if there
+// is none.
+func NewSigningKeyHandler(db *sql.DB, algorithm string, rotation time.Duration) (*SigningKeyHandler, error) {
+	if _, ok := signingMethods[algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q; use RS256 or ES256", algorithm)
+	}
+	if rotation < 2*signingKeyLead {
+		return nil, fmt.Errorf("key rotation interval must be at least %s", 2*signingKeyLead)
+	}
+
+	h := &SigningKeyHandler{db: db, algorithm: algorithm, rotation: rotation}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := h.rotate(ctx, false); err != nil {
+		return nil, err
+	}
+	if err := h.load(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// signingKeyColumns is the column list scanSigningKey expects, in order.
+const signingKeyColumns = "kid, algorithm, private_key, created_at, active_at, expires_at"
+
+func scanSigningKey(row rowScanner) (signingKey, error) {
+	var k signingKey
+	var privatePEM string
+	var expiresAt sql.NullTime
+	if err := row.Scan(&k.Kid, &k.Algorithm, &privatePEM, &k.CreatedAt, &k.ActiveAt, &expiresAt); err != nil {
+		return k, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return k, fmt.Errorf("key %s: invalid PEM", k.Kid)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return k, fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return k, fmt.Errorf("key %s: unsupported key type %T", k.Kid, private)
+	}
+	k.private = signer
+	return k, nil
+}
+
+// Current implements middleware.SigningKeys: the newest key that is already
+// active signs.
+func (h *SigningKeyHandler) Current() (string, jwt.SigningMethod, crypto.PrivateKey, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	for _, k := range h.keys {
+		if !k.ActiveAt.After(now) {
+			return k.Kid, signingMethods[k.Algorithm], k.private, nil
+		}
+	}
+	return "", nil, nil, fmt.Errorf("no active signing key")
+}
+
+// PublicKey implements middleware.SigningKeys.
+func (h *SigningKeyHandler) PublicKey(kid string) (crypto.PublicKey, bool) {
+	if key, ok := h.publicKey(kid); ok {
+		return key, true
+	}
+
+	h.mu.RLock()
+	stale := time.Since(h.loadedAt) >= signingKeyReloadEvery
+	h.mu.RUnlock()
+	if !stale {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.load(ctx); err != nil {
+		log.Printf("Failed to reload signing keys: %v", err)
+		return nil, false
+	}
+	return h.publicKey(kid)
+}
+
+func (h *SigningKeyHandler) publicKey(kid string) (crypto.PublicKey, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	for _, k := range h.keys {
+		if k.Kid == kid && signingKeyTrusted(k.SigningKey, now) {
+			return k.private.Public(), true
+		}
+	}
+	return nil, false
+}
+
+// signingKeyTrusted reports whether tokens signed with k are still accepted.
+func signingKeyTrusted(k models.SigningKey, now time.Time) bool {
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// JWKS serves the public keys other services verify our tokens with,
+// including the next key before it starts signing.
+func (h *SigningKeyHandler) JWKS(c *gin.Context) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	set := oidc.JWKS{Keys: []oidc.JWK{}}
+	for _, k := range h.keys {
+		if !signingKeyTrusted(k.SigningKey, now) {
+			continue
+		}
+		jwk, err := oidc.NewJWK(k.Kid, k.private.Public())
+		if err != nil {
+			errors.InternalError(c, "Failed to encode signing key")
+			return
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
+
+// ListSigningKeys lists the key ring without private keys.
+func (h *SigningKeyHandler) ListSigningKeys(c *gin.Context) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	keys := make([]models.SigningKey, 0, len(h.keys))
+	for _, k := range h.keys {
+		keys = append(keys, k.SigningKey)
+	}
+	c.JSON(http.StatusOK, gin.H{"signing_keys": keys})
+}
+
+// RotateSigningKey replaces the signing key immediately, e.g. after a
+// suspected compromise. Tokens signed with the old key stay valid until
+// they expire; delete it from the table to reject them at once.
+func (h *SigningKeyHandler) RotateSigningKey(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	kid, err := h.rotate(ctx, true)
+	if err != nil {
+		log.Printf("Failed to rotate signing key: %v", err)
+		errors.InternalError(c, "Failed to rotate signing key")
+		return
+	}
+	if err := h.load(ctx); err != nil {
+		errors.InternalError(c, "Failed to reload signing keys")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"kid": kid})
+}
+
+// Run rotates keys when they are due and picks up keys rotated by other
+// replicas.
+func (h *SigningKeyHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(signingKeyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if kid, err := h.rotate(ctx, false); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			} else if kid != "" {
+				log.Printf("Created signing key %s", kid)
+			}
+			if err := h.load(ctx); err != nil {
+				log.Printf("Failed to reload signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func (h *SigningKeyHandler) load(ctx context.Context) error {
+	rows, err := h.db.QueryContext(ctx,
+		"SELECT "+signingKeyColumns+" FROM jwt_signing_keys WHERE expires_at IS NULL OR expires_at > $1 ORDER BY active_at DESC",
+		time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []signingKey
+	for rows.Next() {
+		k, err := scanSigningKey(rows)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.keys = keys
+	h.loadedAt = time.Now()
+	h.mu.Unlock()
+	return nil
+}
+
+// rotate creates the next key when the newest one is due for replacement,
+// was made for another algorithm, or force is set, and schedules the keys it
+// replaces to expire. It returns the new kid, or "" when nothing was due.
+func (h *SigningKeyHandler) rotate(ctx context.Context, force bool) (string, error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Replicas rotate one at a time
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('jwt_signing_keys'))"); err != nil {
+		return "", err
+	}
+
+	var latest models.SigningKey
+	err = tx.QueryRowContext(ctx,
+		"SELECT algorithm, active_at FROM jwt_signing_keys WHERE expires_at IS NULL ORDER BY active_at DESC LIMIT 1",
+	).Scan(&latest.Algorithm, &latest.ActiveAt)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	now := time.Now()
+	activeAt, due := nextSigningKey(latest, err == sql.ErrNoRows, h.algorithm, h.rotation, force, now)
+	if !due {
+		return "", nil
+	}
+
+	privatePEM, err := generateSigningKey(h.algorithm)
+	if err != nil {
+		return "", err
+	}
+	kid := uuid.New().String()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO jwt_signing_keys (kid, algorithm, private_key, created_at, active_at) VALUES ($1, $2, $3, $4, $5)`,
+		kid, h.algorithm, privatePEM, now, activeAt,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE jwt_signing_keys SET expires_at = $2 WHERE expires_at IS NULL AND kid <> $1",
+		kid, activeAt.Add(middleware.RefreshTokenTTL+signingKeyMargin),
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM jwt_signing_keys WHERE expires_at < $1", now.Add(-24*time.Hour)); err != nil {
+		return "", err
+	}
+
+	return kid, tx.Commit()
+}
+
+// nextSigningKey decides whether a key should be created after latest, the
+// newest key still in service, and when it should start signing. The very
+// first key and forced rotations sign at once; scheduled ones are published
+// signingKeyLead ahead.
+func nextSigningKey(latest models.SigningKey, none bool, algorithm string, rotation time.Duration, force bool, now time.Time) (time.Time, bool) {
+	switch {
+	case none || force:
+		return now, true
+	case latest.ActiveAt.After(now):
+		return time.Time{}, false // the next key is already published
+	case latest.Algorithm != algorithm || !now.Before(latest.ActiveAt.Add(rotation-signingKeyLead)):
+		return now.Add(signingKeyLead), true
+	}
+	return time.Time{}, false
+}
+
+// generateSigningKey creates a private key for algorithm, PEM-encoded.
+func generateSigningKey(algorithm string) (string, error) {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
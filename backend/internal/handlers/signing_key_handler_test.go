@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestNextSigningKey(t *testing.T) {
+	now := time.Now()
+	rotation := 30 * 24 * time.Hour
+	key := func(alg string, age time.Duration) models.SigningKey {
+		return models.SigningKey{Algorithm: alg, ActiveAt: now.Add(-age)}
+	}
+
+	tests := []struct {
+		name       string
+		latest     models.SigningKey
+		none       bool
+		force      bool
+		wantDue    bool
+		wantActive time.Time
+	}{
+		{"first key signs at once", models.SigningKey{}, true, false, true, now},
+		{"fresh key", key("RS256", time.Hour), false, false, false, time.Time{}},
+		{"due key published ahead", key("RS256", rotation-signingKeyLead), false, false, true, now.Add(signingKeyLead)},
+		{"next key already published", key("RS256", -time.Minute), false, false, false, time.Time{}},
+		{"algorithm changed", key("ES256", time.Hour), false, false, true, now.Add(signingKeyLead)},
+		{"forced", key("RS256", time.Hour), false, true, true, now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, due := nextSigningKey(tt.latest, tt.none, "RS256", rotation, tt.force, now)
+			if due != tt.wantDue || !active.Equal(tt.wantActive) {
+				t.Errorf("nextSigningKey() = %v, %v, want %v, %v", active, due, tt.wantActive, tt.wantDue)
+			}
+		})
+	}
+}
+
+type fakeRow []interface{}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = r[i].(string)
+		case *time.Time:
+			*d = r[i].(time.Time)
+		}
+	}
+	return nil
+}
+
+func TestSigningKeyPEM(t *testing.T) {
+	for alg, check := range map[string]func(interface{}) bool{
+		"RS256": func(k interface{}) bool { _, ok := k.(*rsa.PrivateKey); return ok },
+		"ES256": func(k interface{}) bool { _, ok := k.(*ecdsa.PrivateKey); return ok },
+	} {
+		privatePEM, err := generateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		k, err := scanSigningKey(fakeRow{"kid", alg, privatePEM, now, now, nil})
+		if err != nil {
+			t.Fatalf("%s: scanSigningKey() error = %v", alg, err)
+		}
+		if !check(k.private) {
+			t.Errorf("%s: got a %T", alg, k.private)
+		}
+	}
+
+	if _, err := generateSigningKey("HS256"); err == nil {
+		t.Error("generateSigningKey() should refuse symmetric algorithms")
+	}
+}
@@ -0,0 +1,653 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/validation"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	webhookPollInterval = 2 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookBatchSize    = 20
+	webhookSenders      = 5 // deliveries of a batch sent at once
+	// A claimed delivery is retried after the lease if its sender dies. It
+	// outlasts a batch of deliveries that all time out.
+	webhookLease            = webhookBatchSize/webhookSenders*webhookTimeout + 30*time.Second
+	webhookMaxAttempts      = 8
+	webhookBaseBackoff      = 10 * time.Second
+	webhookMaxBackoff       = time.Hour
+	webhookHistoryRetention = 30 * 24 * time.Hour
+)
+
+var webhookEvents = map[string]bool{
+	models.EventServiceCreated: true,
+	models.EventServiceUpdated: true,
+	models.EventServiceDeleted: true,
+	models.EventDeploymentLog:  true,
+	models.EventAlertPending:   true,
+	models.EventAlertFiring:    true,
+	models.EventAlertResolved:  true,
+}
+
+type webhookEvent struct {
+	name    string
+	payload interface{}
+}
+
+// WebhookHandler manages webhook subscriptions and delivers hub events to
+// them. Deliveries are stored before they are sent, so they survive restarts
+// and can be retried from any replica.
+type WebhookHandler struct {
+	db     *sql.DB
+	client *http.Client
+	events chan webhookEvent
+}
+
+func NewWebhookHandler(db *sql.DB, hub *websocket.Hub) *WebhookHandler {
+	h := &WebhookHandler{
+		db:     db,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan webhookEvent, 1024),
+	}
+	hub.Listen(h.listen)
+	return h
+}
+
+// webhookColumns is the column list scanWebhook expects, in order.
+const webhookColumns = "id, url, events, enabled, COALESCE(created_by, ''), created_at, updated_at"
+
+func scanWebhook(row rowScanner) (models.Webhook, error) {
+	var w models.Webhook
+	err := row.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.Enabled, &w.CreatedBy, &w.CreatedAt, &w.UpdatedAt)
+	return w, err
+}
+
+// deliveryColumns is the column list scanDelivery expects, in order.
+const deliveryColumns = `id, webhook_id, event, payload, status, attempts, last_status_code, last_error,
+	next_attempt_at, delivered_at, created_at`
+
+func scanDelivery(row rowScanner) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var payload []byte
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError,
+		&nextAttemptAt, &deliveredAt, &d.CreatedAt)
+	d.Payload = payload
+	if nextAttemptAt.Valid && d.Status == models.DeliveryPending {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, err
+}
+
+func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, "SELECT "+webhookColumns+" FROM webhooks ORDER BY created_at")
+	if err != nil {
+		errors.InternalError(c, "Failed to query webhooks")
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan webhook")
+			return
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (h *WebhookHandler) GetWebhook(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	w, err := scanWebhook(h.db.QueryRowContext(ctx, "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Webhook")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, w)
+}
+
+// CreateWebhook registers a webhook and returns its signing secret, which is
+// not shown again.
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	req, ok := bindWebhook(c)
+	if !ok {
+		return
+	}
+
+	secret, err := newNodeToken()
+	if err != nil {
+		errors.InternalError(c, "Failed to generate webhook secret")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	w, err := scanWebhook(h.db.QueryRowContext(ctx,
+		`INSERT INTO webhooks (id, url, secret, events, enabled, created_by, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		 RETURNING `+webhookColumns,
+		uuid.New().String(), req.URL, secret, pq.Array(req.Events), *req.Enabled, c.GetString("user_id"), time.Now(),
+	))
+	if err != nil {
+		errors.InternalError(c, "Failed to create webhook")
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.CreateWebhookResponse{Webhook: w, Secret: secret})
+}
+
+// UpdateWebhook replaces a webhook's URL, events and enabled flag. The secret
+// is kept.
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	req, ok := bindWebhook(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	current, err := scanWebhook(h.db.QueryRowContext(ctx, "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Webhook")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get webhook")
+		return
+	}
+	auditBefore(c, current)
+
+	w, err := scanWebhook(h.db.QueryRowContext(ctx,
+		`UPDATE webhooks SET url = $2, events = $3, enabled = $4, updated_at = $5 WHERE id = $1
+		 RETURNING `+webhookColumns,
+		c.Param("id"), req.URL, pq.Array(req.Events), *req.Enabled, time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Webhook")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to update webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, w)
+}
+
+// DeleteWebhook deletes a webhook together with its delivery history.
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	w, err := scanWebhook(h.db.QueryRowContext(ctx, "DELETE FROM webhooks WHERE id = $1 RETURNING "+webhookColumns, c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Webhook")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to delete webhook")
+		return
+	}
+	auditBefore(c, w)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+func bindWebhook(c *gin.Context) (models.WebhookRequest, bool) {
+	var req models.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errors.BadRequest(c, "Invalid request body", err.Error())
+		return req, false
+	}
+	if validationErrs := validateWebhook(&req); len(validationErrs) > 0 {
+		errors.BadRequest(c, "Validation failed", validationErrs)
+		return req, false
+	}
+	return req, true
+}
+
+// validateWebhook checks a webhook request and fills in its defaults.
+func validateWebhook(req *models.WebhookRequest) validation.ValidationErrors {
+	var errs validation.ValidationErrors
+
+	if req.Enabled == nil {
+		enabled := true
+		req.Enabled = &enabled
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, validation.ValidationError{Field: "url", Message: "url must be an absolute http or https URL"})
+	}
+
+	if len(req.Events) == 0 {
+		errs = append(errs, validation.ValidationError{Field: "events", Message: "events must not be empty"})
+	}
+	for _, event := range req.Events {
+		if event != "*" && !webhookEvents[event] {
+			errs = append(errs, validation.ValidationError{Field: "events", Message: fmt.Sprintf("unknown event %q", event)})
+		}
+	}
+
+	return errs
+}
+
+// ListDeliveries lists deliveries, newest first. Filter with ?webhook_id=
+// and ?status=; ?status=dead is the dead-letter list.
+func (h *WebhookHandler) ListDeliveries(c *gin.Context) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE 1=1"
+	args := []interface{}{}
+
+	if webhookID := c.Query("webhook_id"); webhookID != "" {
+		args = append(args, webhookID)
+		query += fmt.Sprintf(" AND webhook_id = $%d", len(args))
+	}
+	if status := c.Query("status"); status != "" {
+		switch models.WebhookDeliveryStatus(status) {
+		case models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead:
+		default:
+			errors.BadRequest(c, "status must be pending, delivered or dead", nil)
+			return
+		}
+		args = append(args, status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", len(args))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		errors.InternalError(c, "Failed to query deliveries")
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			errors.InternalError(c, "Failed to scan delivery")
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// GetDelivery returns a delivery with the history of its attempts.
+func (h *WebhookHandler) GetDelivery(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	d, err := scanDelivery(h.db.QueryRowContext(ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = $1", c.Param("id")))
+	if err == sql.ErrNoRows {
+		errors.NotFound(c, "Delivery")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to get delivery")
+		return
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT attempt, status_code, error, duration_ms, created_at FROM webhook_attempts
+		 WHERE delivery_id = $1 ORDER BY attempt`, d.ID)
+	if err != nil {
+		errors.InternalError(c, "Failed to query delivery attempts")
+		return
+	}
+	defer rows.Close()
+
+	d.History = []models.WebhookAttempt{}
+	for rows.Next() {
+		var a models.WebhookAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			errors.InternalError(c, "Failed to scan delivery attempt")
+			return
+		}
+		d.History = append(d.History, a)
+	}
+
+	c.JSON(http.StatusOK, d)
+}
+
+// RetryDelivery puts a dead or delivered delivery back in the queue with a
+// fresh set of attempts.
+func (h *WebhookHandler) RetryDelivery(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	d, err := scanDelivery(h.db.QueryRowContext(ctx,
+		`UPDATE webhook_deliveries SET status = $2, attempts = 0, next_attempt_at = $3
+		 WHERE id = $1 AND status <> $2
+		 RETURNING `+deliveryColumns,
+		c.Param("id"), models.DeliveryPending, time.Now(),
+	))
+	if err == sql.ErrNoRows {
+		var exists bool
+		h.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM webhook_deliveries WHERE id = $1)", c.Param("id")).Scan(&exists)
+		if !exists {
+			errors.NotFound(c, "Delivery")
+			return
+		}
+		errors.Conflict(c, "Delivery is already pending")
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to retry delivery")
+		return
+	}
+
+	c.JSON(http.StatusOK, d)
+}
+
+// listen receives hub broadcasts. It must not block the hub, so events are
+// dropped when the queue is full.
+func (h *WebhookHandler) listen(msg websocket.Message) {
+	name, ok := webhookEventName(msg)
+	if !ok {
+		return
+	}
+	select {
+	case h.events <- webhookEvent{name: name, payload: msg.Payload}:
+	default:
+		log.Printf("Webhook event queue full, dropping %s", name)
+	}
+}
+
+// webhookEventName maps a hub message to a webhook event, if it is one.
+func webhookEventName(msg websocket.Message) (string, bool) {
+	var payload map[string]interface{}
+	switch p := msg.Payload.(type) {
+	case map[string]interface{}:
+		payload = p
+	case gin.H:
+		payload = p
+	}
+
+	switch msg.Type {
+	case websocket.MessageTypeServiceUpdate:
+		switch payload["action"] {
+		case "created":
+			return models.EventServiceCreated, true
+		case "deleted":
+			return models.EventServiceDeleted, true
+		case "moved_out":
+			// The moved_in message of the same move is the update
+			return "", false
+		}
+		return models.EventServiceUpdated, true
+	case websocket.MessageTypeLog:
+		return models.EventDeploymentLog, true
+	case websocket.MessageTypeAlert:
+		if state, ok := payload["state"].(string); ok {
+			return "alert." + state, true
+		}
+	}
+	return "", false
+}
+
+// Run stores incoming events as deliveries and sends due deliveries until
+// ctx is done.
+func (h *WebhookHandler) Run(ctx context.Context) {
+	go h.enqueueEvents(ctx)
+
+	poll := time.NewTicker(webhookPollInterval)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			h.deliverDue(ctx)
+		case <-cleanup.C:
+			h.expireHistory(ctx)
+		}
+	}
+}
+
+func (h *WebhookHandler) enqueueEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-h.events:
+			payload, err := json.Marshal(event.payload)
+			if err != nil {
+				continue
+			}
+
+			qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			_, err = h.db.ExecContext(qctx,
+				`INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, next_attempt_at, created_at)
+				 SELECT gen_random_uuid()::text, id, $1, $2, $3, $4, $4 FROM webhooks
+				 WHERE enabled AND ($1 = ANY(events) OR '*' = ANY(events))`,
+				event.name, payload, models.DeliveryPending, time.Now(),
+			)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to queue webhook deliveries for %s: %v", event.name, err)
+			}
+		}
+	}
+}
+
+type dueDelivery struct {
+	id, event, url, secret string
+	payload                []byte
+	attempts               int
+	createdAt              time.Time
+}
+
+// deliverDue claims due deliveries by pushing their next attempt past the
+// lease, so concurrent senders skip them, and sends them, webhookSenders at
+// a time.
+func (h *WebhookHandler) deliverDue(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	now := time.Now()
+	rows, err := h.db.QueryContext(qctx,
+		`UPDATE webhook_deliveries d SET next_attempt_at = $1
+		 FROM webhooks w
+		 WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= $3
+			ORDER BY next_attempt_at LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING d.id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret`,
+		now.Add(webhookLease), models.DeliveryPending, now, webhookBatchSize,
+	)
+	if err != nil {
+		cancel()
+		log.Printf("Failed to claim webhook deliveries: %v", err)
+		return
+	}
+
+	due := []dueDelivery{}
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.createdAt, &d.url, &d.secret); err == nil {
+			due = append(due, d)
+		}
+	}
+	rows.Close()
+	cancel()
+
+	var wg sync.WaitGroup
+	senders := make(chan struct{}, webhookSenders)
+	for _, d := range due {
+		wg.Add(1)
+		senders <- struct{}{}
+		go func(d dueDelivery) {
+			defer wg.Done()
+			defer func() { <-senders }()
+			h.deliver(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (h *WebhookHandler) deliver(ctx context.Context, d dueDelivery) {
+	body, _ := json.Marshal(struct {
+		ID        string          `json:"id"`
+		Event     string          `json:"event"`
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+	}{d.id, d.event, d.createdAt, d.payload})
+
+	attempt := d.attempts + 1
+	started := time.Now()
+	statusCode, err := h.send(ctx, d, body, started)
+	duration := time.Since(started)
+
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+
+	status := models.DeliveryPending
+	var nextAttemptAt, deliveredAt interface{}
+	switch {
+	case err == nil:
+		status = models.DeliveryDelivered
+		deliveredAt = time.Now()
+	case attempt >= webhookMaxAttempts:
+		status = models.DeliveryDead
+	default:
+		nextAttemptAt = time.Now().Add(webhookBackoff(attempt))
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := h.db.ExecContext(qctx,
+		`INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		d.id, attempt, statusCode, errMsg, duration.Milliseconds(), started,
+	); err != nil {
+		log.Printf("Failed to record webhook attempt for %s: %v", d.id, err)
+	}
+	if _, err := h.db.ExecContext(qctx,
+		`UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = $5,
+			next_attempt_at = $6, delivered_at = $7
+		 WHERE id = $1`,
+		d.id, status, attempt, statusCode, errMsg, nextAttemptAt, deliveredAt,
+	); err != nil {
+		log.Printf("Failed to update webhook delivery %s: %v", d.id, err)
+	}
+}
+
+// send posts one attempt. Any 2xx response counts as delivered.
+func (h *WebhookHandler) send(ctx context.Context, d dueDelivery, body []byte, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Stratus-Webhooks/1.0")
+	req.Header.Set("X-Stratus-Event", d.event)
+	req.Header.Set("X-Stratus-Delivery", d.id)
+	req.Header.Set("X-Stratus-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Stratus-Signature", signWebhook(d.secret, timestamp, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (h *WebhookHandler) expireHistory(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if _, err := h.db.ExecContext(qctx,
+		"DELETE FROM webhook_deliveries WHERE status <> $1 AND created_at < $2",
+		models.DeliveryPending, time.Now().Add(-webhookHistoryRetention),
+	); err != nil {
+		log.Printf("Failed to expire webhook deliveries: %v", err)
+	}
+}
+
+// signWebhook returns the X-Stratus-Signature value: the hex HMAC-SHA256,
+// keyed with the webhook secret, of the timestamp, a dot and the body.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait after a failed attempt: doubling from
+// webhookBaseBackoff, capped at webhookMaxBackoff.
+func webhookBackoff(attempt int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+func TestWebhookEventName(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    websocket.Message
+		want   string
+		wantOK bool
+	}{
+		{"created", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: map[string]interface{}{"id": "a", "action": "created"}}, models.EventServiceCreated, true},
+		{"updated", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: map[string]interface{}{"id": "a"}}, models.EventServiceUpdated, true},
+		{"deleted", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: map[string]interface{}{"id": "a", "action": "deleted"}}, models.EventServiceDeleted, true},
+		{"moved in", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: map[string]interface{}{"id": "a", "action": "moved_in"}}, models.EventServiceUpdated, true},
+		{"moved out", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: map[string]interface{}{"id": "a", "action": "moved_out"}}, "", false},
+		{"deleted gin.H", websocket.Message{Type: websocket.MessageTypeServiceUpdate, Payload: gin.H{"id": "a", "action": "deleted"}}, models.EventServiceDeleted, true},
+		{"log", websocket.Message{Type: websocket.MessageTypeLog, Payload: map[string]interface{}{}}, models.EventDeploymentLog, true},
+		{"alert", websocket.Message{Type: websocket.MessageTypeAlert, Payload: map[string]interface{}{"state": "firing"}}, models.EventAlertFiring, true},
+		{"metrics", websocket.Message{Type: websocket.MessageTypeMetrics, Payload: map[string]interface{}{}}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := webhookEventName(tt.msg)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("webhookEventName() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// printf '1700000000.{"id":"d"}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=c355ed8b3d66641319d7e10cde5e7c4c497c066d8d1d84a5e75f83aef640b2de"
+	if got := signWebhook("secret", 1700000000, []byte(`{"id":"d"}`)); got != want {
+		t.Errorf("signWebhook() = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempt); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     models.WebhookRequest
+		wantErr bool
+	}{
+		{"valid", models.WebhookRequest{URL: "https://hooks.example.com/stratus", Events: []string{models.EventAlertFiring}}, false},
+		{"all events", models.WebhookRequest{URL: "http://localhost:9000", Events: []string{"*"}}, false},
+		{"relative url", models.WebhookRequest{URL: "/hook", Events: []string{"*"}}, true},
+		{"bad scheme", models.WebhookRequest{URL: "ftp://example.com", Events: []string{"*"}}, true},
+		{"no events", models.WebhookRequest{URL: "https://example.com"}, true},
+		{"unknown event", models.WebhookRequest{URL: "https://example.com", Events: []string{"service.exploded"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateWebhook(&tt.req)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Errorf("validateWebhook() = %v, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.req.Enabled == nil || !*tt.req.Enabled {
+				t.Error("validateWebhook() should default enabled to true")
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/stratus/backend/internal/errors"
 	ws "github.com/stratus/backend/internal/websocket"
 )
 
@@ -26,7 +29,20 @@ func NewWebSocketHandler(hub *ws.Hub, corsOrigins string) *WebSocketHandler {
 	}
 }
 
+// HandleWebSocket upgrades the connection. Clients pick what they receive
+// with ?topics= on connect and subscribe/unsubscribe frames afterwards;
+// without either they receive every message. Reconnecting clients pass the
+// last seq they saw as ?since= to have the gap replayed.
 func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
+	topics, ok := streamTopics(c)
+	if !ok {
+		return
+	}
+	since, ok := streamSince(c, c.Query("since"))
+	if !ok {
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -45,9 +61,46 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
-	client := ws.NewClient(h.hub, conn)
+	client := ws.NewClient(h.hub, conn, topics)
+	if since >= 0 {
+		client.ResumeAfter(since)
+	}
+	if projects, all := visibleProjects(c); !all {
+		client.RestrictToProjects(projects)
+	}
 	h.hub.Register(client)
 	
 	go client.WritePump()
 	go client.ReadPump()
 }
+
+// streamTopics parses the comma-separated ?topics= of a WebSocket or event
+// stream, responding with an error if one is unknown.
+func streamTopics(c *gin.Context) ([]string, bool) {
+	var topics []string
+	if param := c.Query("topics"); param != "" {
+		for _, t := range strings.Split(param, ",") {
+			t = strings.TrimSpace(t)
+			if !ws.ValidTopic(t) {
+				errors.BadRequest(c, fmt.Sprintf("unknown topic %q", t), nil)
+				return nil, false
+			}
+			topics = append(topics, t)
+		}
+	}
+	return topics, true
+}
+
+// streamSince parses the sequence number a stream resumes after, or -1 when
+// param is empty, responding with an error if it is malformed.
+func streamSince(c *gin.Context, param string) (int64, bool) {
+	if param == "" {
+		return -1, true
+	}
+	seq, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || seq < 0 {
+		errors.BadRequest(c, "since must be a non-negative sequence number", nil)
+		return 0, false
+	}
+	return seq, true
+}
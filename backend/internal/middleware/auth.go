@@ -1,11 +1,18 @@
 package middleware
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	stderrors "errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/stratus/backend/internal/errors"
 )
 
@@ -17,14 +24,84 @@ const (
 	RoleAdmin    Role = "admin"
 )
 
+const (
+	// AccessTokenTTL is how long access tokens, which authenticate requests,
+	// are valid.
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is how long a session lasts. Refresh tokens, which
+	// only obtain new access tokens, expire this long after sign-in however
+	// often they are used, so the role and groups they carry over do not
+	// outlive it.
+	RefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// Token uses, telling access and refresh tokens apart.
+const (
+	TokenUseAccess  = "access"
+	TokenUseRefresh = "refresh"
+)
+
 type Claims struct {
-	UserID string `json:"user_id"`
-	Role   Role   `json:"role"`
+	UserID   string   `json:"user_id"`
+	Role     Role     `json:"role"`
+	Groups   []string `json:"groups,omitempty"`   // IdP groups, matched by role bindings
+	Projects []string `json:"projects,omitempty"` // IDs of the projects the user is a member of
+	Use      string   `json:"token_use,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// TokenPair is what signing in or refreshing issues.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // seconds until AccessToken expires
+}
+
+// APIKeyPrefix starts every API key, telling them apart from JWTs.
+const APIKeyPrefix = "stratus_"
+
+// ErrInvalidAPIKey is returned by an APIKeyValidator for keys that are
+// unknown, expired or revoked.
+var ErrInvalidAPIKey = stderrors.New("invalid API key")
+
+// APIKeyValidator resolves an API key to the claims of the service account
+// it belongs to.
+type APIKeyValidator interface {
+	ValidateAPIKey(ctx context.Context, key string) (*Claims, error)
+}
+
+// SigningKeys holds the asymmetric keys tokens are signed with and verified
+// against, identified by kid.
+type SigningKeys interface {
+	// Current returns the key new tokens are signed with.
+	Current() (kid string, method jwt.SigningMethod, key crypto.PrivateKey, err error)
+	// PublicKey returns the verification key kid, if it is still trusted.
+	PublicKey(kid string) (crypto.PublicKey, bool)
+}
+
+// TokenRevocations tells whether a token was revoked, by its jti or along
+// with all of its user's sessions.
+type TokenRevocations interface {
+	Revoked(ctx context.Context, claims *Claims) (bool, error)
+}
+
+// ProjectMemberships tells which projects a user, directly or through
+// their groups, is a member of.
+type ProjectMemberships interface {
+	ProjectsFor(ctx context.Context, userID string, groups []string) ([]string, error)
+}
+
+// asymmetricMethods are accepted when signing keys are in use; HS256 tokens
+// are then rejected outright.
+var asymmetricMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}
+
 type AuthMiddleware struct {
-	jwtSecret []byte
+	jwtSecret   []byte
+	apiKeys     APIKeyValidator
+	keys        SigningKeys
+	issuer      string
+	revocations TokenRevocations
+	projects    ProjectMemberships
 }
 
 func NewAuthMiddleware(jwtSecret string) *AuthMiddleware {
@@ -33,7 +110,39 @@ func NewAuthMiddleware(jwtSecret string) *AuthMiddleware {
 	}
 }
 
-// AuthRequired validates JWT token
+// UseAPIKeys makes AuthRequired accept API keys validated by v alongside
+// JWTs.
+func (m *AuthMiddleware) UseAPIKeys(v APIKeyValidator) {
+	m.apiKeys = v
+}
+
+// UseSigningKeys switches from the shared HS256 secret to asymmetric keys.
+// Tokens are then issued by issuer and carry the kid of their key.
+func (m *AuthMiddleware) UseSigningKeys(keys SigningKeys, issuer string) {
+	m.keys = keys
+	m.issuer = issuer
+}
+
+// UseRevocations makes AuthRequired reject revoked tokens.
+func (m *AuthMiddleware) UseRevocations(r TokenRevocations) {
+	m.revocations = r
+}
+
+// UseProjects makes issued tokens carry the projects p says their user is
+// a member of, and API keys act in their service account's projects.
+func (m *AuthMiddleware) UseProjects(p ProjectMemberships) {
+	m.projects = p
+}
+
+// Projects returns the projects a user is a member of, for GenerateTokenPair.
+func (m *AuthMiddleware) Projects(ctx context.Context, userID string, groups []string) ([]string, error) {
+	if m.projects == nil {
+		return nil, nil
+	}
+	return m.projects.ProjectsFor(ctx, userID, groups)
+}
+
+// AuthRequired validates a JWT or, when enabled, an API key
 func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -51,25 +160,112 @@ func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 		}
 
 		tokenString := parts[1]
-		claims := &Claims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return m.jwtSecret, nil
-		})
+		if m.apiKeys != nil && strings.HasPrefix(tokenString, APIKeyPrefix) {
+			m.authenticateAPIKey(c, tokenString)
+			return
+		}
 
-		if err != nil || !token.Valid {
+		claims, err := m.parseToken(tokenString)
+		if err != nil || claims.Use != TokenUseAccess {
 			errors.Unauthorized(c, "Invalid or expired token")
 			c.Abort()
 			return
 		}
 
+		if m.revocations != nil {
+			revoked, err := m.revocations.Revoked(c.Request.Context(), claims)
+			if err != nil {
+				errors.InternalError(c, "Failed to check token revocation")
+				c.Abort()
+				return
+			}
+			if revoked {
+				errors.Unauthorized(c, "Token has been revoked")
+				c.Abort()
+				return
+			}
+		}
+
 		// Set user context
 		c.Set("user_id", claims.UserID)
 		c.Set("role", claims.Role)
+		c.Set("groups", claims.Groups)
+		c.Set("projects", claims.Projects)
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
 
+// parseToken verifies a token's signature, signing method and expiry and
+// returns its claims.
+func (m *AuthMiddleware) parseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	var token *jwt.Token
+	var err error
+	if m.keys == nil {
+		token, err = jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+			return m.jwtSecret, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	} else {
+		token, err = jwt.ParseWithClaims(tokenString, claims, m.verificationKey,
+			jwt.WithValidMethods(asymmetricMethods), jwt.WithIssuer(m.issuer), jwt.WithExpirationRequired())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return claims, nil
+}
+
+// verificationKey finds the key named by a token's kid, making sure it is
+// of the kind the token's method expects.
+func (m *AuthMiddleware) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := m.keys.PublicKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key %q cannot verify %s tokens", kid, token.Method.Alg())
+}
+
+func (m *AuthMiddleware) authenticateAPIKey(c *gin.Context, key string) {
+	claims, err := m.apiKeys.ValidateAPIKey(c.Request.Context(), key)
+	if stderrors.Is(err, ErrInvalidAPIKey) {
+		errors.Unauthorized(c, "Invalid, expired or revoked API key")
+		c.Abort()
+		return
+	}
+	if err != nil {
+		errors.InternalError(c, "Failed to validate API key")
+		c.Abort()
+		return
+	}
+	// Keys are looked up on every request, so membership changes apply at once
+	projects, err := m.Projects(c.Request.Context(), claims.UserID, nil)
+	if err != nil {
+		errors.InternalError(c, "Failed to look up project memberships")
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", claims.UserID)
+	c.Set("role", claims.Role)
+	c.Set("projects", projects)
+	c.Next()
+}
+
 // RequireRole checks if user has required role
 func (m *AuthMiddleware) RequireRole(requiredRole Role) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -105,17 +301,84 @@ func (m *AuthMiddleware) RequireRole(requiredRole Role) gin.HandlerFunc {
 	}
 }
 
-// GenerateToken creates a new JWT token (for testing/setup)
+// GenerateToken creates a new access token (for testing/setup)
 func (m *AuthMiddleware) GenerateToken(userID string, role Role) (string, error) {
+	return m.signToken(userID, role, nil, nil, TokenUseAccess, time.Now().Add(AccessTokenTTL))
+}
+
+// GenerateTokenPair issues an access token and the refresh token that
+// renews it, starting a session. projects are those the user is a member
+// of, from Projects.
+func (m *AuthMiddleware) GenerateTokenPair(userID string, role Role, groups, projects []string) (*TokenPair, error) {
+	return m.tokenPair(userID, role, groups, projects, time.Now().Add(RefreshTokenTTL))
+}
+
+// RefreshTokenPair issues the next pair of the session that refresh, a
+// verified refresh token, belongs to. Neither new token outlives refresh, so
+// refreshing never extends the session.
+func (m *AuthMiddleware) RefreshTokenPair(refresh *Claims, projects []string) (*TokenPair, error) {
+	if refresh.ExpiresAt == nil {
+		return nil, fmt.Errorf("refresh token has no expiry")
+	}
+	return m.tokenPair(refresh.UserID, refresh.Role, refresh.Groups, projects, refresh.ExpiresAt.Time)
+}
+
+func (m *AuthMiddleware) tokenPair(userID string, role Role, groups, projects []string, sessionEnd time.Time) (*TokenPair, error) {
+	accessEnd := time.Now().Add(AccessTokenTTL)
+	if accessEnd.After(sessionEnd) {
+		accessEnd = sessionEnd
+	}
+	access, err := m.signToken(userID, role, groups, projects, TokenUseAccess, accessEnd)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := m.signToken(userID, role, groups, projects, TokenUseRefresh, sessionEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(time.Until(accessEnd).Seconds())}, nil
+}
+
+// ParseRefreshToken verifies a refresh token and returns its claims. It
+// does not check for revocation.
+func (m *AuthMiddleware) ParseRefreshToken(tokenString string) (*Claims, error) {
+	claims, err := m.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Use != TokenUseRefresh {
+		return nil, fmt.Errorf("not a refresh token")
+	}
+	return claims, nil
+}
+
+// signToken issues a token with its own jti, so it can be revoked alone.
+func (m *AuthMiddleware) signToken(userID string, role Role, groups, projects []string, use string, expiresAt time.Time) (string, error) {
+	now := time.Now()
 	claims := Claims{
-		UserID: userID,
-		Role:   role,
+		UserID:   userID,
+		Role:     role,
+		Groups:   groups,
+		Projects: projects,
+		Use:      use,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(m.jwtSecret)
+	if m.keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(m.jwtSecret)
+	}
+
+	kid, method, key, err := m.keys.Current()
+	if err != nil {
+		return "", err
+	}
+	claims.Issuer = m.issuer
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
 }
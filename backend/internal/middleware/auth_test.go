@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type staticKeys struct {
+	kid string
+	key *ecdsa.PrivateKey
+}
+
+func (k staticKeys) Current() (string, jwt.SigningMethod, crypto.PrivateKey, error) {
+	return k.kid, jwt.SigningMethodES256, k.key, nil
+}
+
+func (k staticKeys) PublicKey(kid string) (crypto.PublicKey, bool) {
+	if kid != k.kid {
+		return nil, false
+	}
+	return &k.key.PublicKey, true
+}
+
+func TestParseTokenWithSigningKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewAuthMiddleware("secret")
+	m.UseSigningKeys(staticKeys{kid: "k1", key: key}, "stratus")
+
+	token, err := m.GenerateToken("alice", RoleOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := m.parseToken(token)
+	if err != nil {
+		t.Fatalf("parseToken() error = %v", err)
+	}
+	if claims.UserID != "alice" || claims.Role != RoleOperator || claims.Issuer != "stratus" {
+		t.Errorf("parseToken() = %+v", claims)
+	}
+
+	valid := Claims{UserID: "mallory", Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    "stratus",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+	sign := func(method jwt.SigningMethod, kid string, claims Claims, key interface{}) string {
+		t.Helper()
+		tok := jwt.NewWithClaims(method, claims)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	noExpiry := valid
+	noExpiry.ExpiresAt = nil
+	wrongIssuer := valid
+	wrongIssuer.Issuer = "someone-else"
+
+	rejected := map[string]string{
+		"shared secret":           sign(jwt.SigningMethodHS256, "k1", valid, []byte("secret")),
+		"public key as HMAC key":  sign(jwt.SigningMethodHS256, "k1", valid, der),
+		"unsigned":                sign(jwt.SigningMethodNone, "k1", valid, jwt.UnsafeAllowNoneSignatureType),
+		"unknown kid":             sign(jwt.SigningMethodES256, "k2", valid, key),
+		"signed with another key": sign(jwt.SigningMethodES256, "k1", valid, other),
+		"without expiry":          sign(jwt.SigningMethodES256, "k1", noExpiry, key),
+		"from another issuer":     sign(jwt.SigningMethodES256, "k1", wrongIssuer, key),
+	}
+	for name, token := range rejected {
+		if _, err := m.parseToken(token); err == nil {
+			t.Errorf("parseToken() accepted a token %s", name)
+		}
+	}
+}
+
+func TestParseTokenWithSecret(t *testing.T) {
+	m := NewAuthMiddleware("secret")
+	token, err := m.GenerateToken("alice", RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.parseToken(token); err != nil {
+		t.Fatalf("parseToken() error = %v", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, Claims{UserID: "mallory", Role: RoleAdmin})
+	signed, _ := tok.SignedString(key)
+	if _, err := m.parseToken(signed); err == nil {
+		t.Error("parseToken() should only accept HS256 with the shared secret")
+	}
+}
+
+func TestTokenPair(t *testing.T) {
+	m := NewAuthMiddleware("secret")
+	pair, err := m.GenerateTokenPair("alice", RoleOperator, []string{"sre"}, []string{"proj-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := m.parseToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.Use != TokenUseAccess || access.ID == "" || len(access.Projects) != 1 || access.Projects[0] != "proj-1" {
+		t.Errorf("access token claims = %+v", access)
+	}
+	if ttl := access.ExpiresAt.Sub(access.IssuedAt.Time); ttl != AccessTokenTTL {
+		t.Errorf("access token lives %v, want %v", ttl, AccessTokenTTL)
+	}
+
+	refresh, err := m.ParseRefreshToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("ParseRefreshToken() error = %v", err)
+	}
+	if refresh.UserID != "alice" || refresh.Role != RoleOperator || len(refresh.Groups) != 1 || refresh.ID == access.ID {
+		t.Errorf("refresh token claims = %+v", refresh)
+	}
+	if _, err := m.ParseRefreshToken(pair.AccessToken); err == nil {
+		t.Error("ParseRefreshToken() accepted an access token")
+	}
+}
+
+func TestRefreshTokenPairKeepsSessionEnd(t *testing.T) {
+	m := NewAuthMiddleware("secret")
+	end := time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	old := &Claims{UserID: "alice", Role: RoleOperator, Groups: []string{"sre"}, Use: TokenUseRefresh}
+	old.ExpiresAt = jwt.NewNumericDate(end)
+
+	pair, err := m.RefreshTokenPair(old, []string{"proj-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := m.ParseRefreshToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("ParseRefreshToken() error = %v", err)
+	}
+	if !refresh.ExpiresAt.Equal(end) {
+		t.Errorf("refresh token expires %v, want the session end %v", refresh.ExpiresAt.Time, end)
+	}
+	access, err := m.parseToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.ExpiresAt.After(end) || access.Projects[0] != "proj-2" {
+		t.Errorf("access token claims = %+v, want expiry by %v", access, end)
+	}
+	if pair.ExpiresIn > int((5 * time.Minute).Seconds()) {
+		t.Errorf("ExpiresIn = %d, want at most the rest of the session", pair.ExpiresIn)
+	}
+
+	if _, err := m.RefreshTokenPair(&Claims{UserID: "alice"}, nil); err == nil {
+		t.Error("RefreshTokenPair() accepted a token without an expiry")
+	}
+}
+
+func TestAuthRequiredRejectsRefreshAndRevokedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewAuthMiddleware("secret")
+	revoked := revokedIDs{}
+	m.UseRevocations(revoked)
+
+	r := gin.New()
+	r.GET("/", m.AuthRequired(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	status := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	pair, _ := m.GenerateTokenPair("alice", RoleViewer, nil, nil)
+	if got := status(pair.AccessToken); got != http.StatusOK {
+		t.Errorf("access token: status %d", got)
+	}
+	if got := status(pair.RefreshToken); got != http.StatusUnauthorized {
+		t.Errorf("refresh token: status %d, want 401", got)
+	}
+
+	access, _ := m.parseToken(pair.AccessToken)
+	revoked[access.ID] = true
+	if got := status(pair.AccessToken); got != http.StatusUnauthorized {
+		t.Errorf("revoked access token: status %d, want 401", got)
+	}
+}
+
+type revokedIDs map[string]bool
+
+func (r revokedIDs) Revoked(_ context.Context, claims *Claims) (bool, error) {
+	return r[claims.ID], nil
+}
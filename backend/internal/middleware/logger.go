@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"encoding/json"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/telemetry"
 )
 
 type LogEntry struct {
@@ -51,5 +53,13 @@ func StructuredLogger() gin.HandlerFunc {
 		// Output as JSON
 		logJSON, _ := json.Marshal(entry)
 		println(string(logJSON))
+
+		// Label by route template, not path, to keep cardinality bounded
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		telemetry.HTTPRequests.Inc(entry.Method, route, strconv.Itoa(entry.Status))
+		telemetry.HTTPDuration.Observe(time.Since(start).Seconds(), entry.Method, route)
 	}
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/stratus/backend/internal/errors"
+	"github.com/stratus/backend/internal/telemetry"
 )
 
 type visitor struct {
@@ -77,6 +78,7 @@ func (rl *RateLimiter) Limit() gin.HandlerFunc {
 		// Check if limit exceeded
 		if v.count >= rl.limit {
 			rl.mu.Unlock()
+			telemetry.RateLimitRejections.Inc(c.FullPath())
 			errors.TooManyRequests(c, "Rate limit exceeded")
 			c.Abort()
 			return
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+)
+
+type AlertRuleKind string
+
+const (
+	AlertThreshold    AlertRuleKind = "threshold"
+	AlertRateOfChange AlertRuleKind = "rate_of_change"
+)
+
+type AlertState string
+
+const (
+	AlertPending  AlertState = "pending" // condition holds, waiting out for_seconds
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// AlertRule watches one metric of a service, or of every service of its
+// project in a region.
+// A threshold rule compares the latest sample with Threshold; a rate of change
+// rule compares the percentage change of the metric over WindowSeconds. The
+// condition must hold for ForSeconds before the alert fires.
+type AlertRule struct {
+	ID            string        `json:"id"`
+	ProjectID     string        `json:"project_id"`
+	Name          string        `json:"name"`
+	ServiceID     string        `json:"service_id,omitempty"`
+	Region        string        `json:"region,omitempty"`
+	Metric        string        `json:"metric"`
+	Kind          AlertRuleKind `json:"kind"`
+	Operator      string        `json:"operator"`
+	Threshold     float64       `json:"threshold"`
+	WindowSeconds int           `json:"window_seconds,omitempty"`
+	ForSeconds    int           `json:"for_seconds"`
+	Enabled       bool          `json:"enabled"`
+	CreatedBy     string        `json:"created_by,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+// AlertRuleRequest creates or replaces a rule. Exactly one of ServiceID and
+// Region must be set. A service rule belongs to its service's project; a
+// region rule to ProjectID, or the default project when empty. Kind
+// defaults to threshold, Operator to ">" and Enabled to true.
+type AlertRuleRequest struct {
+	ProjectID     string        `json:"project_id,omitempty"`
+	Name          string        `json:"name" binding:"required"`
+	ServiceID     string        `json:"service_id"`
+	Region        string        `json:"region"`
+	Metric        string        `json:"metric" binding:"required"`
+	Kind          AlertRuleKind `json:"kind"`
+	Operator      string        `json:"operator"`
+	Threshold     float64       `json:"threshold"`
+	WindowSeconds int           `json:"window_seconds"`
+	ForSeconds    int           `json:"for_seconds"`
+	Enabled       *bool         `json:"enabled"`
+}
+
+// Alert is one rule's condition on one service, from the moment it first held
+// until it cleared. Value is the last evaluated metric value, or percentage
+// change for rate of change rules.
+type Alert struct {
+	ID         string     `json:"id"`
+	RuleID     string     `json:"rule_id"`
+	RuleName   string     `json:"rule_name"`
+	ServiceID  string     `json:"service_id"`
+	State      AlertState `json:"state"`
+	Value      float64    `json:"value"`
+	Message    string     `json:"message"`
+	StartedAt  time.Time  `json:"started_at"`
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
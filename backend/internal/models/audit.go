@@ -0,0 +1,35 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied" // 401 or 403
+	AuditFailed  = "failed"
+)
+
+// AuditEntry records one mutating API call. Entries are never changed or
+// deleted. Before and After hold the resource as it was and as the call
+// returned it, with secrets redacted; Changes is the difference between
+// them.
+type AuditEntry struct {
+	ID           int64           `json:"id"`
+	OccurredAt   time.Time       `json:"occurred_at"`
+	RequestID    string          `json:"request_id"`
+	Actor        string          `json:"actor,omitempty"`
+	ActorRole    string          `json:"actor_role,omitempty"`
+	ClientIP     string          `json:"client_ip"`
+	Action       string          `json:"action"` // method and route, e.g. "PATCH /api/v1/services/:id"
+	ResourceType string          `json:"resource_type"`
+	ResourceID   string          `json:"resource_id,omitempty"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	Changes      []ConfigChange  `json:"changes,omitempty"`
+	Status       int             `json:"status"`
+	Outcome      string          `json:"outcome"`
+	Error        string          `json:"error,omitempty"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+)
+
+// PutConfigRequest stores a new config version. When BaseVersion is set the
+// write only succeeds if it is still the latest version.
+type PutConfigRequest struct {
+	Config      map[string]interface{} `json:"config" binding:"required"`
+	BaseVersion *int                   `json:"base_version,omitempty"`
+}
+
+// ConfigSchema is the optional JSON Schema every new config version of a
+// service is validated against.
+type ConfigSchema struct {
+	ServiceID string                 `json:"service_id" db:"service_id"`
+	Schema    map[string]interface{} `json:"schema" db:"schema"`
+	UpdatedBy string                 `json:"updated_by" db:"updated_by"`
+	UpdatedAt time.Time              `json:"updated_at" db:"updated_at"`
+}
+
+type PutConfigSchemaRequest struct {
+	Schema map[string]interface{} `json:"schema" binding:"required"`
+}
+
+type ConfigChangeOp string
+
+const (
+	ConfigAdded   ConfigChangeOp = "added"
+	ConfigRemoved ConfigChangeOp = "removed"
+	ConfigChanged ConfigChangeOp = "changed"
+)
+
+// ConfigChange is one difference between two config versions. Path is a
+// dotted key path; arrays are compared as a whole.
+type ConfigChange struct {
+	Path string         `json:"path"`
+	Op   ConfigChangeOp `json:"op"`
+	From interface{}    `json:"from"` // null when added
+	To   interface{}    `json:"to"`   // null when removed
+}
+
+type ConfigDiff struct {
+	ServiceID   string         `json:"service_id"`
+	FromVersion int            `json:"from_version"`
+	ToVersion   int            `json:"to_version"`
+	Changes     []ConfigChange `json:"changes"`
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"time"
+)
+
+type DeploymentStatus string
+
+const (
+	DeploymentPending    DeploymentStatus = "pending"
+	DeploymentInProgress DeploymentStatus = "in_progress"
+	DeploymentSucceeded  DeploymentStatus = "succeeded"
+	DeploymentFailed     DeploymentStatus = "failed"      // halted, rollback also failed
+	DeploymentRolledBack DeploymentStatus = "rolled_back" // halted and restored
+)
+
+type DeploymentStrategy string
+
+const (
+	StrategyRolling DeploymentStrategy = "rolling"
+	StrategyCanary  DeploymentStrategy = "canary"
+)
+
+type CanaryVerdict string
+
+const (
+	VerdictPass         CanaryVerdict = "pass"
+	VerdictFail         CanaryVerdict = "fail"
+	VerdictInconclusive CanaryVerdict = "inconclusive" // not enough samples to judge
+)
+
+// CanaryAnalysis compares the canary instances against the baseline over the
+// analysis window. Latencies are the mean of the per-sample p95s.
+type CanaryAnalysis struct {
+	Verdict            CanaryVerdict `json:"verdict"`
+	Reason             string        `json:"reason,omitempty"`
+	CanaryErrorRate    float64       `json:"canary_error_rate"`
+	BaselineErrorRate  float64       `json:"baseline_error_rate"`
+	CanaryP95Latency   float64       `json:"canary_p95_latency"`
+	BaselineP95Latency float64       `json:"baseline_p95_latency"`
+	CanarySamples      int           `json:"canary_samples"`
+	BaselineSamples    int           `json:"baseline_samples"`
+}
+
+type DeploymentTargetStatus string
+
+const (
+	TargetPending    DeploymentTargetStatus = "pending"
+	TargetUpdated    DeploymentTargetStatus = "updated" // new version applied, waiting for health
+	TargetHealthy    DeploymentTargetStatus = "healthy"
+	TargetRolledBack DeploymentTargetStatus = "rolled_back"
+)
+
+// Deployment rolls a new version across every instance of a service. A
+// service deployed to several regions is one services row per region, all
+// sharing the same name; each row is one target of the deployment.
+//
+// A canary deployment first moves CanaryPercent of the instances (batch 1),
+// compares them with the rest over AnalysisSeconds, and only then rolls the
+// remaining instances in batches of BatchSize.
+type Deployment struct {
+	ID                   string             `json:"id" db:"id"`
+	ServiceID            string             `json:"service_id" db:"service_id"`
+	ServiceName          string             `json:"service_name" db:"service_name"`
+	Version              string             `json:"version" db:"version"`
+	Strategy             DeploymentStrategy `json:"strategy" db:"strategy"`
+	BatchSize            int                `json:"batch_size" db:"batch_size"`
+	MaxErrorRate         float64            `json:"max_error_rate" db:"max_error_rate"` // percentage
+	HealthTimeoutSeconds int                `json:"health_timeout_seconds" db:"health_timeout_seconds"`
+	BakeSeconds          int                `json:"bake_seconds" db:"bake_seconds"`
+	CanaryPercent        int                `json:"canary_percent,omitempty" db:"canary_percent"`
+	AnalysisSeconds      int                `json:"analysis_seconds,omitempty" db:"analysis_seconds"`
+	MaxErrorRateDelta    float64            `json:"max_error_rate_delta,omitempty" db:"max_error_rate_delta"` // percentage points over baseline
+	MaxLatencyIncrease   float64            `json:"max_latency_increase,omitempty" db:"max_latency_increase"` // percent over baseline p95
+	Analysis             *CanaryAnalysis    `json:"analysis,omitempty" db:"analysis"`
+	Status               DeploymentStatus   `json:"status" db:"status"`
+	CurrentBatch         int                `json:"current_batch" db:"current_batch"` // 1-based, 0 before the first batch
+	TotalBatches         int                `json:"total_batches" db:"total_batches"`
+	Message              string             `json:"message,omitempty" db:"message"`
+	CreatedBy            string             `json:"created_by" db:"created_by"`
+	CreatedAt            time.Time          `json:"created_at" db:"created_at"`
+	UpdatedAt            time.Time          `json:"updated_at" db:"updated_at"`
+	Targets              []DeploymentTarget `json:"targets,omitempty"`
+}
+
+type DeploymentTarget struct {
+	DeploymentID string                 `json:"deployment_id" db:"deployment_id"`
+	ServiceID    string                 `json:"service_id" db:"service_id"`
+	Region       string                 `json:"region" db:"region"`
+	FromVersion  string                 `json:"from_version" db:"from_version"`
+	Batch        int                    `json:"batch" db:"batch"`
+	Canary       bool                   `json:"canary" db:"canary"`
+	Status       DeploymentTargetStatus `json:"status" db:"status"`
+}
+
+type CreateDeploymentRequest struct {
+	Version              string             `json:"version" binding:"required"`
+	Strategy             DeploymentStrategy `json:"strategy,omitempty"` // rolling (default) or canary
+	BatchSize            int                `json:"batch_size,omitempty"`
+	MaxErrorRate         float64            `json:"max_error_rate,omitempty"`
+	HealthTimeoutSeconds int                `json:"health_timeout_seconds,omitempty"`
+	BakeSeconds          int                `json:"bake_seconds,omitempty"`
+	CanaryPercent        int                `json:"canary_percent,omitempty"`
+	AnalysisSeconds      int                `json:"analysis_seconds,omitempty"`
+	MaxErrorRateDelta    float64            `json:"max_error_rate_delta,omitempty"`
+	MaxLatencyIncrease   float64            `json:"max_latency_increase,omitempty"`
+	Regions              []string           `json:"regions,omitempty"` // limit the rollout to these regions
+}
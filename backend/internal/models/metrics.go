@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+)
+
+// MetricStats summarises one metric over a set of samples.
+type MetricStats struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// MetricsSummary aggregates a group of services: counts come from Postgres,
+// metric statistics from the samples stored in Redis for the window.
+// P95Latency statistics are taken over the per-sample p95 values.
+type MetricsSummary struct {
+	TotalServices   int                   `json:"total_services"`
+	RunningServices int                   `json:"running_services"`
+	ByStatus        map[ServiceStatus]int `json:"by_status"`
+	Samples         int                   `json:"samples"`
+	TotalRequests   int64                 `json:"total_requests"`
+	CPUUsage        MetricStats           `json:"cpu_usage"`
+	MemoryUsage     MetricStats           `json:"memory_usage"`
+	ErrorRate       MetricStats           `json:"error_rate"`
+	P95Latency      MetricStats           `json:"p95_latency"`
+}
+
+type AggregatedMetrics struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Region string    `json:"region,omitempty"`
+	MetricsSummary
+	Regions map[string]MetricsSummary `json:"regions"`
+}
+
+// MetricsBatch is a batch of samples pushed for one service.
+type MetricsBatch struct {
+	Samples []ServiceMetrics `json:"samples" binding:"required"`
+}
+
+// IngestTokenResponse carries a newly issued ingestion token. The token is
+// only ever returned here; the control plane keeps a hash.
+type IngestTokenResponse struct {
+	ServiceID string `json:"service_id"`
+	Token     string `json:"token"`
+}
+
+// MetricsResolution names a retention tier.
+type MetricsResolution string
+
+const (
+	ResolutionRaw    MetricsResolution = "raw"
+	ResolutionMinute MetricsResolution = "1m"
+	ResolutionHour   MetricsResolution = "1h"
+)
+
+// RollupStats summarises one metric within a rollup bucket.
+type RollupStats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+	P95 float64 `json:"p95"`
+}
+
+// MetricsRollup summarises the samples of one service taken within a bucket
+// starting at Timestamp.
+type MetricsRollup struct {
+	Timestamp    time.Time   `json:"timestamp"`
+	Samples      int         `json:"samples"`
+	RequestCount int64       `json:"request_count"`
+	CPUUsage     RollupStats `json:"cpu_usage"`
+	MemoryUsage  RollupStats `json:"memory_usage"`
+	ErrorRate    RollupStats `json:"error_rate"`
+	P95Latency   RollupStats `json:"p95_latency"`
+}
+
+// MetricsSeries is a service's metrics over a range, one point per step, read
+// from the tier named by Resolution.
+type MetricsSeries struct {
+	ServiceID  string            `json:"service_id"`
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Step       string            `json:"step"`
+	Resolution MetricsResolution `json:"resolution"`
+	Points     []MetricsRollup   `json:"points"`
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+)
+
+type NodeStatus string
+
+const (
+	NodeStatusReady     NodeStatus = "ready"
+	NodeStatusUnhealthy NodeStatus = "unhealthy" // missed a few heartbeats
+	NodeStatusLost      NodeStatus = "lost"      // silent long enough to be considered gone
+)
+
+type NodeCapacity struct {
+	CPUCores    float64 `json:"cpu_cores"`
+	MemoryMB    int64   `json:"memory_mb"`
+	MaxServices int     `json:"max_services"`
+}
+
+// Node is an edge host running a Stratus agent.
+type Node struct {
+	ID              string            `json:"id" db:"id"`
+	Name            string            `json:"name" db:"name"`
+	Region          string            `json:"region" db:"region"`
+	Capacity        NodeCapacity      `json:"capacity" db:"capacity"`
+	Labels          map[string]string `json:"labels" db:"labels"`
+	Status          NodeStatus        `json:"status" db:"status"`
+	Generation      int64             `json:"generation" db:"generation"`
+	LastHeartbeatAt time.Time         `json:"last_heartbeat_at" db:"last_heartbeat_at"`
+	CreatedAt       time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+type RegisterNodeRequest struct {
+	Name     string            `json:"name" binding:"required"`
+	Region   string            `json:"region" binding:"required"`
+	Capacity NodeCapacity      `json:"capacity" binding:"required"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// RegisterNodeResponse carries the node token the agent must present on
+// every later call. It is only ever returned once.
+type RegisterNodeResponse struct {
+	Node                     Node   `json:"node"`
+	Token                    string `json:"token"`
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds"`
+}
+
+type HeartbeatResponse struct {
+	Status                   NodeStatus `json:"status"`
+	HeartbeatIntervalSeconds int        `json:"heartbeat_interval_seconds"`
+}
+
+// Assignment is the spec of one service an agent is expected to run.
+type Assignment struct {
+	ServiceID      string        `json:"service_id"`
+	Name           string        `json:"name"`
+	Image          string        `json:"image"`
+	Version        string        `json:"version"`
+	DesiredStatus  ServiceStatus `json:"desired_status"`
+	ConfigRevision int           `json:"config_revision"` // latest service_configs.version, 0 if none
+}
+
+// AssignmentSet is everything assigned to a node. Generation increases every
+// time the set or any spec in it changes.
+type AssignmentSet struct {
+	NodeID     string       `json:"node_id"`
+	Generation int64        `json:"generation"`
+	Services   []Assignment `json:"services"`
+}
+
+// ServiceStatusReport is an agent's view of one assigned service.
+type ServiceStatusReport struct {
+	ServiceID string        `json:"service_id" binding:"required"`
+	Status    ServiceStatus `json:"status" binding:"required"`
+	Uptime    int64         `json:"uptime"` // seconds
+	Message   string        `json:"message,omitempty"`
+}
+
+type NodeStatusReport struct {
+	Generation int64                 `json:"generation"` // generation the agent has applied
+	Services   []ServiceStatusReport `json:"services"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// DefaultProjectID is the project every caller belongs to. It holds the
+// services created before projects existed, and belongs to
+// DefaultOrganizationID.
+const (
+	DefaultProjectID      = "default"
+	DefaultOrganizationID = "default"
+)
+
+// Organization groups the projects of one tenant.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// Project owns services. Only its members, and admins, can see them.
+type Project struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organization_id"`
+	Name           string    `json:"name"`
+	CreatedBy      string    `json:"created_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ProjectRequest struct {
+	OrganizationID string `json:"organization_id" binding:"required"`
+	Name           string `json:"name" binding:"required"`
+}
+
+// ProjectMember makes a user, or everyone in an IdP group, a member of a
+// project. SubjectKind is SubjectUser or SubjectGroup; service accounts are
+// the users service-account:<id>.
+type ProjectMember struct {
+	ProjectID   string    `json:"project_id"`
+	SubjectKind string    `json:"subject_kind"`
+	Subject     string    `json:"subject"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// MoveServiceRequest moves a service to ProjectID.
+type MoveServiceRequest struct {
+	ProjectID string `json:"project_id" binding:"required"`
+}
+
+type ProjectMemberRequest struct {
+	SubjectKind string `json:"subject_kind" binding:"required"`
+	Subject     string `json:"subject" binding:"required"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Quota scope kinds
+const (
+	QuotaProject = "project"
+	QuotaUser    = "user"
+)
+
+// Quota limits the services of a project, or those created by a user. A
+// nil limit is unlimited. Running services are those whose desired status
+// is running.
+type Quota struct {
+	ScopeKind            string     `json:"scope_kind"`
+	Scope                string     `json:"scope"`
+	MaxServices          *int       `json:"max_services"`
+	MaxRunningServices   *int       `json:"max_running_services"`
+	MaxServicesPerRegion *int       `json:"max_services_per_region"`
+	UpdatedBy            string     `json:"updated_by,omitempty"`
+	UpdatedAt            *time.Time `json:"updated_at,omitempty"`
+}
+
+// QuotaRequest sets a quota's limits; omitted limits are unlimited.
+type QuotaRequest struct {
+	MaxServices          *int `json:"max_services"`
+	MaxRunningServices   *int `json:"max_running_services"`
+	MaxServicesPerRegion *int `json:"max_services_per_region"`
+}
+
+// QuotaUsage is what counts against a quota.
+type QuotaUsage struct {
+	Services         int            `json:"services"`
+	RunningServices  int            `json:"running_services"`
+	ServicesByRegion map[string]int `json:"services_by_region"`
+}
+
+// QuotaStatus shows a quota's limits next to current usage.
+type QuotaStatus struct {
+	Quota
+	Usage QuotaUsage `json:"usage"`
+}
+
+// QuotaViolation details a refused request: which limit of which quota it
+// would have exceeded, and by how much.
+type QuotaViolation struct {
+	ScopeKind string `json:"scope_kind"`
+	Scope     string `json:"scope"`
+	Limit     string `json:"limit"` // max_services, max_running_services or max_services_per_region
+	Region    string `json:"region,omitempty"`
+	Max       int    `json:"max"`
+	Used      int    `json:"used"`
+}
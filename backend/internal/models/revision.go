@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ServiceRevision is an immutable snapshot of a service's image, version and
+// latest config, taken whenever one of them changes. Revisions are numbered
+// per service starting at 1.
+type ServiceRevision struct {
+	ID            string          `json:"id" db:"id"`
+	ServiceID     string          `json:"service_id" db:"service_id"`
+	Revision      int             `json:"revision" db:"revision"`
+	Image         string          `json:"image" db:"image"`
+	Version       string          `json:"version" db:"version"`
+	Config        json.RawMessage `json:"config,omitempty" db:"config"`
+	ConfigVersion int             `json:"config_version,omitempty" db:"config_version"`
+	Reason        string          `json:"reason" db:"reason"` // what produced the revision, e.g. "update"
+	CreatedBy     string          `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+}
+
+type RollbackRequest struct {
+	Revision int `json:"revision" binding:"required"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Role binding subject kinds
+const (
+	SubjectUser  = "user"
+	SubjectGroup = "group"
+)
+
+// RoleBinding grants a user, or everyone in an IdP group, a role on some
+// services on top of their own role. Its scope is either one service or
+// every service in Region (any region when empty) carrying all the labels
+// in Selector.
+type RoleBinding struct {
+	ID          string            `json:"id"`
+	SubjectKind string            `json:"subject_kind"`
+	Subject     string            `json:"subject"`
+	Role        string            `json:"role"`
+	ServiceID   string            `json:"service_id,omitempty"`
+	Region      string            `json:"region,omitempty"`
+	Selector    map[string]string `json:"selector,omitempty"`
+	CreatedBy   string            `json:"created_by,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+type RoleBindingRequest struct {
+	SubjectKind string            `json:"subject_kind" binding:"required"`
+	Subject     string            `json:"subject" binding:"required"`
+	Role        string            `json:"role" binding:"required"`
+	ServiceID   string            `json:"service_id"`
+	Region      string            `json:"region"`
+	Selector    map[string]string `json:"selector"`
+}
@@ -13,28 +13,45 @@ const (
 	StatusStarting ServiceStatus = "starting"
 )
 
+// Service tracks both the state an operator asked for (DesiredStatus) and
+// the state the reconciler last observed (Status). The two differ while a
+// transition is in flight or when the service has drifted.
 type Service struct {
-	ID        string        `json:"id" db:"id"`
-	Name      string        `json:"name" db:"name"`
-	Region    string        `json:"region" db:"region"`
-	Image     string        `json:"image" db:"image"`
-	Version   string        `json:"version" db:"version"`
-	Status    ServiceStatus `json:"status" db:"status"`
-	Uptime    int64         `json:"uptime" db:"uptime"` // seconds
-	CreatedAt time.Time     `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time     `json:"updated_at" db:"updated_at"`
+	ID            string            `json:"id" db:"id"`
+	ProjectID     string            `json:"project_id" db:"project_id"`
+	Name          string            `json:"name" db:"name"`
+	Region        string            `json:"region" db:"region"`
+	Labels        map[string]string `json:"labels" db:"labels"`
+	Image         string            `json:"image" db:"image"`
+	Version       string            `json:"version" db:"version"`
+	Status        ServiceStatus     `json:"status" db:"status"`                 // observed
+	DesiredStatus ServiceStatus     `json:"desired_status" db:"desired_status"` // requested
+	StatusMessage string            `json:"status_message,omitempty" db:"status_message"`
+	NodeID        string            `json:"node_id,omitempty" db:"node_id"` // empty when not scheduled onto a node
+	Uptime        int64             `json:"uptime" db:"uptime"`             // seconds
+	CreatedAt     time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at" db:"updated_at"`
 }
 
+// CreateServiceRequest creates a service in ProjectID, or in the default
+// project when empty.
 type CreateServiceRequest struct {
-	Name    string `json:"name" binding:"required"`
-	Region  string `json:"region" binding:"required"`
-	Image   string `json:"image" binding:"required"`
-	Version string `json:"version" binding:"required"`
+	ProjectID string            `json:"project_id,omitempty"`
+	Name      string            `json:"name" binding:"required"`
+	Region    string            `json:"region" binding:"required"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Image     string            `json:"image" binding:"required"`
+	Version   string            `json:"version" binding:"required"`
 }
 
+// UpdateServiceRequest changes the desired state of a service. Status is
+// accepted as an alias for DesiredStatus for older clients. Labels, when
+// given, replace the service's labels.
 type UpdateServiceRequest struct {
-	Status  *ServiceStatus `json:"status,omitempty"`
-	Version *string        `json:"version,omitempty"`
+	DesiredStatus *ServiceStatus     `json:"desired_status,omitempty"`
+	Status        *ServiceStatus     `json:"status,omitempty"`
+	Version       *string            `json:"version,omitempty"`
+	Labels        *map[string]string `json:"labels,omitempty"`
 }
 
 type ServiceMetrics struct {
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// ServiceAccount is a non-human identity for automation such as CI. It
+// authenticates with API keys and acts with its role.
+type ServiceAccount struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Role        string    `json:"role"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ServiceAccountRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Role        string `json:"role" binding:"required"`
+}
+
+// APIKey is a key belonging to a service account. Only a hash of the key is
+// stored; Prefix identifies it in listings.
+type APIKey struct {
+	ID               string     `json:"id"`
+	ServiceAccountID string     `json:"service_account_id"`
+	Name             string     `json:"name"`
+	Prefix           string     `json:"prefix"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedBy        string     `json:"created_by,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// APIKeyRequest creates a key. Without ExpiresInDays the key does not
+// expire.
+type APIKeyRequest struct {
+	Name          string `json:"name" binding:"required"`
+	ExpiresInDays *int   `json:"expires_in_days"`
+}
+
+// RotateAPIKeyRequest replaces a key. The old key keeps working for
+// GraceSeconds, so deployments using it can be updated first.
+type RotateAPIKeyRequest struct {
+	GraceSeconds int `json:"grace_seconds"`
+}
+
+// CreateAPIKeyResponse carries a newly issued key, which is not shown again.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
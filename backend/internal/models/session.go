@@ -0,0 +1,11 @@
+package models
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// LogoutRequest optionally names the refresh token to revoke along with
+// the access token.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
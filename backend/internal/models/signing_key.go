@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// SigningKey describes a key in the JWT key ring. It signs tokens from
+// ActiveAt until a newer key becomes active, and is published for
+// verification until ExpiresAt, which is set once it has been replaced.
+type SigningKey struct {
+	Kid       string     `json:"kid"`
+	Algorithm string     `json:"algorithm"`
+	CreatedAt time.Time  `json:"created_at"`
+	ActiveAt  time.Time  `json:"active_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
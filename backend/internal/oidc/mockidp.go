@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const mockCodeTTL = time.Minute
+
+// MockUsers are the accounts the development mock IdP offers, with their
+// groups.
+var MockUsers = map[string][]string{
+	"admin@example.com":    {"stratus-admins"},
+	"operator@example.com": {"stratus-operators"},
+	"viewer@example.com":   {"stratus-viewers"},
+}
+
+// MockIdP is a minimal OpenID provider for local development and tests.
+// It signs in any of its users without a password: the one named by
+// login_hint, or the one picked from a list. It implements discovery, the
+// authorization code flow with S256 PKCE, and a JWKS endpoint.
+type MockIdP struct {
+	issuer string
+	users  map[string][]string
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+	expires     time.Time
+}
+
+// NewMockIdP creates a provider whose issuer is the URL it is served at.
+func NewMockIdP(issuer string, users map[string][]string) (*MockIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockIdP{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		users:  users,
+		key:    key,
+		kid:    "mock-1",
+		codes:  make(map[string]mockGrant),
+	}, nil
+}
+
+func (m *MockIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.issuer,
+			"authorization_endpoint":                m.issuer + "/authorize",
+			"token_endpoint":                        m.issuer + "/token",
+			"jwks_uri":                              m.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	case "/jwks":
+		jwk, _ := NewJWK(m.kid, &m.key.PublicKey)
+		writeJSON(w, http.StatusOK, JWKS{Keys: []JWK{jwk}})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var mockLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>Mock IdP</title>
+<h1>Sign in as</h1>
+<ul>{{range .}}<li><a href="{{.URL}}">{{.Email}}</a> {{.Groups}}</li>{{end}}</ul>
+`))
+
+func (m *MockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "redirect_uri must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" {
+		http.Error(w, "response_type must be code and client_id is required", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+
+	email := q.Get("login_hint")
+	if email == "" {
+		m.loginPage(w, r)
+		return
+	}
+	if _, ok := m.users[email]; !ok {
+		http.Error(w, fmt.Sprintf("unknown user %q", email), http.StatusBadRequest)
+		return
+	}
+
+	code, err := RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = mockGrant{
+		clientID:    q.Get("client_id"),
+		redirectURI: redirectURI.String(),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		email:       email,
+		expires:     time.Now().Add(mockCodeTTL),
+	}
+	m.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockIdP) loginPage(w http.ResponseWriter, r *http.Request) {
+	type option struct {
+		Email  string
+		Groups []string
+		URL    string
+	}
+	var options []option
+	for email, groups := range m.users {
+		q := r.URL.Query()
+		q.Set("login_hint", email)
+		options = append(options, option{Email: email, Groups: groups, URL: r.URL.Path + "?" + q.Encode()})
+	}
+	sort.Slice(options, func(i, j int) bool { return options[i].Email < options[j].Email })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mockLoginPage.Execute(w, options)
+}
+
+func (m *MockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	challenge := Challenge(r.PostForm.Get("code_verifier"))
+	if !ok || time.Now().After(grant.expires) ||
+		grant.clientID != r.PostForm.Get("client_id") ||
+		grant.redirectURI != r.PostForm.Get("redirect_uri") ||
+		subtle.ConstantTimeCompare([]byte(grant.challenge), []byte(challenge)) != 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.issuer,
+		"sub":            "mock|" + grant.email,
+		"aud":            grant.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          grant.nonce,
+		"email":          grant.email,
+		"email_verified": true,
+		"name":           strings.Split(grant.email, "@")[0],
+		"groups":         m.users[grant.email],
+	})
+	token.Header["kid"] = m.kid
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	accessToken, _ := RandomString()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,123 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	if got := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Challenge() = %s", got)
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pub := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		jwk, err := NewJWK("k", pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("PublicKey() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, pub) {
+			t.Errorf("%s key did not survive the round trip", jwk.Kty)
+		}
+	}
+
+	bad, _ := NewJWK("k", &ecKey.PublicKey)
+	bad.Y = bad.X
+	if _, err := bad.PublicKey(); err == nil {
+		t.Error("PublicKey() should reject points off the curve")
+	}
+}
+
+func TestProviderFlow(t *testing.T) {
+	var mock *MockIdP
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	var err error
+	mock, err = NewMockIdP(srv.URL, map[string][]string{"ops@example.com": {"sre", "oncall"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(Config{Issuer: srv.URL, ClientID: "stratus", RedirectURL: "http://localhost/callback"})
+	ctx := context.Background()
+
+	login := func(nonce, verifier string) string {
+		authURL, err := p.AuthCodeURL(ctx, "state-1", nonce, verifier, url.Values{"login_hint": {"ops@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || callback.Query().Get("state") != "state-1" {
+			t.Fatalf("unexpected redirect %q", resp.Header.Get("Location"))
+		}
+		return callback.Query().Get("code")
+	}
+
+	code := login("nonce-1", "verifier-1")
+	if _, err := p.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Fatal("Exchange() should fail with the wrong PKCE verifier")
+	}
+
+	code = login("nonce-1", "verifier-1")
+	raw, err := p.Exchange(ctx, code, "verifier-1")
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, err := p.Exchange(ctx, code, "verifier-1"); err == nil {
+		t.Error("a code should only be redeemable once")
+	}
+
+	token, err := p.Verify(ctx, raw, "nonce-1")
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if token.Email != "ops@example.com" || token.Subject == "" || !reflect.DeepEqual(token.Groups, []string{"sre", "oncall"}) {
+		t.Errorf("Verify() = %+v", token)
+	}
+
+	if _, err := p.Verify(ctx, raw, "nonce-2"); err == nil {
+		t.Error("Verify() should reject a token for another login")
+	}
+	parts := strings.Split(raw, ".")
+	if _, err := p.Verify(ctx, parts[0]+"."+parts[1]+".AAAA", "nonce-1"); err == nil {
+		t.Error("Verify() should reject a bad signature")
+	}
+
+	other := NewProvider(Config{Issuer: srv.URL, ClientID: "someone-else", RedirectURL: "http://localhost/callback"})
+	if _, err := other.Verify(ctx, raw, "nonce-1"); err == nil {
+		t.Error("Verify() should reject a token issued to another client")
+	}
+}
@@ -0,0 +1,341 @@
+package reconciler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stratus/backend/internal/models"
+	"github.com/stratus/backend/internal/websocket"
+)
+
+const (
+	defaultInterval = 5 * time.Second
+	baseBackoff     = 2 * time.Second
+	maxBackoff      = 2 * time.Minute
+	queryTimeout    = 5 * time.Second
+	// startTimeout bounds how long a service may sit in starting while an
+	// asynchronous driver (an edge agent) brings it up.
+	startTimeout = 2 * time.Minute
+)
+
+// serviceColumns is the column list scanService expects, in order. It
+// matches the handlers' own, which cannot be shared since they import this
+// package.
+const serviceColumns = "id, project_id, name, region, labels, image, version, status, desired_status, status_message, COALESCE(node_id, ''), uptime, created_at, updated_at"
+
+// ErrInProgress is returned by a Driver whose start completes asynchronously.
+// The service stays in starting until someone else records the observed
+// status, or until startTimeout passes and the start is retried.
+var ErrInProgress = errors.New("start in progress")
+
+// Driver performs the actual work of starting and stopping a service.
+type Driver interface {
+	Start(ctx context.Context, service models.Service) error
+	Stop(ctx context.Context, service models.Service) error
+}
+
+// NoopDriver starts and stops services without doing anything. It stands in
+// when the workload runs outside the control plane and reports its own
+// metrics.
+type NoopDriver struct{}
+
+func (NoopDriver) Start(ctx context.Context, service models.Service) error { return nil }
+func (NoopDriver) Stop(ctx context.Context, service models.Service) error  { return nil }
+
+type action int
+
+const (
+	actionNone action = iota
+	actionStart
+	actionStop
+)
+
+type retryState struct {
+	attempts int
+	next     time.Time
+}
+
+// Reconciler drives the observed status of every service toward its desired
+// status. Every observed transition is persisted and broadcast on the hub.
+type Reconciler struct {
+	db       *sql.DB
+	hub      *websocket.Hub
+	driver   Driver
+	interval time.Duration
+	trigger  chan string
+	retries  map[string]*retryState // owned by the Run goroutine
+}
+
+func New(db *sql.DB, hub *websocket.Hub, driver Driver) *Reconciler {
+	return &Reconciler{
+		db:       db,
+		hub:      hub,
+		driver:   driver,
+		interval: defaultInterval,
+		trigger:  make(chan string, 64),
+		retries:  make(map[string]*retryState),
+	}
+}
+
+// Trigger asks the reconciler to look at a service now instead of waiting for
+// the next periodic pass. It never blocks; a dropped trigger is picked up by
+// the next pass.
+func (r *Reconciler) Trigger(serviceID string) {
+	select {
+	case r.trigger <- serviceID:
+	default:
+	}
+}
+
+// Run reconciles until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) {
+	r.resync(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-r.trigger:
+			r.reconcile(ctx, id)
+		case <-ticker.C:
+			r.reconcileAll(ctx)
+		}
+	}
+}
+
+// resync restarts services that were running before the control plane
+// restarted, since the driver does not survive a restart.
+func (r *Reconciler) resync(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	services, err := r.query(qctx, "WHERE status = $1 AND desired_status = $1", models.StatusRunning)
+	if err != nil {
+		log.Printf("reconciler: resync failed: %v", err)
+		return
+	}
+
+	for _, s := range services {
+		if err := r.driver.Start(ctx, s); err != nil && !errors.Is(err, ErrInProgress) {
+			r.fail(ctx, s, "start", err)
+		}
+	}
+}
+
+func (r *Reconciler) reconcileAll(ctx context.Context) {
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	services, err := r.query(qctx, "WHERE status <> desired_status")
+	if err != nil {
+		log.Printf("reconciler: failed to list services: %v", err)
+		return
+	}
+
+	for _, s := range services {
+		r.step(ctx, s)
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, serviceID string) {
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	services, err := r.query(qctx, "WHERE id = $1", serviceID)
+	if err != nil {
+		log.Printf("reconciler: failed to load service %s: %v", serviceID, err)
+		return
+	}
+	if len(services) == 0 {
+		delete(r.retries, serviceID)
+		return
+	}
+
+	r.step(ctx, services[0])
+}
+
+func (r *Reconciler) step(ctx context.Context, s models.Service) {
+	act := plan(s.DesiredStatus, s.Status)
+	if act == actionNone {
+		delete(r.retries, s.ID)
+		return
+	}
+
+	if rs, ok := r.retries[s.ID]; ok && time.Now().Before(rs.next) {
+		return
+	}
+
+	switch act {
+	case actionStart:
+		if s.Status == models.StatusStarting {
+			if time.Since(s.UpdatedAt) < startTimeout {
+				return
+			}
+			r.fail(ctx, s, "start", fmt.Errorf("no running status reported within %s", startTimeout))
+			return
+		}
+
+		// Another replica got to it first
+		if !r.transition(ctx, &s, models.StatusStarting, "") {
+			return
+		}
+		if err := r.driver.Start(ctx, s); err != nil {
+			if errors.Is(err, ErrInProgress) {
+				return
+			}
+			r.fail(ctx, s, "start", err)
+			return
+		}
+		delete(r.retries, s.ID)
+		if !r.transition(ctx, &s, models.StatusRunning, "") {
+			return
+		}
+		r.createDeploymentLog(s.ID, "start", "success", "Service reached desired status running")
+
+	case actionStop:
+		if err := r.driver.Stop(ctx, s); err != nil {
+			r.fail(ctx, s, "stop", err)
+			return
+		}
+		delete(r.retries, s.ID)
+		if !r.transition(ctx, &s, models.StatusStopped, "") {
+			return
+		}
+		r.createDeploymentLog(s.ID, "stop", "success", "Service reached desired status stopped")
+	}
+}
+
+// fail records a failed transition and schedules the next attempt.
+func (r *Reconciler) fail(ctx context.Context, s models.Service, action string, cause error) {
+	rs, ok := r.retries[s.ID]
+	if !ok {
+		rs = &retryState{}
+		r.retries[s.ID] = rs
+	}
+	rs.attempts++
+	delay := backoff(rs.attempts)
+	rs.next = time.Now().Add(delay)
+
+	message := fmt.Sprintf("%s failed (attempt %d): %v; retrying in %s", action, rs.attempts, cause, delay)
+	if r.transition(ctx, &s, models.StatusError, message) {
+		r.createDeploymentLog(s.ID, action, "failed", message)
+	}
+}
+
+// transition records the service's new status if it is still in the status
+// it was read with, and reports whether it was. Replicas reconciling the same
+// service thus record and broadcast each transition once.
+func (r *Reconciler) transition(ctx context.Context, s *models.Service, status models.ServiceStatus, message string) bool {
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	updated, err := scanService(r.db.QueryRowContext(qctx,
+		"UPDATE services SET status = $1, status_message = $2, updated_at = $3 WHERE id = $4 AND status = $5 RETURNING "+serviceColumns,
+		status, message, time.Now(), s.ID, s.Status,
+	))
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("reconciler: failed to record %s for service %s: %v", status, s.ID, err)
+		return false
+	}
+	*s = updated
+
+	r.hub.BroadcastJSON(websocket.MessageTypeServiceUpdate, s)
+	return true
+}
+
+func (r *Reconciler) query(ctx context.Context, where string, args ...interface{}) ([]models.Service, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+serviceColumns+" FROM services "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []models.Service{}
+	for rows.Next() {
+		s, err := scanService(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanService(row rowScanner) (models.Service, error) {
+	var s models.Service
+	var labels []byte
+	if err := row.Scan(&s.ID, &s.ProjectID, &s.Name, &s.Region, &labels, &s.Image, &s.Version, &s.Status, &s.DesiredStatus, &s.StatusMessage, &s.NodeID, &s.Uptime, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return s, err
+	}
+	err := json.Unmarshal(labels, &s.Labels)
+	return s, err
+}
+
+func (r *Reconciler) createDeploymentLog(serviceID, action, status, message string) {
+	entry := models.DeploymentLog{
+		ID:        uuid.New().String(),
+		ServiceID: serviceID,
+		Action:    action,
+		Status:    status,
+		Message:   message,
+		CreatedAt: time.Now(),
+	}
+
+	r.db.Exec(
+		`INSERT INTO deployment_logs (id, service_id, action, status, message, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.ID, entry.ServiceID, entry.Action, entry.Status, entry.Message, entry.CreatedAt,
+	)
+
+	r.hub.BroadcastJSON(websocket.MessageTypeLog, entry)
+}
+
+// plan decides what the reconciler has to do to move observed toward desired.
+// A service in starting still needs a start; step decides whether to keep
+// waiting for it or to give up and retry.
+func plan(desired, observed models.ServiceStatus) action {
+	switch desired {
+	case models.StatusRunning:
+		if observed == models.StatusRunning {
+			return actionNone
+		}
+		return actionStart
+	case models.StatusStopped:
+		if observed == models.StatusStopped {
+			return actionNone
+		}
+		return actionStop
+	}
+	return actionNone
+}
+
+// backoff returns the delay before retry number attempt (starting at 1).
+func backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := baseBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
@@ -0,0 +1,53 @@
+package reconciler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stratus/backend/internal/models"
+)
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  models.ServiceStatus
+		observed models.ServiceStatus
+		want     action
+	}{
+		{"running in sync", models.StatusRunning, models.StatusRunning, actionNone},
+		{"stopped in sync", models.StatusStopped, models.StatusStopped, actionNone},
+		{"start stopped service", models.StatusRunning, models.StatusStopped, actionStart},
+		{"retry errored service", models.StatusRunning, models.StatusError, actionStart},
+		{"resume interrupted start", models.StatusRunning, models.StatusStarting, actionStart},
+		{"stop running service", models.StatusStopped, models.StatusRunning, actionStop},
+		{"stop errored service", models.StatusStopped, models.StatusError, actionStop},
+		{"unknown desired status", models.StatusError, models.StatusRunning, actionNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := plan(tt.desired, tt.observed); got != tt.want {
+				t.Errorf("plan(%s, %s) = %v, want %v", tt.desired, tt.observed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, baseBackoff},
+		{1, baseBackoff},
+		{2, 2 * baseBackoff},
+		{3, 4 * baseBackoff},
+		{20, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package router
 
 import (
+	"context"
 	"database/sql"
+	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -10,6 +13,9 @@ import (
 	"github.com/stratus/backend/internal/config"
 	"github.com/stratus/backend/internal/handlers"
 	"github.com/stratus/backend/internal/middleware"
+	"github.com/stratus/backend/internal/oidc"
+	"github.com/stratus/backend/internal/reconciler"
+	"github.com/stratus/backend/internal/telemetry"
 	"github.com/stratus/backend/internal/websocket"
 )
 
@@ -47,7 +53,7 @@ func Setup(cfg *config.Config, db *sql.DB, redisClient *redis.Client, hub *webso
 		
 		if allowed {
 			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Request-ID")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Request-ID, Last-Event-ID")
 			c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE, PATCH")
 		}
 
@@ -61,13 +67,58 @@ func Setup(cfg *config.Config, db *sql.DB, redisClient *redis.Client, hub *webso
 
 	// Initialize middleware
 	auth := middleware.NewAuthMiddleware(cfg.JWTSecret)
+	var signingKeyHandler *handlers.SigningKeyHandler
+	if cfg.JWTAlgorithm == "HS256" {
+		if cfg.Environment == "production" && cfg.JWTSecret == config.DefaultJWTSecret {
+			log.Fatal("JWT_SECRET must be set in production when JWT_ALGORITHM is HS256")
+		}
+	} else {
+		var err error
+		signingKeyHandler, err = handlers.NewSigningKeyHandler(db, cfg.JWTAlgorithm, cfg.JWTKeyRotation)
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing keys: %v", err)
+		}
+		go signingKeyHandler.Run(context.Background())
+		auth.UseSigningKeys(signingKeyHandler, cfg.JWTIssuer)
+	}
 	rateLimiter := middleware.NewRateLimiter(100, time.Minute) // 100 requests per minute
 
 	// Initialize handlers
-	metricsHandler := handlers.NewMetricsHandler(redisClient, hub)
-	serviceHandler := handlers.NewServiceHandler(db, hub, metricsHandler)
+	quotaHandler := handlers.NewQuotaHandler(db)
+	projectHandler := handlers.NewProjectHandler(db, hub, quotaHandler)
+	auth.UseProjects(projectHandler)
+	hub.UseProjects(projectHandler.ProjectOf)
+	hub.ListenRelayed(projectHandler.ForgetMovedService)
+	metricsHandler := handlers.NewMetricsHandler(db, redisClient, hub)
+	go metricsHandler.RunRollups(context.Background())
+	assignmentHandler := handlers.NewAssignmentHandler(db, hub)
+	// Services in regions without nodes are "run" locally; only simulate
+	// metrics for them when asked to
+	var localDriver reconciler.Driver = reconciler.NoopDriver{}
+	if cfg.SimulateMetrics {
+		localDriver = handlers.NewSimulatorDriver(metricsHandler)
+	}
+	rec := reconciler.New(db, hub, handlers.NewNodeDriver(db, assignmentHandler, localDriver))
+	go rec.Run(context.Background())
+	roleBindingHandler := handlers.NewRoleBindingHandler(db)
+	serviceHandler := handlers.NewServiceHandler(db, hub, metricsHandler, rec, assignmentHandler, roleBindingHandler, quotaHandler)
 	wsHandler := handlers.NewWebSocketHandler(hub, cfg.CORSOrigins)
+	eventsHandler := handlers.NewEventsHandler(hub)
 	logsHandler := handlers.NewLogsHandler(db)
+	nodeHandler := handlers.NewNodeHandler(db, hub)
+	go nodeHandler.RunHealthMonitor(context.Background())
+	deploymentHandler := handlers.NewDeploymentHandler(db, hub, metricsHandler, assignmentHandler, roleBindingHandler)
+	go deploymentHandler.Run(context.Background())
+	configHandler := handlers.NewConfigHandler(db, hub, assignmentHandler)
+	alertHandler := handlers.NewAlertHandler(db, hub, metricsHandler)
+	go alertHandler.Run(context.Background())
+	webhookHandler := handlers.NewWebhookHandler(db, hub)
+	go webhookHandler.Run(context.Background())
+	serviceAccountHandler := handlers.NewServiceAccountHandler(db)
+	auth.UseAPIKeys(serviceAccountHandler)
+	sessionHandler := handlers.NewSessionHandler(redisClient, auth)
+	auth.UseRevocations(sessionHandler)
+	auditHandler := handlers.NewAuditHandler(db)
 
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
@@ -77,6 +128,32 @@ func Setup(cfg *config.Config, db *sql.DB, redisClient *redis.Client, hub *webso
 		})
 	})
 
+	// Prometheus metrics
+	telemetry.Default.Register(telemetry.CollectorFunc(func() []telemetry.Family {
+		stats := db.Stats()
+		return []telemetry.Family{
+			telemetry.Gauge("stratus_websocket_clients", "Connected WebSocket clients.", float64(hub.ClientCount())),
+			telemetry.Gauge("stratus_active_simulators", "Services with a running metrics simulator.", float64(metricsHandler.ActiveSimulators())),
+			telemetry.Gauge("stratus_db_open_connections", "Open database connections.", float64(stats.OpenConnections)),
+			telemetry.Gauge("stratus_db_in_use_connections", "Database connections in use.", float64(stats.InUse)),
+			telemetry.Gauge("stratus_db_idle_connections", "Idle database connections.", float64(stats.Idle)),
+			telemetry.Gauge("stratus_db_max_open_connections", "Maximum open database connections.", float64(stats.MaxOpenConnections)),
+			{Name: "stratus_db_wait_count_total", Help: "Connections waited for.", Type: telemetry.TypeCounter,
+				Samples: []telemetry.Sample{{Value: float64(stats.WaitCount)}}},
+			{Name: "stratus_db_wait_duration_seconds_total", Help: "Time spent waiting for connections.", Type: telemetry.TypeCounter,
+				Samples: []telemetry.Sample{{Value: stats.WaitDuration.Seconds()}}},
+		}
+	}))
+	if cfg.ExportServiceMetrics {
+		telemetry.Default.Register(metricsHandler.ServiceCollector())
+	}
+	r.GET("/metrics", telemetry.Handler(telemetry.Default, cfg.MetricsToken))
+
+	// Public keys for verifying the tokens we issue
+	if signingKeyHandler != nil {
+		r.GET("/.well-known/jwks.json", signingKeyHandler.JWKS)
+	}
+
 	// API v1
 	v1 := r.Group("/api/v1")
 	{
@@ -85,58 +162,202 @@ func Setup(cfg *config.Config, db *sql.DB, redisClient *redis.Client, hub *webso
 		public.Use(auth.AuthRequired())
 		public.Use(auth.RequireRole(middleware.RoleViewer))
 		{
+			// Services, and what belongs to them, are only found in the
+			// caller's projects
+			inProject := projectHandler.RequireServiceProject()
+			public.GET("/projects", projectHandler.ListProjects)
+			public.GET("/projects/:id", projectHandler.GetProject)
+			public.GET("/projects/:id/quota", quotaHandler.GetProjectQuota)
+			public.GET("/users/:user_id/quota", quotaHandler.GetUserQuota)
 			public.GET("/services", serviceHandler.ListServices)
-			public.GET("/services/:id", serviceHandler.GetService)
-			public.GET("/metrics/:id", metricsHandler.GetMetrics)
+			public.GET("/services/:id", inProject, serviceHandler.GetService)
+			public.GET("/metrics/:id", inProject, metricsHandler.GetMetrics)
 			public.GET("/metrics/aggregated", metricsHandler.GetAggregatedMetrics)
 			public.GET("/logs/deployment", logsHandler.GetDeploymentLogs)
+			public.GET("/services/:id/deployments", inProject, deploymentHandler.ListDeployments)
+			public.GET("/services/:id/revisions", inProject, serviceHandler.ListRevisions)
+			public.GET("/services/:id/config", inProject, configHandler.GetConfig)
+			public.GET("/services/:id/config/versions", inProject, configHandler.ListConfigVersions)
+			public.GET("/services/:id/config/versions/:version", inProject, configHandler.GetConfigVersion)
+			public.GET("/services/:id/config/diff", inProject, configHandler.DiffConfig)
+			public.GET("/services/:id/config/schema", inProject, configHandler.GetConfigSchema)
+			public.GET("/deployments/:id", projectHandler.RequireDeploymentProject(), deploymentHandler.GetDeployment)
+			public.GET("/nodes", nodeHandler.ListNodes)
+			public.GET("/nodes/:id", nodeHandler.GetNode)
+			public.GET("/alerts", alertHandler.ListAlerts)
+			public.GET("/alerts/:id", alertHandler.GetAlert)
+			public.GET("/alert-rules", alertHandler.ListAlertRules)
+			public.GET("/alert-rules/:id", alertHandler.GetAlertRule)
+			public.GET("/can-i", roleBindingHandler.CanI)
+		}
+
+		// Service endpoints. The role each needs is checked against the
+		// service itself, so role bindings can grant it on some services
+		// only.
+		services := v1.Group("")
+		services.Use(auditHandler.Record())
+		services.Use(auth.AuthRequired())
+		services.Use(auth.RequireRole(middleware.RoleViewer))
+		services.Use(rateLimiter.Limit())
+		{
+			inProject := projectHandler.RequireServiceProject()
+			serviceOperator := roleBindingHandler.RequireServiceRole(middleware.RoleOperator)
+			services.POST("/services", serviceHandler.CreateService)
+			services.PATCH("/services/:id", inProject, serviceOperator, serviceHandler.UpdateService)
+			services.POST("/services/:id/deployments", inProject, serviceOperator, deploymentHandler.CreateDeployment)
+			services.POST("/services/:id/rollback", inProject, serviceOperator, serviceHandler.RollbackService)
+			services.POST("/services/:id/ingest-token", inProject, serviceOperator, metricsHandler.IssueIngestToken)
+			services.PUT("/services/:id/config", inProject, serviceOperator, configHandler.PutConfig)
+			services.PUT("/services/:id/config/schema", inProject, serviceOperator, configHandler.PutConfigSchema)
+			services.DELETE("/services/:id/config/schema", inProject, serviceOperator, configHandler.DeleteConfigSchema)
+			services.POST("/deployments/:id/abort", projectHandler.RequireDeploymentProject(), deploymentHandler.AbortDeployment)
+			services.DELETE("/services/:id", inProject, roleBindingHandler.RequireServiceRole(middleware.RoleAdmin), serviceHandler.DeleteService)
 		}
 
 		// Operator endpoints (mutating operations)
 		operator := v1.Group("")
+		operator.Use(auditHandler.Record())
 		operator.Use(auth.AuthRequired())
 		operator.Use(auth.RequireRole(middleware.RoleOperator))
 		operator.Use(rateLimiter.Limit()) // Rate limit mutating operations
 		{
-			operator.POST("/services", serviceHandler.CreateService)
-			operator.PATCH("/services/:id", serviceHandler.UpdateService)
+			operator.POST("/nodes", nodeHandler.RegisterNode)
+			operator.POST("/alert-rules", alertHandler.CreateAlertRule)
+			operator.PUT("/alert-rules/:id", alertHandler.UpdateAlertRule)
+			operator.DELETE("/alert-rules/:id", alertHandler.DeleteAlertRule)
 		}
 
 		// Admin endpoints
 		admin := v1.Group("")
+		admin.Use(auditHandler.Record())
 		admin.Use(auth.AuthRequired())
 		admin.Use(auth.RequireRole(middleware.RoleAdmin))
 		admin.Use(rateLimiter.Limit())
 		{
-			admin.DELETE("/services/:id", serviceHandler.DeleteService)
+			admin.DELETE("/nodes/:id", nodeHandler.DeregisterNode)
+			admin.GET("/webhooks", webhookHandler.ListWebhooks)
+			admin.POST("/webhooks", webhookHandler.CreateWebhook)
+			admin.GET("/webhooks/:id", webhookHandler.GetWebhook)
+			admin.PUT("/webhooks/:id", webhookHandler.UpdateWebhook)
+			admin.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook)
+			admin.GET("/webhook-deliveries", webhookHandler.ListDeliveries)
+			admin.GET("/webhook-deliveries/:id", webhookHandler.GetDelivery)
+			admin.POST("/webhook-deliveries/:id/retry", webhookHandler.RetryDelivery)
+			admin.GET("/service-accounts", serviceAccountHandler.ListServiceAccounts)
+			admin.POST("/service-accounts", serviceAccountHandler.CreateServiceAccount)
+			admin.GET("/service-accounts/:id", serviceAccountHandler.GetServiceAccount)
+			admin.DELETE("/service-accounts/:id", serviceAccountHandler.DeleteServiceAccount)
+			admin.GET("/service-accounts/:id/api-keys", serviceAccountHandler.ListAPIKeys)
+			admin.POST("/service-accounts/:id/api-keys", serviceAccountHandler.CreateAPIKey)
+			admin.POST("/api-keys/:id/rotate", serviceAccountHandler.RotateAPIKey)
+			admin.DELETE("/api-keys/:id", serviceAccountHandler.RevokeAPIKey)
+			admin.POST("/users/:user_id/revoke-sessions", sessionHandler.RevokeUserSessions)
+			admin.GET("/role-bindings", roleBindingHandler.ListRoleBindings)
+			admin.POST("/role-bindings", roleBindingHandler.CreateRoleBinding)
+			admin.GET("/role-bindings/:id", roleBindingHandler.GetRoleBinding)
+			admin.DELETE("/role-bindings/:id", roleBindingHandler.DeleteRoleBinding)
+			admin.GET("/organizations", projectHandler.ListOrganizations)
+			admin.POST("/organizations", projectHandler.CreateOrganization)
+			admin.DELETE("/organizations/:id", projectHandler.DeleteOrganization)
+			admin.POST("/projects", projectHandler.CreateProject)
+			admin.DELETE("/projects/:id", projectHandler.DeleteProject)
+			admin.GET("/projects/:id/members", projectHandler.ListProjectMembers)
+			admin.POST("/projects/:id/members", projectHandler.AddProjectMember)
+			admin.DELETE("/projects/:id/members/:kind/:subject", projectHandler.RemoveProjectMember)
+			admin.POST("/services/:id/move", projectHandler.MoveService)
+			admin.PUT("/projects/:id/quota", quotaHandler.PutProjectQuota)
+			admin.DELETE("/projects/:id/quota", quotaHandler.DeleteProjectQuota)
+			admin.PUT("/users/:user_id/quota", quotaHandler.PutUserQuota)
+			admin.DELETE("/users/:user_id/quota", quotaHandler.DeleteUserQuota)
+			admin.GET("/audit-log", auditHandler.ListAuditLog)
+			admin.GET("/audit-log/export", auditHandler.ExportAuditLog)
+			if signingKeyHandler != nil {
+				admin.GET("/signing-keys", signingKeyHandler.ListSigningKeys)
+				admin.POST("/signing-keys/rotate", signingKeyHandler.RotateSigningKey)
+			}
+		}
+
+		// Metrics ingestion (authenticated by the service's ingestion token
+		// or the token of the node running it)
+		ingest := v1.Group("/metrics/:id")
+		ingest.Use(metricsHandler.IngestAuth())
+		{
+			ingest.POST("", metricsHandler.IngestMetrics)
+			ingest.POST("/batch", metricsHandler.IngestMetricsBatch)
+		}
+
+		// Agent endpoints (authenticated by node token, not JWT)
+		agent := v1.Group("/nodes/:id")
+		agent.Use(nodeHandler.AgentAuth())
+		{
+			agent.POST("/heartbeat", nodeHandler.Heartbeat)
+			agent.GET("/assignments", assignmentHandler.GetAssignments)
+			agent.POST("/status", assignmentHandler.ReportStatus)
 		}
 	}
 
-	// WebSocket endpoint (requires auth)
+	// WebSocket and Server-Sent Events endpoints (require auth)
 	ws := r.Group("")
 	ws.Use(auth.AuthRequired())
 	{
 		ws.GET("/ws", wsHandler.HandleWebSocket)
+		ws.GET("/events", eventsHandler.StreamEvents)
 	}
 
+	// Session tokens
+	r.POST("/auth/refresh", auditHandler.Record(), sessionHandler.Refresh)
+	r.POST("/auth/logout", auditHandler.Record(), auth.AuthRequired(), sessionHandler.Logout)
+
 	// Token generation endpoint (for development/testing)
 	if cfg.Environment == "development" {
 		r.POST("/auth/token", func(c *gin.Context) {
 			var req struct {
-				UserID string `json:"user_id" binding:"required"`
-				Role   string `json:"role" binding:"required"`
+				UserID string   `json:"user_id" binding:"required"`
+				Role   string   `json:"role" binding:"required"`
+				Groups []string `json:"groups"`
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
-			token, err := auth.GenerateToken(req.UserID, middleware.Role(req.Role))
+			projects, err := auth.Projects(c.Request.Context(), req.UserID, req.Groups)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
+			tokens, err := auth.GenerateTokenPair(req.UserID, middleware.Role(req.Role), req.Groups, projects)
 			if err != nil {
 				c.JSON(500, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(200, gin.H{"token": token})
+			c.JSON(200, tokens)
 		})
+
+		if cfg.OIDCMockIdP {
+			mock, err := oidc.NewMockIdP(cfg.OIDCIssuer, oidc.MockUsers)
+			if err != nil {
+				log.Fatalf("Failed to start mock IdP: %v", err)
+			}
+			r.Any("/mock-idp/*path", gin.WrapH(http.StripPrefix("/mock-idp", mock)))
+		}
+	}
+
+	// OIDC single sign-on
+	if cfg.OIDCIssuer != "" {
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       strings.Fields(cfg.OIDCScopes),
+			GroupsClaim:  cfg.OIDCGroupsClaim,
+		})
+		oidcHandler, err := handlers.NewOIDCHandler(provider, redisClient, auth, cfg.OIDCRoleMapping, cfg.OIDCDefaultRole, cfg.OIDCPostLoginURL)
+		if err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+		r.GET("/auth/oidc/login", oidcHandler.Login)
+		r.GET("/auth/oidc/callback", oidcHandler.Callback)
 	}
 
 	return r
@@ -0,0 +1,29 @@
+package telemetry
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stratus/backend/internal/errors"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the registry. With a non-empty token, scrapers must send it
+// as a bearer token.
+func Handler(r *Registry, token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token != "" {
+			want := []byte("Bearer " + token)
+			if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), want) != 1 {
+				errors.Unauthorized(c, "Invalid metrics token")
+				return
+			}
+		}
+
+		c.Status(http.StatusOK)
+		c.Header("Content-Type", contentType)
+		r.WriteTo(c.Writer)
+	}
+}
@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Requests.", "route", "status")
+	requests.Inc("/a", "200")
+	requests.Inc("/a", "200")
+	requests.Add(3, `/b"x`, "500")
+
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(5, "/a")
+
+	r := NewRegistry()
+	r.Register(latency, requests, CollectorFunc(func() []Family {
+		return []Family{Gauge("test_clients", "Connected clients.", 4)}
+	}))
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := `# HELP test_clients Connected clients.
+# TYPE test_clients gauge
+test_clients 4
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="/a",le="0.1"} 1
+test_latency_seconds_bucket{route="/a",le="1"} 2
+test_latency_seconds_bucket{route="/a",le="+Inf"} 3
+test_latency_seconds_sum{route="/a"} 5.55
+test_latency_seconds_count{route="/a"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",status="200"} 2
+test_requests_total{route="/b\"x",status="500"} 3
+`
+	if b.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
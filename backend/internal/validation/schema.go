@@ -0,0 +1,288 @@
+package validation
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The config schema support is a subset of JSON Schema: type, properties,
+// required, additionalProperties, items, enum, minimum, maximum, minLength,
+// maxLength, pattern, minItems and maxItems. Other keywords (title,
+// description, default, $schema, ...) are accepted and ignored.
+//
+// Documents are expected in the shape encoding/json decodes into
+// interface{}: map[string]interface{}, []interface{}, float64, string, bool
+// and nil.
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// ValidateSchema checks that a schema only uses the supported keywords in
+// the shapes ValidateAgainstSchema expects.
+func ValidateSchema(schema map[string]interface{}) error {
+	return checkSchema(schema, "schema")
+}
+
+func checkSchema(schema map[string]interface{}, path string) error {
+	invalid := func(keyword, message string) error {
+		return ValidationError{Field: path + "." + keyword, Message: message}
+	}
+
+	if t, ok := schema["type"]; ok {
+		types, ok := schemaTypeList(t)
+		if !ok {
+			return invalid("type", "type must be a string or an array of strings")
+		}
+		for _, name := range types {
+			if !schemaTypes[name] {
+				return invalid("type", fmt.Sprintf("unknown type %q", name))
+			}
+		}
+	}
+
+	if props, ok := schema["properties"]; ok {
+		m, ok := props.(map[string]interface{})
+		if !ok {
+			return invalid("properties", "properties must be an object")
+		}
+		for name, sub := range m {
+			subSchema, ok := sub.(map[string]interface{})
+			if !ok {
+				return invalid("properties."+name, "property schema must be an object")
+			}
+			if err := checkSchema(subSchema, path+".properties."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if req, ok := schema["required"]; ok {
+		list, ok := req.([]interface{})
+		if !ok {
+			return invalid("required", "required must be an array of strings")
+		}
+		for _, name := range list {
+			if _, ok := name.(string); !ok {
+				return invalid("required", "required must be an array of strings")
+			}
+		}
+	}
+
+	if ap, ok := schema["additionalProperties"]; ok {
+		switch v := ap.(type) {
+		case bool:
+		case map[string]interface{}:
+			if err := checkSchema(v, path+".additionalProperties"); err != nil {
+				return err
+			}
+		default:
+			return invalid("additionalProperties", "additionalProperties must be a boolean or an object")
+		}
+	}
+
+	if items, ok := schema["items"]; ok {
+		sub, ok := items.(map[string]interface{})
+		if !ok {
+			return invalid("items", "items must be an object")
+		}
+		if err := checkSchema(sub, path+".items"); err != nil {
+			return err
+		}
+	}
+
+	if enum, ok := schema["enum"]; ok {
+		if _, ok := enum.([]interface{}); !ok {
+			return invalid("enum", "enum must be an array")
+		}
+	}
+
+	for _, keyword := range []string{"minimum", "maximum", "minLength", "maxLength", "minItems", "maxItems"} {
+		if v, ok := schema[keyword]; ok {
+			if _, ok := v.(float64); !ok {
+				return invalid(keyword, keyword+" must be a number")
+			}
+		}
+	}
+
+	if p, ok := schema["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return invalid("pattern", "pattern must be a string")
+		}
+		if _, err := regexp.Compile(s); err != nil {
+			return invalid("pattern", "pattern is not a valid regular expression")
+		}
+	}
+
+	return nil
+}
+
+// ValidateAgainstSchema validates doc against schema and returns every
+// violation found, with Field set to the path of the offending value
+// relative to root (e.g. "config.listeners[0].port").
+func ValidateAgainstSchema(schema map[string]interface{}, doc interface{}, root string) ValidationErrors {
+	var errs ValidationErrors
+	validateValue(schema, doc, root, &errs)
+	return errs
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, path string, errs *ValidationErrors) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t, ok := schema["type"]; ok {
+		types, _ := schemaTypeList(t)
+		matched := false
+		for _, name := range types {
+			if valueHasType(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must be of type %s", strings.Join(types, " or "))
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the allowed values")
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, ok := v[name]; !ok {
+					*errs = append(*errs, ValidationError{Field: path + "." + name, Message: "is required"})
+				}
+			}
+		}
+
+		// Sorted so errors come out in a stable order
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if sub, ok := props[k].(map[string]interface{}); ok {
+				validateValue(sub, v[k], path+"."+k, errs)
+				continue
+			}
+			switch ap := schema["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					*errs = append(*errs, ValidationError{Field: path + "." + k, Message: "is not an allowed property"})
+				}
+			case map[string]interface{}:
+				validateValue(ap, v[k], path+"."+k, errs)
+			}
+		}
+
+	case []interface{}:
+		if min, ok := schema["minItems"].(float64); ok && float64(len(v)) < min {
+			fail("must have at least %v items", min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(v)) > max {
+			fail("must have at most %v items", max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validateValue(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := schema["minLength"].(float64); ok && length < min {
+			fail("must be at least %v characters", min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && length > max {
+			fail("must be at most %v characters", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && v < min {
+			fail("must be at least %v", min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && v > max {
+			fail("must be at most %v", max)
+		}
+	}
+}
+
+func schemaTypeList(t interface{}) ([]string, bool) {
+	switch v := t.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		types := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			types = append(types, s)
+		}
+		return types, true
+	}
+	return nil, false
+}
+
+func valueHasType(value interface{}, name string) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
@@ -0,0 +1,88 @@
+package validation
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("bad test JSON %s: %v", s, err)
+	}
+	return v
+}
+
+const testSchema = `{
+	"type": "object",
+	"required": ["port"],
+	"additionalProperties": false,
+	"properties": {
+		"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+		"mode": {"enum": ["blue", "green"]},
+		"hosts": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z.]+$"}},
+		"debug": {"type": ["boolean", "null"]}
+	}
+}`
+
+func TestValidateAgainstSchema(t *testing.T) {
+	schema := decodeJSON(t, testSchema).(map[string]interface{})
+
+	tests := []struct {
+		name   string
+		doc    string
+		fields []string
+	}{
+		{"valid", `{"port": 8080, "mode": "blue", "hosts": ["a.example"], "debug": null}`, nil},
+		{"missing required", `{"mode": "green"}`, []string{"config.port"}},
+		{"not an integer", `{"port": 80.5}`, []string{"config.port"}},
+		{"out of range", `{"port": 70000}`, []string{"config.port"}},
+		{"not in enum", `{"port": 80, "mode": "red"}`, []string{"config.mode"}},
+		{"unknown property", `{"port": 80, "extra": 1}`, []string{"config.extra"}},
+		{"bad array item", `{"port": 80, "hosts": ["ok", "NOT OK"]}`, []string{"config.hosts[1]"}},
+		{"too many items", `{"port": 80, "hosts": ["a", "b", "c"]}`, []string{"config.hosts"}},
+		{"wrong type", `[1, 2]`, []string{"config"}},
+		{"several errors", `{"port": 0, "debug": "yes"}`, []string{"config.debug", "config.port"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateAgainstSchema(schema, decodeJSON(t, tt.doc), "config")
+			if len(errs) != len(tt.fields) {
+				t.Fatalf("ValidateAgainstSchema() = %v, want errors for %v", errs, tt.fields)
+			}
+			for i, err := range errs {
+				if err.Field != tt.fields[i] {
+					t.Errorf("error %d field = %s, want %s", i, err.Field, tt.fields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"valid", testSchema, false},
+		{"empty", `{}`, false},
+		{"unknown type", `{"type": "date"}`, true},
+		{"bad properties", `{"properties": []}`, true},
+		{"bad nested type", `{"properties": {"a": {"type": 1}}}`, true},
+		{"bad required", `{"required": [1]}`, true},
+		{"bad pattern", `{"pattern": "("}`, true},
+		{"bad minimum", `{"minimum": "1"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSchema(decodeJSON(t, tt.schema).(map[string]interface{}))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -13,6 +13,10 @@ var (
 	nameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,64}$`)
 	// Valid version format (semver-like)
 	versionRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,32}$`)
+	// Valid node name (hostname-like)
+	nodeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{2,63}$`)
+	// Valid label key (optionally prefixed, e.g. "stratus.io/gpu")
+	labelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]{0,61}[a-zA-Z0-9])?$`)
 )
 
 var validRegions = map[string]bool{
@@ -92,6 +96,78 @@ func ValidateVersion(version string) error {
 	return nil
 }
 
+func ValidateNodeName(name string) error {
+	if name == "" {
+		return ValidationError{Field: "name", Message: "name is required"}
+	}
+	if !nodeNameRegex.MatchString(name) {
+		return ValidationError{Field: "name", Message: "name must be 3-64 characters of letters, digits, dots, hyphens, or underscores"}
+	}
+	return nil
+}
+
+func ValidateNodeCapacity(cpuCores float64, memoryMB int64, maxServices int) error {
+	if cpuCores <= 0 {
+		return ValidationError{Field: "capacity.cpu_cores", Message: "cpu_cores must be positive"}
+	}
+	if memoryMB <= 0 {
+		return ValidationError{Field: "capacity.memory_mb", Message: "memory_mb must be positive"}
+	}
+	if maxServices <= 0 {
+		return ValidationError{Field: "capacity.max_services", Message: "max_services must be positive"}
+	}
+	return nil
+}
+
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > 32 {
+		return ValidationError{Field: "labels", Message: "at most 32 labels are allowed"}
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return ValidationError{Field: "labels", Message: fmt.Sprintf("invalid label key %q", key)}
+		}
+		if len(value) > 63 {
+			return ValidationError{Field: "labels", Message: fmt.Sprintf("label %q value too long (max 63 characters)", key)}
+		}
+	}
+	return nil
+}
+
+func ValidatePercentage(field string, value float64) error {
+	if value < 0 || value > 100 {
+		return ValidationError{Field: field, Message: fmt.Sprintf("%s must be between 0 and 100", field)}
+	}
+	return nil
+}
+
+func ValidateSeconds(field string, value, max int) error {
+	if value < 0 || value > max {
+		return ValidationError{Field: field, Message: fmt.Sprintf("%s must be between 0 and %d", field, max)}
+	}
+	return nil
+}
+
+// ValidateDesiredStatus accepts the statuses an operator may request. starting
+// and error are observed-only and set by the reconciler.
+func ValidateDesiredStatus(status string) error {
+	if status == "" {
+		return ValidationError{Field: "desired_status", Message: "desired_status is required"}
+	}
+	if status != "running" && status != "stopped" {
+		return ValidationError{Field: "desired_status", Message: "desired_status must be running or stopped"}
+	}
+	return nil
+}
+
+// ValidateDeploymentStrategy accepts an empty strategy, which means rolling.
+func ValidateDeploymentStrategy(strategy string) error {
+	if strategy != "" && strategy != "rolling" && strategy != "canary" {
+		return ValidationError{Field: "strategy", Message: "strategy must be rolling or canary"}
+	}
+	return nil
+}
+
 func getRegionList() []string {
 	regions := make([]string, 0, len(validRegions))
 	for region := range validRegions {
@@ -97,3 +97,118 @@ func TestValidateVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateDesiredStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"running", "running", false},
+		{"stopped", "stopped", false},
+		{"observed-only starting", "starting", true},
+		{"observed-only error", "error", true},
+		{"empty status", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDesiredStatus(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDesiredStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNodeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"valid name", "edge-fra-01", false},
+		{"valid hostname", "node1.fra.example", false},
+		{"empty name", "", true},
+		{"too short", "ab", true},
+		{"leading dot", ".edge-01", true},
+		{"invalid characters", "edge 01", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNodeName(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateNodeName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   map[string]string
+		wantErr bool
+	}{
+		{"no labels", nil, false},
+		{"simple labels", map[string]string{"team": "payments", "gpu": "true"}, false},
+		{"prefixed key", map[string]string{"stratus.io/tier": "edge"}, false},
+		{"invalid key", map[string]string{"bad key": "x"}, true},
+		{"value too long", map[string]string{"team": string(make([]byte, 64))}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLabels(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePercentage(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   float64
+		wantErr bool
+	}{
+		{"zero", 0, false},
+		{"fraction", 2.5, false},
+		{"hundred", 100, false},
+		{"negative", -1, true},
+		{"over hundred", 100.1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePercentage("max_error_rate", tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePercentage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDeploymentStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"rolling", "rolling", false},
+		{"canary", "canary", false},
+		{"unknown", "blue-green", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDeploymentStrategy(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDeploymentStrategy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,21 +17,158 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 4096
+	maxTopics      = 100
 )
 
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan Message
+
+	mu     sync.RWMutex
+	topics map[string]bool
+	// implicit is set while a client that connected without topics still
+	// receives everything; its first subscribe frame ends that.
+	implicit bool
+
+	// resume and since are set by ResumeAfter before the client is
+	// registered.
+	resume bool
+	since  int64
+
+	// projects, set by RestrictToProjects before the client is registered,
+	// are those whose messages it receives; nil means all of them.
+	projects map[string]bool
+}
+
+// NewClient creates a client subscribed to topics, or to every message when
+// topics is empty.
+func NewClient(hub *Hub, conn *websocket.Conn, topics []string) *Client {
+	c := &Client{
+		hub:    hub,
+		conn:   conn,
+		send:   make(chan Message, 256),
+		topics: make(map[string]bool),
+	}
+	for _, t := range topics {
+		c.topics[t] = true
+	}
+	if len(topics) == 0 {
+		c.topics[TopicAll] = true
+		c.implicit = true
+	}
+	return c
+}
+
+// ResumeAfter asks for the broadcast messages numbered after seq to be
+// replayed before live ones, or a resync_required message when they are no
+// longer buffered. Call it before registering the client.
+func (c *Client) ResumeAfter(seq int64) {
+	c.resume = true
+	c.since = seq
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn) *Client {
-	return &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan Message, 256),
+// RestrictToProjects limits the client to messages about the services of
+// projects, and messages about no service at all. Call it before
+// registering the client.
+func (c *Client) RestrictToProjects(projects []string) {
+	c.projects = make(map[string]bool, len(projects))
+	for _, p := range projects {
+		c.projects[p] = true
+	}
+}
+
+// visible reports whether a message is about a project the client can see.
+func (c *Client) visible(message Message) bool {
+	if c.projects == nil {
+		return true
+	}
+	if message.ProjectID != "" {
+		return c.projects[message.ProjectID]
 	}
+	// A service whose project is unknown could be anyone's
+	for _, topic := range message.topics {
+		if strings.HasPrefix(topic, ServiceTopicPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientFrame is what clients send: {"action": "subscribe", "topics": [...]}
+// or the same with "unsubscribe".
+type clientFrame struct {
+	Action string   `json:"action"`
+	Topics []string `json:"topics"`
+}
+
+// subscribed reports whether the client wants a message published on topics.
+func (c *Client) subscribed(topics []string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.topics[TopicAll] {
+		return true
+	}
+	for _, t := range topics {
+		if c.topics[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFrame applies a subscribe or unsubscribe frame and returns the reply:
+// the resulting subscriptions, or an error.
+func (c *Client) handleFrame(data []byte) Message {
+	var frame clientFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return errorMessage("frames must be JSON objects with an action and topics")
+	}
+	for _, t := range frame.Topics {
+		if !ValidTopic(t) {
+			return errorMessage(fmt.Sprintf("unknown topic %q", t))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch frame.Action {
+	case "subscribe":
+		if c.implicit {
+			delete(c.topics, TopicAll)
+			c.implicit = false
+		}
+		for _, t := range frame.Topics {
+			c.topics[t] = true
+		}
+		if len(c.topics) > maxTopics {
+			for _, t := range frame.Topics {
+				delete(c.topics, t)
+			}
+			return errorMessage(fmt.Sprintf("at most %d topics per connection", maxTopics))
+		}
+	case "unsubscribe":
+		c.implicit = false
+		for _, t := range frame.Topics {
+			delete(c.topics, t)
+		}
+	default:
+		return errorMessage("action must be subscribe or unsubscribe")
+	}
+
+	topics := make([]string, 0, len(c.topics))
+	for t := range c.topics {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return Message{Type: MessageTypeSubscriptions, Payload: map[string]interface{}{"topics": topics}}
+}
+
+func errorMessage(message string) Message {
+	return Message{Type: MessageTypeError, Payload: map[string]interface{}{"message": message}}
 }
 
 func (c *Client) ReadPump() {
@@ -43,47 +185,104 @@ func (c *Client) ReadPump() {
 	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		c.hub.reply(c, c.handleFrame(data))
 	}
 }
 
 func (c *Client) WritePump() {
+	defer c.conn.Close()
+
+	c.Stream(context.Background(), c.writeMessage, func() error {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return c.conn.WriteMessage(websocket.PingMessage, nil)
+	})
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
+
+// Stream passes a resuming client's backlog and then its live messages to
+// write, calling ping when idle, until ctx is done, the hub drops the client
+// or write or ping fails. It lets transports other than WebSocket, such as
+// Server-Sent Events, serve a client registered with the hub.
+func (c *Client) Stream(ctx context.Context, write func(Message) error, ping func() error) {
 	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
+	defer ticker.Stop()
+
+	// The client is registered before the replay is read, so live messages
+	// queued meanwhile that were also replayed are skipped.
+	backlog, replayed := c.backlog()
+	for _, message := range backlog {
+		if err := write(message); err != nil {
+			return
+		}
+	}
 
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-
-			data, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("Error marshaling message: %v", err)
+			if message.Seq != 0 && message.Seq <= replayed {
 				continue
 			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			if err := write(message); err != nil {
 				return
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := ping(); err != nil {
 				return
 			}
+
+		case <-ctx.Done():
+			return
 		}
 	}
 }
+
+// backlog returns what a resuming client missed: the replayed messages
+// matching its topics, or a resync_required message. replayed is the last
+// sequence number covered.
+func (c *Client) backlog() (messages []Message, replayed int64) {
+	if !c.resume {
+		return nil, 0
+	}
+
+	missed, complete := c.hub.replaySince(c.since)
+	if !complete {
+		return []Message{{
+			Type:    MessageTypeResyncRequired,
+			Payload: map[string]interface{}{"since": c.since},
+		}}, 0
+	}
+
+	for _, message := range missed {
+		if c.subscribed(message.topics) && c.visible(message) {
+			messages = append(messages, message)
+		}
+	}
+	if len(missed) == 0 {
+		return messages, c.since
+	}
+	return messages, missed[len(missed)-1].Seq
+}
+
+func (c *Client) writeMessage(message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return nil
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const fanoutChannel = "ws:broadcast"
+
+// fanout relays broadcast messages between replicas through Redis pub/sub.
+// Each replica delivers its own messages directly and publishes them; the
+// others deliver them when they arrive.
+type fanout struct {
+	rdb *redis.Client
+	// origin identifies this replica so it can ignore its own publications.
+	origin string
+}
+
+func newFanout(rdb *redis.Client) *fanout {
+	return &fanout{rdb: rdb, origin: uuid.NewString()}
+}
+
+type fanoutEnvelope struct {
+	Origin  string  `json:"origin"`
+	Message Message `json:"message"`
+}
+
+func (f *fanout) publish(ctx context.Context, message Message) error {
+	data, err := json.Marshal(fanoutEnvelope{Origin: f.origin, Message: message})
+	if err != nil {
+		return err
+	}
+	return f.rdb.Publish(ctx, fanoutChannel, data).Err()
+}
+
+// consume forwards messages published by other replicas to deliver until ctx
+// is cancelled. The subscription reconnects by itself if Redis goes away.
+func (f *fanout) consume(ctx context.Context, deliver func(Message)) {
+	pubsub := f.rdb.Subscribe(ctx, fanoutChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		message, ok, err := f.decode(msg.Payload)
+		if err != nil {
+			log.Printf("Failed to decode fan-out message: %v", err)
+			continue
+		}
+		if ok {
+			deliver(message)
+		}
+	}
+}
+
+// decode unwraps a published message; ok is false for this replica's own.
+func (f *fanout) decode(payload string) (message Message, ok bool, err error) {
+	var envelope fanoutEnvelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return Message{}, false, err
+	}
+	if envelope.Origin == f.origin {
+		return Message{}, false, nil
+	}
+
+	message = envelope.Message
+	message.topics = messageTopics(message.Type, message.Payload)
+	message.remote = true
+	return message, true, nil
+}
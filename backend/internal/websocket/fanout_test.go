@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFanoutDecode(t *testing.T) {
+	local := &fanout{origin: "a"}
+	data, err := json.Marshal(fanoutEnvelope{
+		Origin: "b",
+		Message: Message{
+			Seq:     7,
+			Type:    MessageTypeServiceUpdate,
+			Payload: map[string]interface{}{"id": "svc", "region": "eu-west-1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, ok, err := local.decode(string(data))
+	if err != nil || !ok {
+		t.Fatalf("decode() = %v, %v", ok, err)
+	}
+	if message.Seq != 7 || !message.remote {
+		t.Errorf("decode() = %+v, want seq 7 marked remote", message)
+	}
+	if want := []string{"services", "service:svc", "region:eu-west-1"}; !reflect.DeepEqual(message.topics, want) {
+		t.Errorf("topics = %v, want %v", message.topics, want)
+	}
+
+	own := &fanout{origin: "b"}
+	if _, ok, err := own.decode(string(data)); ok || err != nil {
+		t.Errorf("a replica should skip its own messages, got %v, %v", ok, err)
+	}
+
+	if _, _, err := local.decode("not json"); err == nil {
+		t.Error("decode() should fail on malformed payloads")
+	}
+}
@@ -1,9 +1,14 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 type MessageType string
@@ -12,11 +17,33 @@ const (
 	MessageTypeServiceUpdate MessageType = "service_update"
 	MessageTypeMetrics       MessageType = "metrics"
 	MessageTypeLog           MessageType = "log"
+	MessageTypeNodeUpdate    MessageType = "node_update"
+	MessageTypeDeployment    MessageType = "deployment_update"
+	MessageTypeConfigUpdate  MessageType = "config_update"
+	MessageTypeAlert         MessageType = "alert"
+
+	// Replies to a client's own frames
+	MessageTypeSubscriptions MessageType = "subscriptions"
+	MessageTypeError         MessageType = "error"
+
+	// Sent instead of a replay when a resuming client's gap is no longer
+	// buffered; the client should refetch its state.
+	MessageTypeResyncRequired MessageType = "resync_required"
 )
 
 type Message struct {
-	Type    MessageType `json:"type"`
-	Payload interface{} `json:"payload"`
+	// Seq numbers broadcast messages when replay is enabled. Replies to a
+	// client's own frames have none.
+	Seq  int64       `json:"seq,omitempty"`
+	Type MessageType `json:"type"`
+	// ProjectID is the project of the service the message is about, if
+	// any. Clients restricted to projects only receive their projects'.
+	ProjectID string      `json:"project_id,omitempty"`
+	Payload   interface{} `json:"payload"`
+
+	topics []string
+	// remote is set on messages relayed from another replica.
+	remote bool
 }
 
 type Hub struct {
@@ -24,19 +51,44 @@ type Hub struct {
 	broadcast  chan Message
 	register   chan *Client
 	unregister chan *Client
-	mu         sync.RWMutex
+	listeners  []func(Message)
+	relayed    []func(Message)
+	replay     *replayBuffer
+	fanout     *fanout
+	// outbox holds messages broadcast on this replica until they are
+	// numbered and published, when replay or fan-out is enabled, so Run
+	// never waits on Redis.
+	outbox    chan Message
+	projectOf func(serviceID string) string
+	mu        sync.RWMutex
 }
 
 func NewHub() *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
 		broadcast:  make(chan Message, 256),
+		outbox:     make(chan Message, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 	}
 }
 
 func (h *Hub) Run() {
+	if h.replay != nil || h.fanout != nil {
+		go h.publish()
+	}
+	if h.fanout != nil {
+		go h.fanout.consume(context.Background(), func(message Message) {
+			h.mu.RLock()
+			relayed := h.relayed
+			h.mu.RUnlock()
+			for _, listen := range relayed {
+				listen(message)
+			}
+			h.broadcast <- message
+		})
+	}
+
 	for {
 		select {
 		case client := <-h.register:
@@ -55,8 +107,11 @@ func (h *Hub) Run() {
 			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
 
 		case message := <-h.broadcast:
-			h.mu.RLock()
+			h.mu.Lock()
 			for client := range h.clients {
+				if !client.subscribed(message.topics) || !client.visible(message) {
+					continue
+				}
 				select {
 				case client.send <- message:
 				default:
@@ -64,7 +119,7 @@ func (h *Hub) Run() {
 					delete(h.clients, client)
 				}
 			}
-			h.mu.RUnlock()
+			h.mu.Unlock()
 		}
 	}
 }
@@ -73,8 +128,111 @@ func (h *Hub) Broadcast(msgType MessageType, payload interface{}) {
 	message := Message{
 		Type:    msgType,
 		Payload: payload,
+		topics:  messageTopics(msgType, payload),
+	}
+	message.ProjectID = h.messageProject(message)
+
+	h.mu.RLock()
+	listeners := h.listeners
+	h.mu.RUnlock()
+	for _, listen := range listeners {
+		listen(message)
+	}
+
+	if h.replay == nil && h.fanout == nil {
+		h.broadcast <- message
+		return
+	}
+	select {
+	case h.outbox <- message:
+	default:
+		// Redis is falling behind; clients here still get the message
+		log.Printf("Broadcast outbox full, delivering %s message locally only", message.Type)
+		h.broadcast <- message
+	}
+}
+
+// publish distributes the messages broadcast on this replica, in order, and
+// then hands them to Run for delivery.
+func (h *Hub) publish() {
+	for message := range h.outbox {
+		h.distribute(&message)
+		h.broadcast <- message
+	}
+}
+
+// UseProjects has broadcast messages about a service carry its project,
+// as found by projectOf, so they reach only clients that can see it. Call
+// it before anything is broadcast.
+func (h *Hub) UseProjects(projectOf func(serviceID string) string) {
+	h.projectOf = projectOf
+}
+
+// messageProject returns the project_id in a message's payload or else
+// the project of the first service it refers to.
+func (h *Hub) messageProject(message Message) string {
+	if project, ok := payloadFields(message.Payload)["project_id"].(string); ok && project != "" {
+		return project
+	}
+	if h.projectOf == nil {
+		return ""
+	}
+	for _, topic := range message.topics {
+		if id, ok := strings.CutPrefix(topic, ServiceTopicPrefix); ok {
+			return h.projectOf(id)
+		}
 	}
-	h.broadcast <- message
+	return ""
+}
+
+// EnableReplay numbers broadcast messages and keeps the last size of them in
+// Redis for clients resuming with Client.ResumeAfter. Call it before Run.
+func (h *Hub) EnableReplay(rdb *redis.Client, size int64) {
+	h.replay = &replayBuffer{rdb: rdb, size: size}
+}
+
+// EnableFanout relays broadcasts between replicas sharing rdb, so clients
+// receive every replica's messages. Call it before Run.
+func (h *Hub) EnableFanout(rdb *redis.Client) {
+	h.fanout = newFanout(rdb)
+}
+
+// distribute numbers a message broadcast on this replica and publishes it to
+// the others. Messages relayed from other replicas were numbered by their
+// origin.
+func (h *Hub) distribute(message *Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if h.replay != nil && replayable(message.Type) {
+		if err := h.replay.record(ctx, message); err != nil {
+			log.Printf("Failed to record message for replay: %v", err)
+		}
+	}
+	if h.fanout != nil {
+		if err := h.fanout.publish(ctx, *message); err != nil {
+			log.Printf("Failed to publish message to other replicas: %v", err)
+		}
+	}
+}
+
+// Listen registers fn to receive every message broadcast on this replica,
+// e.g. to forward events beyond WebSocket clients. Messages relayed from
+// other replicas are not passed on, so each event reaches listeners once. fn
+// is called from Broadcast and must not block.
+func (h *Hub) Listen(fn func(Message)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+// ListenRelayed registers fn to receive every message relayed from another
+// replica, e.g. to drop state cached for what it is about. fn is called
+// before the message is delivered and must not block.
+func (h *Hub) ListenRelayed(fn func(Message)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.relayed = append(h.relayed, fn)
 }
 
 func (h *Hub) BroadcastJSON(msgType MessageType, payload interface{}) error {
@@ -92,6 +250,51 @@ func (h *Hub) BroadcastJSON(msgType MessageType, payload interface{}) error {
 	return nil
 }
 
+// ClientCount returns the number of connected clients.
+func (h *Hub) ClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// reply sends a message to one client unless it has been disconnected or
+// its buffer is full.
+func (h *Hub) reply(client *Client, message Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+	}
+}
+
+// replaySince returns the messages a client resuming after seq missed;
+// complete is false when it has to resync instead.
+func (h *Hub) replaySince(seq int64) (messages []Message, complete bool) {
+	if h.replay == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, complete, err := h.replay.since(ctx, seq)
+	if err != nil {
+		log.Printf("Failed to read replay buffer: %v", err)
+		return nil, false
+	}
+	return messages, complete
+}
+
 func (h *Hub) Register(client *Client) {
 	h.register <- client
 }
+
+// Unregister removes a client that is not served by ReadPump, which
+// unregisters WebSocket clients itself.
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	seqKey    = "ws:seq"
+	replayKey = "ws:replay"
+)
+
+// replayBuffer numbers broadcast messages and keeps the latest size of them
+// in Redis, so clients can resume after a reconnect, or a restart, without
+// missing anything.
+type replayBuffer struct {
+	rdb  *redis.Client
+	size int64
+}
+
+// replayable reports whether messages of type t are numbered and buffered.
+// Metrics samples are not: there is one per sample, enough to flush the
+// buffer within seconds, and clients refetch the series instead.
+func replayable(t MessageType) bool {
+	return t != MessageTypeMetrics
+}
+
+// record assigns message the next sequence number and appends it to the
+// buffer, dropping the oldest entries beyond size.
+func (b *replayBuffer) record(ctx context.Context, message *Message) error {
+	seq, err := b.rdb.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	pipe := b.rdb.TxPipeline()
+	pipe.ZAdd(ctx, replayKey, redis.Z{Score: float64(seq), Member: data})
+	pipe.ZRemRangeByRank(ctx, replayKey, 0, -b.size-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// since returns the buffered messages numbered after seq, oldest first.
+// complete is false when some of them are no longer buffered, or seq is from
+// a sequence that has since been reset, and the client has to resync.
+func (b *replayBuffer) since(ctx context.Context, seq int64) (messages []Message, complete bool, err error) {
+	latest, err := b.rdb.Get(ctx, seqKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, false, err
+	}
+	if seq >= latest {
+		return nil, seq == latest, nil
+	}
+
+	entries, err := b.rdb.ZRangeByScore(ctx, replayKey, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(seq, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages, err = decodeMessages(entries)
+	if err != nil {
+		return nil, false, err
+	}
+	return messages, contiguous(seq, messages), nil
+}
+
+func decodeMessages(entries []string) ([]Message, error) {
+	messages := make([]Message, 0, len(entries))
+	for _, entry := range entries {
+		var m Message
+		if err := json.Unmarshal([]byte(entry), &m); err != nil {
+			return nil, err
+		}
+		m.topics = messageTopics(m.Type, m.Payload)
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// contiguous reports whether messages continue directly from seq without
+// gaps, which appear when entries were trimmed or failed to be recorded.
+func contiguous(seq int64, messages []Message) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	for i, m := range messages {
+		if m.Seq != seq+int64(i)+1 {
+			return false
+		}
+	}
+	return true
+}
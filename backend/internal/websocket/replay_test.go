@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContiguous(t *testing.T) {
+	seqs := func(ns ...int64) []Message {
+		messages := make([]Message, len(ns))
+		for i, n := range ns {
+			messages[i].Seq = n
+		}
+		return messages
+	}
+
+	tests := []struct {
+		name     string
+		since    int64
+		messages []Message
+		want     bool
+	}{
+		{"continues", 4, seqs(5, 6, 7), true},
+		{"from start", 0, seqs(1), true},
+		{"trimmed", 4, seqs(9, 10), false},
+		{"hole", 4, seqs(5, 7), false},
+		{"nothing buffered", 4, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contiguous(tt.since, tt.messages); got != tt.want {
+				t.Errorf("contiguous() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessages(t *testing.T) {
+	messages, err := decodeMessages([]string{
+		`{"seq":3,"type":"log","payload":{"service_id":"a","message":"started"}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Seq != 3 || messages[0].Type != MessageTypeLog {
+		t.Fatalf("decodeMessages() = %+v", messages)
+	}
+	if want := []string{"logs", "service:a"}; !reflect.DeepEqual(messages[0].topics, want) {
+		t.Errorf("topics = %v, want %v", messages[0].topics, want)
+	}
+
+	if _, err := decodeMessages([]string{"{"}); err == nil {
+		t.Error("decodeMessages() should fail on malformed entries")
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	if replayable(MessageTypeMetrics) {
+		t.Error("metrics samples should not be replayed")
+	}
+	for _, msgType := range []MessageType{MessageTypeServiceUpdate, MessageTypeLog, MessageTypeAlert, MessageTypeDeployment} {
+		if !replayable(msgType) {
+			t.Errorf("%s messages should be replayed", msgType)
+		}
+	}
+}
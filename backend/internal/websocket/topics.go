@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Topics a client can subscribe to. A message is delivered to a client
+// subscribed to any of its topics; "*" matches every message.
+const (
+	TopicAll         = "*"
+	TopicServices    = "services"
+	TopicMetrics     = "metrics"
+	TopicLogs        = "logs"
+	TopicNodes       = "nodes"
+	TopicDeployments = "deployments"
+	TopicConfigs     = "configs"
+	TopicAlerts      = "alerts"
+
+	ServiceTopicPrefix = "service:" // service:<id>
+	RegionTopicPrefix  = "region:"  // region:<name>
+
+	maxTopicLength = 100
+)
+
+var typeTopics = map[MessageType]string{
+	MessageTypeServiceUpdate: TopicServices,
+	MessageTypeMetrics:       TopicMetrics,
+	MessageTypeLog:           TopicLogs,
+	MessageTypeNodeUpdate:    TopicNodes,
+	MessageTypeDeployment:    TopicDeployments,
+	MessageTypeConfigUpdate:  TopicConfigs,
+	MessageTypeAlert:         TopicAlerts,
+}
+
+// ValidTopic reports whether a client may subscribe to topic.
+func ValidTopic(topic string) bool {
+	if topic == TopicAll {
+		return true
+	}
+	for _, t := range typeTopics {
+		if topic == t {
+			return true
+		}
+	}
+	for _, prefix := range []string{ServiceTopicPrefix, RegionTopicPrefix} {
+		if strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) && len(topic) <= maxTopicLength {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTopics returns the topics a message is published on: one for its
+// type, plus service:<id> and region:<name> for every service and region the
+// payload refers to.
+func messageTopics(msgType MessageType, payload interface{}) []string {
+	var topics []string
+	if t, ok := typeTopics[msgType]; ok {
+		topics = append(topics, t)
+	}
+
+	fields := payloadFields(payload)
+	add := func(prefix string, value interface{}) {
+		if s, ok := value.(string); ok && s != "" {
+			topics = append(topics, prefix+s)
+		}
+	}
+
+	if msgType == MessageTypeServiceUpdate {
+		add(ServiceTopicPrefix, fields["id"])
+	}
+	add(ServiceTopicPrefix, fields["service_id"])
+	add(RegionTopicPrefix, fields["region"])
+
+	// Deployments span every instance they target
+	if targets, ok := fields["targets"].([]interface{}); ok {
+		for _, t := range targets {
+			if target, ok := t.(map[string]interface{}); ok {
+				add(ServiceTopicPrefix, target["service_id"])
+				add(RegionTopicPrefix, target["region"])
+			}
+		}
+	}
+
+	return topics
+}
+
+// payloadFields returns the top-level fields of a payload. BroadcastJSON
+// payloads already are generic maps; anything else is converted.
+func payloadFields(payload interface{}) map[string]interface{} {
+	if m, ok := payload.(map[string]interface{}); ok {
+		return m
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
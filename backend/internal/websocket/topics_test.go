@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgType MessageType
+		payload interface{}
+		want    []string
+	}{
+		{"service", MessageTypeServiceUpdate, map[string]interface{}{"id": "a", "region": "us-east-1"},
+			[]string{"services", "service:a", "region:us-east-1"}},
+		{"metrics", MessageTypeMetrics, map[string]interface{}{"service_id": "a"},
+			[]string{"metrics", "service:a"}},
+		{"alert", MessageTypeAlert, map[string]interface{}{"service_id": "a", "state": "firing"},
+			[]string{"alerts", "service:a"}},
+		{"deployment", MessageTypeDeployment, map[string]interface{}{
+			"service_id": "a",
+			"targets": []interface{}{
+				map[string]interface{}{"service_id": "b", "region": "eu-west-1"},
+			},
+		}, []string{"deployments", "service:a", "service:b", "region:eu-west-1"}},
+		{"non-map payload", MessageTypeServiceUpdate, struct {
+			ID string `json:"id"`
+		}{"a"}, []string{"services", "service:a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messageTopics(tt.msgType, tt.payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messageTopics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	for _, topic := range []string{"*", "metrics", "logs", "alerts", "service:abc", "region:us-east-1"} {
+		if !ValidTopic(topic) {
+			t.Errorf("ValidTopic(%q) = false, want true", topic)
+		}
+	}
+	for _, topic := range []string{"", "service:", "everything", "region"} {
+		if ValidTopic(topic) {
+			t.Errorf("ValidTopic(%q) = true, want false", topic)
+		}
+	}
+}
+
+func TestClientSubscriptions(t *testing.T) {
+	c := NewClient(nil, nil, nil)
+	if !c.subscribed([]string{"metrics", "service:a"}) {
+		t.Fatal("client without topics should receive everything")
+	}
+
+	reply := c.handleFrame([]byte(`{"action": "subscribe", "topics": ["service:a", "alerts"]}`))
+	if reply.Type != MessageTypeSubscriptions {
+		t.Fatalf("subscribe reply = %+v", reply)
+	}
+	if want := []string{"alerts", "service:a"}; !reflect.DeepEqual(reply.Payload.(map[string]interface{})["topics"], want) {
+		t.Errorf("subscriptions = %v, want %v", reply.Payload, want)
+	}
+	if !c.subscribed([]string{"metrics", "service:a"}) || c.subscribed([]string{"metrics", "service:b"}) {
+		t.Error("first subscribe should replace the implicit subscription to everything")
+	}
+
+	c.handleFrame([]byte(`{"action": "unsubscribe", "topics": ["service:a"]}`))
+	if c.subscribed([]string{"metrics", "service:a"}) || !c.subscribed([]string{"alerts", "service:b"}) {
+		t.Error("unsubscribe should only drop the given topic")
+	}
+
+	for _, frame := range []string{`nonsense`, `{"action": "subscribe", "topics": ["bogus"]}`, `{"action": "publish"}`} {
+		if reply := c.handleFrame([]byte(frame)); reply.Type != MessageTypeError {
+			t.Errorf("handleFrame(%s) = %+v, want an error", frame, reply)
+		}
+	}
+
+	explicit := NewClient(nil, nil, []string{"logs"})
+	if explicit.subscribed([]string{"metrics"}) || !explicit.subscribed([]string{"logs"}) {
+		t.Error("client with topics should only receive those")
+	}
+}
+
+func TestMessageProjects(t *testing.T) {
+	h := NewHub()
+	h.UseProjects(func(serviceID string) string {
+		return map[string]string{"a": "payments"}[serviceID]
+	})
+	message := func(msgType MessageType, payload map[string]interface{}) Message {
+		m := Message{Type: msgType, Payload: payload, topics: messageTopics(msgType, payload)}
+		m.ProjectID = h.messageProject(m)
+		return m
+	}
+
+	metrics := message(MessageTypeMetrics, map[string]interface{}{"service_id": "a"})
+	deleted := message(MessageTypeServiceUpdate, map[string]interface{}{"id": "gone", "project_id": "search", "action": "deleted"})
+	unknown := message(MessageTypeLog, map[string]interface{}{"service_id": "gone"})
+	node := message(MessageTypeNodeUpdate, map[string]interface{}{"id": "node-1"})
+	if metrics.ProjectID != "payments" || deleted.ProjectID != "search" || unknown.ProjectID != "" || node.ProjectID != "" {
+		t.Fatalf("projects = %q, %q, %q, %q", metrics.ProjectID, deleted.ProjectID, unknown.ProjectID, node.ProjectID)
+	}
+
+	everyone := NewClient(nil, nil, nil)
+	payments := NewClient(nil, nil, nil)
+	payments.RestrictToProjects([]string{"default", "payments"})
+
+	tests := []struct {
+		name            string
+		message         Message
+		everyone, teams bool
+	}{
+		{"own project", metrics, true, true},
+		{"other project", deleted, true, false},
+		{"service of unknown project", unknown, true, false},
+		{"no service", node, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := everyone.visible(tt.message); got != tt.everyone {
+				t.Errorf("unrestricted visible() = %v, want %v", got, tt.everyone)
+			}
+			if got := payments.visible(tt.message); got != tt.teams {
+				t.Errorf("restricted visible() = %v, want %v", got, tt.teams)
+			}
+		})
+	}
+}
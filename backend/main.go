@@ -44,6 +44,8 @@ func main() {
 
 	// Initialize WebSocket hub
 	hub := websocket.NewHub()
+	hub.EnableReplay(redisClient, cfg.WSReplaySize)
+	hub.EnableFanout(redisClient)
 	go hub.Run()
 
 	// Setup router
@@ -58,7 +60,7 @@ func main() {
 		Addr:           ":" + cfg.Port,
 		Handler:        r,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   60 * time.Second, // agents long-poll /assignments for up to 50s
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -64,8 +64,8 @@ export default function Dashboard() {
   }, [])
 
   useEffect(() => {
-    if (lastMessage?.type === 'service_update') {
-      // Refresh services when an update is received
+    if (lastMessage?.type === 'service_update' || lastMessage?.type === 'resync_required') {
+      // Refresh services when an update is received or updates were missed
       fetchServices()
     }
   }, [lastMessage])
@@ -97,7 +97,7 @@ export default function Dashboard() {
 
   const handleStartService = async (id: string) => {
     try {
-      await api.updateService(id, { status: 'running' })
+      await api.updateService(id, { desired_status: 'running' })
       await fetchServices()
     } catch (error) {
       console.error('Failed to start service:', error)
@@ -106,7 +106,7 @@ export default function Dashboard() {
 
   const handleStopService = async (id: string) => {
     try {
-      await api.updateService(id, { status: 'stopped' })
+      await api.updateService(id, { desired_status: 'stopped' })
       await fetchServices()
     } catch (error) {
       console.error('Failed to stop service:', error)
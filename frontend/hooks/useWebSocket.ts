@@ -5,7 +5,8 @@ import { useEffect, useRef, useState } from 'react'
 const WS_URL = process.env.NEXT_PUBLIC_WS_URL || 'ws://localhost:8080'
 
 export interface WebSocketMessage {
-  type: 'service_update' | 'metrics' | 'log'
+  seq?: number
+  type: 'service_update' | 'metrics' | 'log' | 'resync_required'
   payload: any
 }
 
@@ -14,11 +15,14 @@ export function useWebSocket() {
   const [lastMessage, setLastMessage] = useState<WebSocketMessage | null>(null)
   const wsRef = useRef<WebSocket | null>(null)
   const reconnectTimeoutRef = useRef<NodeJS.Timeout>()
+  // Last sequence number seen, so a reconnect can replay what was missed
+  const lastSeqRef = useRef<number | null>(null)
 
   useEffect(() => {
     function connect() {
       try {
-        const ws = new WebSocket(`${WS_URL}/ws`)
+        const since = lastSeqRef.current
+        const ws = new WebSocket(since === null ? `${WS_URL}/ws` : `${WS_URL}/ws?since=${since}`)
 
         ws.onopen = () => {
           console.log('✅ WebSocket connected')
@@ -28,6 +32,11 @@ export function useWebSocket() {
         ws.onmessage = (event) => {
           try {
             const message = JSON.parse(event.data) as WebSocketMessage
+            if (message.seq !== undefined) {
+              lastSeqRef.current = message.seq
+            } else if (message.type === 'resync_required') {
+              lastSeqRef.current = null
+            }
             setLastMessage(message)
           } catch (error) {
             console.error('Failed to parse WebSocket message:', error)
@@ -2,25 +2,32 @@ const API_URL = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:8080'
 
 export interface Service {
   id: string
+  project_id: string
   name: string
   region: string
+  labels: Record<string, string>
   image: string
   version: string
   status: 'running' | 'stopped' | 'error' | 'starting'
+  desired_status: 'running' | 'stopped'
+  status_message?: string
   uptime: number
   created_at: string
   updated_at: string
 }
 
 export interface CreateServiceRequest {
+  project_id?: string
   name: string
   region: string
+  labels?: Record<string, string>
   image: string
   version: string
 }
 
 export interface UpdateServiceRequest {
-  status?: 'running' | 'stopped' | 'error' | 'starting'
+  desired_status?: 'running' | 'stopped'
+  status?: 'running' | 'stopped'
   version?: string
 }
 